@@ -0,0 +1,94 @@
+// Command migrate applies the schema migrations in db/migrations to the
+// database named by the BLUEPRINT_DB_* variables.
+//
+//	migrate up            apply every pending migration
+//	migrate down -steps 1 roll back the latest migrations
+//	migrate status        list migrations and whether they are applied
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"the-phantom-charge/internal/database"
+	"the-phantom-charge/internal/migrate"
+	"time"
+)
+
+func main() {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	steps := flags.Int("steps", 1, "migrations to roll back with down")
+	timeout := flags.Duration("timeout", 5*time.Minute, "give up after this long, including waiting for another migrator's lock")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: migrate [flags] up|down|status")
+		flags.PrintDefaults()
+	}
+	if len(os.Args) < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	command := os.Args[1]
+	flags.Parse(os.Args[2:])
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	pool, err := database.Open(ctx, database.ConfigFromEnv().ForMigrations())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close()
+	m, err := migrate.NewEmbedded(pool.DB())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch command {
+	case "up":
+		done, err := m.Up(ctx)
+		for _, mig := range done {
+			log.Printf("applied %s", mig)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(done) == 0 {
+			log.Println("schema is up to date")
+		}
+	case "down":
+		if *steps < 1 {
+			log.Fatalf("-steps must be at least 1, got %d", *steps)
+		}
+		done, err := m.Down(ctx, *steps)
+		for _, mig := range done {
+			log.Printf("rolled back %s", mig)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			if s.Modified {
+				state += " (MODIFIED since it was applied)"
+			}
+			fmt.Printf("%-32s %s\n", s.Migration, state)
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// writeComparison prints one column per strategy, one row per invariant.
+func writeComparison(w io.Writer, results []result) {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	}
+	rows := []struct {
+		name  string
+		value func(result) string
+	}{
+		{"crashed", func(r result) string { return strconv.Itoa(r.crashed) }},
+		{"paid", func(r result) string { return strconv.Itoa(r.report.Paid) }},
+		{"failed", func(r result) string { return strconv.Itoa(r.report.Failed) }},
+		{"still_pending", func(r result) string { return strconv.Itoa(len(r.report.StillPending)) }},
+		{"duplicate_charges", func(r result) string { return strconv.Itoa(len(r.report.DuplicateCharges)) }},
+		{"ghost_orders", func(r result) string { return strconv.Itoa(len(r.report.GhostOrders)) }},
+		{"phantom_paid", func(r result) string { return strconv.Itoa(len(r.report.PhantomPaid)) }},
+		{"duplicate_payments", func(r result) string { return strconv.Itoa(len(r.report.DuplicatePayments)) }},
+		{"violations", func(r result) string { return strconv.Itoa(r.report.Violations()) }},
+		{"latency_p50_ms", func(r result) string { return ms(r.latency.P50) }},
+		{"latency_p99_ms", func(r result) string { return ms(r.latency.P99) }},
+	}
+
+	fmt.Fprintln(w, "---------------------------------------------------")
+	fmt.Fprintln(w, "STRATEGY COMPARISON")
+	fmt.Fprintf(w, "  %-20s", "")
+	for _, r := range results {
+		fmt.Fprintf(w, " %14s", r.strategy)
+	}
+	fmt.Fprintln(w)
+	for _, row := range rows {
+		fmt.Fprintf(w, "  %-20s", row.name)
+		for _, r := range results {
+			fmt.Fprintf(w, " %14s", row.value(r))
+		}
+		fmt.Fprintln(w)
+	}
+}
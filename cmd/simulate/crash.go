@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+	"the-phantom-charge/internal/service"
+
+	"github.com/google/uuid"
+)
+
+// crashInjector kills a share of checkouts at one crash point. Each order
+// is considered once, at its first visit to the point.
+type crashInjector struct {
+	point service.CrashPoint
+	rate  float64
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	visited map[uuid.UUID]bool
+	crashed int
+}
+
+func newCrashInjector(point service.CrashPoint, rate float64, seed uint64) *crashInjector {
+	return &crashInjector{
+		point:   point,
+		rate:    rate,
+		rng:     rand.New(rand.NewPCG(seed, seed)),
+		visited: make(map[uuid.UUID]bool),
+	}
+}
+
+func (c *crashInjector) hook(point service.CrashPoint, orderId uuid.UUID) bool {
+	if point != c.point {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.visited[orderId] {
+		return false
+	}
+	c.visited[orderId] = true
+	if c.rng.Float64() >= c.rate {
+		return false
+	}
+	c.crashed++
+	return true
+}
+
+func (c *crashInjector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.crashed
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"the-phantom-charge/internal/simulation"
+	"the-phantom-charge/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+)
+
+// HTTP load generation: drives a running server through its public API
+// instead of calling the service package, so gin, middleware, timeouts and
+// JSON handling are exercised too.
+
+const (
+	endpointCreate   = "create"
+	endpointCheckout = "checkout"
+	endpointStatus   = "status"
+)
+
+// histogramBounds are the upper bounds of the latency histogram buckets.
+var histogramBounds = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	1 * time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// loadStats collects what the clients saw, per endpoint.
+type loadStats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	// endpoint -> error class -> count; class "ok" for 2xx
+	classes map[string]map[string]int
+	// order status the client last saw
+	outcomes map[string]int
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{
+		latencies: make(map[string][]time.Duration),
+		classes:   make(map[string]map[string]int),
+		outcomes:  make(map[string]int),
+	}
+}
+
+func (s *loadStats) record(endpoint string, d time.Duration, class string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies[endpoint] = append(s.latencies[endpoint], d)
+	if s.classes[endpoint] == nil {
+		s.classes[endpoint] = make(map[string]int)
+	}
+	s.classes[endpoint][class]++
+}
+
+func (s *loadStats) outcome(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcomes[status]++
+}
+
+// classify names the result of a request: "ok", "timeout", "connection",
+// or "http_<code>".
+func classify(code int, err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case err != nil:
+		return "connection"
+	case code >= 200 && code < 300:
+		return "ok"
+	default:
+		return "http_" + strconv.Itoa(code)
+	}
+}
+
+type loadClient struct {
+	cfg   config
+	http  *http.Client
+	stats *loadStats
+}
+
+// call makes one request with the client timeout and decodes a JSON body
+// into out on 2xx.
+func (c *loadClient) call(ctx context.Context, endpoint, method, path string, out any) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.clientTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.cfg.target, "/")+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	code := 0
+	if err == nil {
+		code = resp.StatusCode
+		var body []byte
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil && code/100 == 2 && out != nil {
+			err = json.NewDecoder(bytes.NewReader(body)).Decode(out)
+		}
+	}
+	c.stats.record(endpoint, time.Since(start), classify(code, err))
+	return code, err
+}
+
+type orderBody struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// runOrder creates an order, checks it out with retries and polls it until
+// it settles, like a browser would.
+func (c *loadClient) runOrder(ctx context.Context) {
+	// one trace per order: every request below carries its context
+	ctx, span := otel.Tracer("the-phantom-charge/cmd/simulate").Start(ctx, "loadgen.order")
+	defer span.End()
+
+	var order orderBody
+	if code, err := c.call(ctx, endpointCreate, http.MethodPost, "/orders", &order); err != nil || code != http.StatusCreated {
+		// creating is not idempotent; a client would not blindly retry it
+		c.stats.outcome("not_created")
+		return
+	}
+	span.SetAttributes(tracing.OrderID.String(order.ID))
+
+	status := ""
+	for attempt := 0; attempt <= c.cfg.retries; attempt++ {
+		var result struct {
+			OrderStatus string `json:"order_status"`
+		}
+		code, err := c.call(ctx, endpointCheckout, http.MethodPost, "/orders/"+order.ID+"/checkout", &result)
+		if err == nil && (code == http.StatusOK || code == http.StatusAccepted) {
+			status = result.OrderStatus
+			break
+		}
+		// a final answer; anything else (timeouts, 5xx) is worth retrying
+		if err == nil && (code == http.StatusPaymentRequired || code == http.StatusConflict || code == http.StatusNotFound) {
+			break
+		}
+		if attempt < c.cfg.retries {
+			time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+		}
+	}
+
+	deadline := time.Now().Add(c.cfg.pollTimeout)
+	for status != "PAID" && status != "FAILED" && time.Now().Before(deadline) {
+		var fresh orderBody
+		if code, err := c.call(ctx, endpointStatus, http.MethodGet, "/orders/"+order.ID, &fresh); err == nil && code == http.StatusOK {
+			status = fresh.Status
+			if status == "PAID" || status == "FAILED" {
+				break
+			}
+		}
+		time.Sleep(c.cfg.pollInterval)
+	}
+	if status == "" {
+		status = "unknown"
+	}
+	span.SetAttributes(tracing.Outcome.String(status))
+	c.stats.outcome(status)
+}
+
+// runLoad starts cfg.orders clients at cfg.rps against cfg.target and
+// prints what they saw.
+func runLoad(ctx context.Context, cfg config) *loadStats {
+	client := &loadClient{cfg: cfg, http: &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}, stats: newLoadStats()}
+
+	fmt.Printf("--- STARTING HTTP LOAD (%d ORDERS, %g RPS, TARGET %s) ---\n", cfg.orders, cfg.rps, cfg.target)
+	start := time.Now()
+	interval := time.Duration(float64(time.Second) / cfg.rps)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.orders; i++ {
+		if i > 0 {
+			<-ticker.C
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.runOrder(ctx)
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("--- %d ORDERS DONE IN %s ---\n", cfg.orders, time.Since(start).Round(time.Millisecond))
+	return client.stats
+}
+
+func (s *loadStats) WriteTable(w io.Writer) {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	}
+
+	fmt.Fprintln(w, "---------------------------------------------------")
+	fmt.Fprintln(w, "HTTP LOAD REPORT")
+	for _, endpoint := range []string{endpointCreate, endpointCheckout, endpointStatus} {
+		ds := s.latencies[endpoint]
+		if len(ds) == 0 {
+			continue
+		}
+		p := simulation.Summarize(ds)
+		fmt.Fprintf(w, "  %s: %d requests, p50 %sms, p90 %sms, p99 %sms, max %sms\n",
+			endpoint, len(ds), ms(p.P50), ms(p.P90), ms(p.P99), ms(p.Max))
+
+		buckets := make([]int, len(histogramBounds)+1)
+		for _, d := range ds {
+			buckets[sort.Search(len(histogramBounds), func(i int) bool { return d <= histogramBounds[i] })]++
+		}
+		for i, n := range buckets {
+			if n == 0 {
+				continue
+			}
+			label := "+Inf"
+			if i < len(histogramBounds) {
+				label = "<= " + histogramBounds[i].String()
+			}
+			fmt.Fprintf(w, "    %-10s %6d %s\n", label, n, strings.Repeat("#", (n*40+len(ds)-1)/len(ds)))
+		}
+
+		classes := sortedKeys(s.classes[endpoint])
+		for _, class := range classes {
+			fmt.Fprintf(w, "    %-10s %6d\n", class, s.classes[endpoint][class])
+		}
+	}
+	fmt.Fprintln(w, "  final order status seen by clients:")
+	for _, status := range sortedKeys(s.outcomes) {
+		fmt.Fprintf(w, "    %-16s %6d\n", status, s.outcomes[status])
+	}
+}
+
+// serverErrors counts responses that point at a bug rather than a
+// dependency: 5xx other than 503 (a provider is down).
+func (s *loadStats) serverErrors() int {
+	n := 0
+	for _, classes := range s.classes {
+		for class, count := range classes {
+			if strings.HasPrefix(class, "http_5") && class != "http_503" {
+				n += count
+			}
+		}
+	}
+	return n
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func runLoadMain(ctx context.Context, cfg config) {
+	if cfg.rps <= 0 {
+		fmt.Fprintln(os.Stderr, "-rps must be positive")
+		os.Exit(2)
+	}
+	shutdownTracing, err := tracing.Setup(ctx, "the-phantom-charge-loadgen")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	stats := runLoad(ctx, cfg)
+	if err := shutdownTracing(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "flushing traces: %v\n", err)
+	}
+	stats.WriteTable(os.Stdout)
+	if stats.serverErrors() > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadClientRetriesCheckout(t *testing.T) {
+	var checkouts atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"42","status":"PENDING"}`))
+	})
+	mux.HandleFunc("POST /orders/42/checkout", func(w http.ResponseWriter, r *http.Request) {
+		if checkouts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"order_status":"PAID"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := config{target: srv.URL, orders: 1, rps: 1, retries: 2, clientTimeout: time.Second, pollTimeout: time.Second}
+	stats := runLoad(context.Background(), cfg)
+
+	if got := stats.outcomes["PAID"]; got != 1 {
+		t.Fatalf("expected one PAID order, got %v", stats.outcomes)
+	}
+	if c := stats.classes[endpointCheckout]; c["http_503"] != 1 || c["ok"] != 1 {
+		t.Fatalf("unexpected checkout classes %v", c)
+	}
+	if stats.serverErrors() != 0 {
+		t.Fatalf("a 503 is not a server bug")
+	}
+}
+
+func TestClassifyTimeout(t *testing.T) {
+	if got := classify(0, context.DeadlineExceeded); got != "timeout" {
+		t.Fatalf("got %q", got)
+	}
+	if got := classify(http.StatusInternalServerError, nil); got != "http_500" {
+		t.Fatalf("got %q", got)
+	}
+}
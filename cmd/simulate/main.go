@@ -2,58 +2,477 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"the-phantom-charge/internal/database"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/domain"
 	"the-phantom-charge/internal/infrastructure/payment"
 	"the-phantom-charge/internal/repo"
 	"the-phantom-charge/internal/service"
+	"the-phantom-charge/internal/simulation"
+	"the-phantom-charge/internal/timeline"
 	"the-phantom-charge/internal/worker"
 	"time"
+
+	"github.com/google/uuid"
 )
 
+type config struct {
+	orders         int
+	concurrency    int
+	profile        string
+	workerInterval time.Duration
+	stuckAfter     time.Duration
+	duration       time.Duration
+	seed           uint64
+	reportJSON     string
+	reportCSV      string
+	strategy       string
+	compare        bool
+	crashPoint     string
+	crashRate      float64
+	speedup        float64
+	scenarioFile   string
+	timeline       string
+	replay         string
+	store          string
+
+	// HTTP load generation
+	target       string
+	rps          float64
+	pollInterval time.Duration
+	pollTimeout  time.Duration
+
+	// the wall clock, or a fake one advanced speedup times faster
+	clock clock.Clock
+	// where checkout events go; timeline.Nop unless -timeline or -replay
+	recorder timeline.Recorder
+
+	scenario      string
+	clicks        int
+	retries       int
+	clientTimeout time.Duration
+	refreshAfter  time.Duration
+}
+
+func parseFlags(args []string) config {
+	var cfg config
+	flag := flag.NewFlagSet("simulate", flag.ExitOnError)
+	profiles := make([]string, 0, len(faultProfiles))
+	for name := range faultProfiles {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+	scenarioNames := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		scenarioNames = append(scenarioNames, name)
+	}
+	sort.Strings(scenarioNames)
+
+	flag.IntVar(&cfg.orders, "orders", 20, "number of orders to create and check out")
+	flag.IntVar(&cfg.concurrency, "concurrency", 1, "concurrent checkout clients")
+	flag.StringVar(&cfg.profile, "fault-profile", "default", "gateway fault profile: "+strings.Join(profiles, ", "))
+	flag.DurationVar(&cfg.workerInterval, "worker-interval", 1*time.Second, "reconciliation worker tick")
+	flag.DurationVar(&cfg.stuckAfter, "stuck-after", 5*time.Second, "age at which the worker treats an unsettled order as stuck")
+	flag.DurationVar(&cfg.duration, "duration", 10*time.Second, "how long to keep reconciling after the last checkout")
+	flag.Uint64Var(&cfg.seed, "seed", 0, "RNG seed for gateway outcomes (0 = random)")
+	flag.StringVar(&cfg.scenario, "scenario", "single", "how clients check out each order: "+strings.Join(scenarioNames, ", "))
+	flag.IntVar(&cfg.clicks, "clicks", 2, "double-click: concurrent checkouts per order")
+	flag.IntVar(&cfg.retries, "retries", 3, "client-timeout, refresh: retries after the first attempt")
+	flag.DurationVar(&cfg.clientTimeout, "client-timeout", 500*time.Millisecond, "client-timeout: per-attempt client timeout")
+	flag.DurationVar(&cfg.refreshAfter, "refresh-after", 300*time.Millisecond, "refresh: abandon the checkout after this long")
+	flag.StringVar(&cfg.strategy, "strategy", string(service.StrategyIdempotent), "checkout strategy: "+strategyNames())
+	flag.BoolVar(&cfg.compare, "compare", false, "run the same seeded workload once per strategy and compare them")
+	flag.StringVar(&cfg.crashPoint, "crash-point", "", "kill checkouts at this point, then restart and reconcile: "+crashPointNames())
+	flag.Float64Var(&cfg.crashRate, "crash-rate", 1, "share of checkouts killed at -crash-point")
+	flag.Float64Var(&cfg.speedup, "speedup", 1, "run simulated time this many times faster than the wall clock")
+	flag.StringVar(&cfg.scenarioFile, "scenario-file", "", "run a YAML scenario (see scenarios/) instead of the flag-driven workload")
+	flag.StringVar(&cfg.target, "target", "", "drive a running server at this base URL over HTTP instead of in-process, e.g. http://localhost:8080")
+	flag.Float64Var(&cfg.rps, "rps", 10, "target: new orders per second")
+	flag.DurationVar(&cfg.pollInterval, "poll-interval", 500*time.Millisecond, "target: how often a client polls an unsettled order")
+	flag.DurationVar(&cfg.pollTimeout, "poll-timeout", 30*time.Second, "target: how long a client polls before giving up")
+	flag.StringVar(&cfg.store, "store", storePostgres, "where orders and payments live: postgres (the local database) or memory (no database needed)")
+	flag.StringVar(&cfg.timeline, "timeline", "", "record every checkout event to this JSONL file")
+	flag.StringVar(&cfg.replay, "replay", "", "rerun a recorded -timeline with its seed, flags and event order")
+	flag.StringVar(&cfg.reportJSON, "report-json", "", "also write the invariant report as JSON to this file")
+	flag.StringVar(&cfg.reportCSV, "report-csv", "", "also write the invariant report as CSV to this file")
+	flag.Parse(args)
+
+	if cfg.seed == 0 {
+		cfg.seed = uint64(time.Now().UnixNano())
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+	if cfg.clicks < 1 {
+		cfg.clicks = 1
+	}
+	return cfg
+}
+
+// newRouter builds two providers behind the router, 80% FastPay and 20%
+// AltPay, each misbehaving according to the profile. It also returns each
+// provider's mock so the run can be checked against what they captured,
+// and each provider's chaos so faults can be changed mid-run.
+func newRouter(profile faultProfile, seed uint64, clk clock.Clock) (*payment.Router, map[string]payment.Ledger, []*payment.Chaos) {
+	registry := payment.NewRegistry()
+	mocks := make(map[string]payment.Ledger)
+	var chaoses []*payment.Chaos
+	mockCfg := profile.mock
+	mockCfg.Clock = clk
+	for i, provider := range []string{payment.ProviderFastPay, "altpay"} {
+		mock := payment.NewMockGateway(mockCfg, seed+uint64(i))
+		mocks[provider] = mock.(payment.Ledger)
+		chaos := payment.NewChaos(mock, profile.chaos, seed+uint64(i)+100, clk)
+		chaoses = append(chaoses, chaos)
+		gateway, breaker := payment.Resilient(chaos, payment.DefaultCallTimeout, clk)
+		registry.Register(provider, gateway, breaker)
+	}
+	router := payment.NewRouter(registry, payment.Rule{
+		Providers: []payment.WeightedProvider{
+			{Name: payment.ProviderFastPay, Weight: 80},
+			{Name: "altpay", Weight: 20},
+		},
+	})
+	return router, mocks, chaoses
+}
+
+func strategyNames() string {
+	names := make([]string, len(service.Strategies))
+	for i, strategy := range service.Strategies {
+		names[i] = string(strategy)
+	}
+	return strings.Join(names, ", ")
+}
+
+func crashPointNames() string {
+	names := make([]string, len(service.CrashPoints))
+	for i, point := range service.CrashPoints {
+		names[i] = string(point)
+	}
+	return strings.Join(names, ", ")
+}
+
 func main() {
+	args := os.Args[1:]
+	cfg := parseFlags(args)
+	var recorded []timeline.Event
+	if cfg.replay != "" {
+		var err error
+		cfg, args, recorded, err = loadReplay(cfg)
+		if err != nil {
+			log.Fatalf("Loading replay failed: %v", err)
+		}
+	}
+	profile, ok := faultProfiles[cfg.profile]
+	if !ok {
+		log.Fatalf("unknown fault profile %q", cfg.profile)
+	}
+	run, ok := scenarios[cfg.scenario]
+	if !ok {
+		log.Fatalf("unknown scenario %q", cfg.scenario)
+	}
+
+	if cfg.crashPoint != "" && !slices.Contains(service.CrashPoints, service.CrashPoint(cfg.crashPoint)) {
+		log.Fatalf("unknown crash point %q", cfg.crashPoint)
+	}
+
 	ctx := context.Background()
-	db := database.NewPostgres()
+	cfg.recorder = timeline.Nop
+	if cfg.target != "" {
+		runLoadMain(ctx, cfg)
+		return
+	}
+	if cfg.scenarioFile != "" {
+		runScenarioFileMain(ctx, cfg)
+		return
+	}
+	cfg.clock = clock.Real
+	if cfg.speedup > 1 {
+		fake := clock.NewFake(time.Now())
+		cfg.clock = fake
+		go driveClock(ctx, fake, cfg.speedup)
+	}
+	st, err := openStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	orderRepo := repo.NewOrderRepo(db)
-	paymentRepo := repo.NewPaymentRepo(db)
-	paymentGateway := payment.NewPaymentGateway()
-	orderService := service.NewOrderService(db, orderRepo, paymentRepo, paymentGateway)
+	if cfg.compare {
+		if cfg.timeline != "" || cfg.replay != "" {
+			log.Fatal("-timeline and -replay record a single strategy; drop -compare")
+		}
+		results := make([]result, 0, len(service.Strategies))
+		for _, strategy := range service.Strategies {
+			res, err := simulate(ctx, st, cfg, profile, run, strategy)
+			if err != nil {
+				log.Fatalf("Simulating %s failed: %v", strategy, err)
+			}
+			results = append(results, res)
+		}
+		writeComparison(os.Stdout, results)
+		return
+	}
 
-    fmt.Println("--- STARTING SIMULATION (20 ORDERS) ---")
-	for i := 0; i < 20; i++ {
-		// 1. Create
-		order, err := orderService.CreateOrder(ctx)
-		if err != nil {
-			log.Printf("Create Failed: %v", err)
-			continue
+	strategy := service.Strategy(cfg.strategy)
+	if !slices.Contains(service.Strategies, strategy) {
+		log.Fatalf("unknown strategy %q", cfg.strategy)
+	}
+	closeTimeline, err := openTimeline(&cfg, args, recorded)
+	if err != nil {
+		log.Fatalf("Opening timeline failed: %v", err)
+	}
+	res, err := simulate(ctx, st, cfg, profile, run, strategy)
+	if err != nil {
+		log.Fatalf("Simulating failed: %v", err)
+	}
+	res.report.WriteTable(os.Stdout)
+	if st.pool != nil {
+		fmt.Printf("--- DB POOL: %s ---\n", st.pool.Stats())
+	}
+	if err := closeTimeline(); err != nil {
+		log.Fatalf("Writing timeline failed: %v", err)
+	}
+	if err := writeReportFiles(res.report, cfg); err != nil {
+		log.Fatalf("Writing report failed: %v", err)
+	}
+	if res.report.Violations() > 0 {
+		os.Exit(1)
+	}
+	// after a restart, reconciliation has to finish what the crashes left
+	if cfg.crashPoint != "" && len(res.report.StillPending) > 0 {
+		os.Exit(1)
+	}
+}
+
+func runScenarioFileMain(ctx context.Context, cfg config) {
+	sf, err := loadScenarioFile(cfg.scenarioFile)
+	if err != nil {
+		log.Fatalf("Loading scenario failed: %v", err)
+	}
+	report, err := runScenarioFile(ctx, cfg, sf, os.Stdout)
+	if err != nil {
+		log.Fatalf("Running scenario failed: %v", err)
+	}
+	report.WriteTable(os.Stdout)
+	if err := writeReportFiles(report, cfg); err != nil {
+		log.Fatalf("Writing report failed: %v", err)
+	}
+	if failures := sf.check(report); len(failures) > 0 {
+		for _, f := range failures {
+			fmt.Printf("  EXPECTATION FAILED %s\n", f)
 		}
+		os.Exit(1)
+	}
+}
+
+// result is one simulated run.
+type result struct {
+	strategy service.Strategy
+	report   simulation.Report
+	crashed  int
+	// client-side checkout time, first attempt to last answer
+	latency simulation.Percentiles
+}
+
+// simulate runs the workload against fresh mocks seeded with cfg.seed, so
+// every strategy sees the same gateway behaviour.
+//
+// With a crash point the checkouts run without a worker, as in a process
+// that is about to die. Afterwards the service "restarts": a new worker
+// comes up against the same database and providers and reconciles.
+func simulate(ctx context.Context, st store, cfg config, profile faultProfile, run scenario, strategy service.Strategy) (result, error) {
+	orderRepo, paymentRepo, txs := st.orders, st.payments, st.txs
+	router, mocks, _ := newRouter(profile, cfg.seed, cfg.clock)
+	opts := []service.Option{service.WithStrategy(strategy), service.WithRecorder(cfg.recorder)}
+	var crashes *crashInjector
+	if cfg.crashPoint != "" {
+		crashes = newCrashInjector(service.CrashPoint(cfg.crashPoint), cfg.crashRate, cfg.seed)
+		opts = append(opts, service.WithCrashHook(crashes.hook))
+	}
+	opts = append(opts, service.WithClock(cfg.clock))
+	orderService := service.NewOrderService(txs, orderRepo, paymentRepo, router, opts...)
+
+	startWorker := func() context.CancelFunc {
+		workerCtx, stopWorker := context.WithCancel(ctx)
+		worker := worker.NewReconciliationWorker(txs, orderRepo, paymentRepo, router, cfg.clock, cfg.workerInterval, cfg.stuckAfter,
+			worker.WithRecorder(cfg.recorder))
+		go worker.Run(workerCtx)
+		return stopWorker
+	}
+	stopWorker := func() {}
+	if crashes == nil {
+		stopWorker = startWorker()
+	}
+
+	fmt.Printf("--- STARTING SIMULATION (%d ORDERS, %d CLIENTS, PROFILE %s, SCENARIO %s, STRATEGY %s, SEED %d) ---\n",
+		cfg.orders, cfg.concurrency, cfg.profile, cfg.scenario, strategy, cfg.seed)
+	start := time.Now()
+	orderIds, latencies := runCheckouts(ctx, cfg, run, orderService, orderRepo)
+	fmt.Printf("--- %d CHECKOUTS DONE IN %s, RECONCILING FOR %s ---\n", len(orderIds), time.Since(start).Round(time.Millisecond), cfg.duration)
+	if crashes != nil {
+		fmt.Printf("--- %d CHECKOUTS CRASHED %s, RESTARTING ---\n", crashes.count(), strings.ToUpper(cfg.crashPoint))
+		stopWorker = startWorker()
+	}
+
+	clock.Sleep(ctx, cfg.clock, cfg.duration)
+	stopWorker()
+
+	report, err := buildReport(ctx, orderRepo, paymentRepo, orderIds, mocks)
+	if err != nil {
+		return result{}, err
+	}
+	res := result{strategy: strategy, report: report, latency: simulation.Summarize(latencies)}
+	if crashes != nil {
+		res.crashed = crashes.count()
+	}
+	return res, nil
+}
+
+// runCheckouts creates and checks out cfg.orders orders using
+// cfg.concurrency clients, and returns the IDs of the orders created with
+// how long each checkout took the client.
+func runCheckouts(ctx context.Context, cfg config, run scenario, orderService service.OrderService, orderRepo repo.OrderRepo) ([]uuid.UUID, []time.Duration) {
+	jobs := make(chan int)
+	var (
+		mu        sync.Mutex
+		orderIds  []uuid.UUID
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+
+	for c := 0; c < cfg.concurrency; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				id, latency, line := checkoutOne(ctx, i, cfg, run, orderService, orderRepo)
+				fmt.Print(line)
+				if id != uuid.Nil {
+					mu.Lock()
+					orderIds = append(orderIds, id)
+					latencies = append(latencies, latency)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < cfg.orders; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return orderIds, latencies
+}
+
+// checkoutOne runs one order end to end and returns how long the checkout
+// took and its report as a single string so concurrent clients don't
+// interleave their output.
+func checkoutOne(ctx context.Context, i int, cfg config, run scenario, orderService service.OrderService, orderRepo repo.OrderRepo) (uuid.UUID, time.Duration, string) {
+	// every event of this client shares a correlation ID on the timeline
+	ctx = timeline.WithCorrelation(ctx, fmt.Sprintf("order-%d", i+1))
 
-		// 2. Checkout (Có thể lỗi mạng)
-		fmt.Printf("[%d] Processing Order %s ... ", i+1, order.ID)
-		_, err = orderService.Checkout(ctx, order.ID)
+	// 1. Create
+	order, err := orderService.CreateOrder(ctx)
+	if err != nil {
+		return uuid.Nil, 0, fmt.Sprintf("[%d] Create Failed: %v\n", i+1, err)
+	}
+
+	// 2. Checkout (Có thể lỗi mạng)
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%d] Processing Order %s ... ", i+1, order.ID)
+	// Log kết quả Checkout
+	start := cfg.clock.Now()
+	run(ctx, cfg, orderService, orderRepo, order, &b)
+	latency := cfg.clock.Now().Sub(start)
 
-        // Log kết quả Checkout
+	// 3. QUAN TRỌNG: Query lại DB để xem trạng thái thực tế
+	// Nếu Checkout Failed (Timeout) mà DB vẫn là PAID -> Ghost Order (Logic cũ, đã fix)
+	// Nếu Checkout Failed (Timeout) mà DB là PENDING -> Ghost Order Case mới (Mất tiền, không có đơn).
+	freshOrder, err := orderRepo.FindById(ctx, order.ID)
+	if err != nil || freshOrder == nil {
+		fmt.Fprintf(&b, "    -> DB Status: unknown (%v)\n", err)
+	} else {
+		fmt.Fprintf(&b, "    -> DB Status: %s\n", freshOrder.Status)
+	}
+	return order.ID, latency, b.String()
+}
+
+// buildReport reads the final state of every simulated order and checks it
+// against what the mocks captured.
+func buildReport(ctx context.Context, orderRepo repo.OrderRepo, paymentRepo repo.PaymentRepo, orderIds []uuid.UUID, mocks map[string]payment.Ledger) (simulation.Report, error) {
+	orders := make([]domain.Order, 0, len(orderIds))
+	var payments []domain.Payment
+	for _, id := range orderIds {
+		order, err := orderRepo.FindById(ctx, id)
 		if err != nil {
-			fmt.Printf("FAILED: %v\n", err)
-		} else {
-			fmt.Printf("SUCCESS\n")
+			return simulation.Report{}, err
+		}
+		if order == nil {
+			return simulation.Report{}, fmt.Errorf("order %s disappeared", id)
 		}
+		orders = append(orders, *order)
 
-		// 3. QUAN TRỌNG: Query lại DB để xem trạng thái thực tế
-        // Nếu Checkout Failed (Timeout) mà DB vẫn là PAID -> Ghost Order (Logic cũ, đã fix)
-        // Nếu Checkout Failed (Timeout) mà DB là PENDING -> Ghost Order Case mới (Mất tiền, không có đơn).
-		freshOrder, _ := orderRepo.FindById(ctx, order.ID)
-		fmt.Printf("    -> DB Status: %s\n", freshOrder.Status)
-        fmt.Println("---------------------------------------------------")
-        time.Sleep(100 * time.Millisecond)
+		ps, err := paymentRepo.ListByOrderId(ctx, id)
+		if err != nil {
+			return simulation.Report{}, err
+		}
+		payments = append(payments, ps...)
 	}
 
-	time.Sleep(2 * time.Second)
+	var ledger []payment.LedgerEntry
+	for provider, mock := range mocks {
+		for _, entry := range mock.Ledger() {
+			entry.Provider = provider
+			ledger = append(ledger, entry)
+		}
+	}
+	return simulation.BuildReport(orders, payments, ledger), nil
+}
+
+func writeReportFiles(report simulation.Report, cfg config) error {
+	write := func(path string, fn func(io.Writer) error) error {
+		if path == "" {
+			return nil
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
 
-	worker := worker.NewReconciliationWorker(db, orderRepo, paymentGateway, 1*time.Second)
-	go worker.Run(ctx)
+	if err := write(cfg.reportJSON, report.WriteJSON); err != nil {
+		return err
+	}
+	return write(cfg.reportCSV, report.WriteCSV)
+}
 
-	time.Sleep(10 * time.Second)
-}
\ No newline at end of file
+// driveClock advances the fake clock speedup times faster than the wall
+// clock until ctx is done.
+func driveClock(ctx context.Context, fake *clock.Fake, speedup float64) {
+	const tick = time.Millisecond
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fake.Advance(time.Duration(float64(tick) * speedup))
+		}
+	}
+}
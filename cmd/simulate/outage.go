@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+)
+
+var errDatabaseDown = errors.New("simulated database outage")
+
+// outage sits between database/sql and the Postgres driver and fails every
+// new connection and statement while the database is "down". Transactions
+// already past their last statement can still commit.
+type outage struct {
+	down atomic.Bool
+}
+
+// open returns a pool on dsn whose connections go through the outage.
+func (o *outage) open(drv driver.Driver, dsn string) *sql.DB {
+	return sql.OpenDB(outageConnector{outage: o, drv: drv, dsn: dsn})
+}
+
+func (o *outage) check() error {
+	if o.down.Load() {
+		return errDatabaseDown
+	}
+	return nil
+}
+
+type outageConnector struct {
+	outage *outage
+	drv    driver.Driver
+	dsn    string
+}
+
+func (c outageConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := c.outage.check(); err != nil {
+		return nil, err
+	}
+	conn, err := c.drv.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &outageConn{Conn: conn, outage: c.outage}, nil
+}
+
+func (c outageConnector) Driver() driver.Driver { return c.drv }
+
+// outageConn forwards to the pgx connection, which implements all of the
+// optional driver interfaces below.
+type outageConn struct {
+	driver.Conn
+	outage *outage
+}
+
+func (c *outageConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.outage.check(); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *outageConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.outage.check(); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c *outageConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.outage.check(); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *outageConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.outage.check(); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *outageConn) Ping(ctx context.Context) error {
+	if err := c.outage.check(); err != nil {
+		return err
+	}
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *outageConn) CheckNamedValue(v *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(v)
+}
+
+// ResetSession and IsValid drop pooled connections once the outage starts.
+func (c *outageConn) ResetSession(ctx context.Context) error {
+	if c.outage.down.Load() {
+		return driver.ErrBadConn
+	}
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *outageConn) IsValid() bool {
+	return !c.outage.down.Load() && c.Conn.(driver.Validator).IsValid()
+}
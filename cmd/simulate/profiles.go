@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	"the-phantom-charge/internal/infrastructure/payment"
+)
+
+// faultProfile is how badly the simulated providers behave: the mock's own
+// outcome mix plus chaos injected in front of it.
+type faultProfile struct {
+	mock  payment.MockConfig
+	chaos payment.ChaosConfig
+}
+
+var faultProfiles = map[string]faultProfile{
+	// the original simulator: 70% success, 20% declined, 10% phantom charges
+	"default": {mock: payment.DefaultMockConfig},
+	"healthy": {
+		mock: payment.MockConfig{DeclineRate: 0.05, Latency: 50 * time.Millisecond},
+	},
+	// slow and lossy network on top of the default mix
+	"flaky": {
+		mock: payment.DefaultMockConfig,
+		chaos: payment.ChaosConfig{
+			Enabled:                 true,
+			LatencyProbability:      0.2,
+			LatencyMs:               800,
+			DropResponseProbability: 0.1,
+			ErrorProbability:        0.05,
+		},
+	},
+	// providers mostly unreachable; the breakers should open
+	"outage": {
+		mock: payment.DefaultMockConfig,
+		chaos: payment.ChaosConfig{
+			Enabled:          true,
+			ErrorProbability: 0.9,
+		},
+	},
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"the-phantom-charge/internal/timeline"
+	"time"
+)
+
+// replayTimeout is how long a replayed event waits for the events recorded
+// before it before the replay is declared diverged.
+const replayTimeout = 10 * time.Second
+
+// loadReplay reads a timeline written with -timeline and returns the
+// configuration it was recorded with, plus its events.
+func loadReplay(cfg config) (config, []string, []timeline.Event, error) {
+	f, err := os.Open(cfg.replay)
+	if err != nil {
+		return cfg, nil, nil, err
+	}
+	defer f.Close()
+	events, err := timeline.Read(f)
+	if err != nil {
+		return cfg, nil, nil, err
+	}
+	if len(events) == 0 || events[0].Kind != timeline.KindRun {
+		return cfg, nil, nil, errors.New("not a simulator timeline: missing run event")
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(events[0].Detail), &args); err != nil {
+		return cfg, nil, nil, fmt.Errorf("run event: %w", err)
+	}
+
+	replayed := parseFlags(args)
+	replayed.replay = cfg.replay
+	// never overwrite the recording being replayed
+	replayed.timeline = cfg.timeline
+	return replayed, args, events, nil
+}
+
+// openTimeline sets cfg.recorder: a JSONL writer for -timeline, gated by a
+// sequencer when replaying. The returned func flushes the timeline and
+// reports how faithful the replay was.
+func openTimeline(cfg *config, args []string, recorded []timeline.Event) (func() error, error) {
+	cfg.recorder = timeline.Nop
+	var (
+		f *os.File
+		w *timeline.Writer
+	)
+	if cfg.timeline != "" {
+		var err error
+		f, err = os.Create(cfg.timeline)
+		if err != nil {
+			return nil, err
+		}
+		w = timeline.NewWriter(f, cfg.clock)
+		// pin the seed so a random one can be replayed too
+		header, err := json.Marshal(append(args, fmt.Sprintf("-seed=%d", cfg.seed)))
+		if err != nil {
+			return nil, err
+		}
+		w.Record(context.Background(), timeline.Event{Kind: timeline.KindRun, Detail: string(header)})
+		cfg.recorder = w
+	}
+
+	var seq *timeline.Sequencer
+	if recorded != nil {
+		seq = timeline.NewSequencer(recorded, cfg.recorder, replayTimeout)
+		cfg.recorder = seq
+	}
+
+	return func() error {
+		if seq != nil {
+			divergences := seq.Divergences()
+			for _, d := range divergences {
+				fmt.Printf("  REPLAY DIVERGED %s\n", d)
+			}
+			if len(divergences) == 0 {
+				fmt.Println("  REPLAY MATCHED THE RECORDED EVENT ORDER")
+			}
+		}
+		if f == nil {
+			return nil
+		}
+		if err := w.Err(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
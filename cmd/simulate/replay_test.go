@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"the-phantom-charge/internal/clock"
+	"time"
+)
+
+func TestReplayRestoresRecordedFlags(t *testing.T) {
+	dir := t.TempDir()
+	recording := filepath.Join(dir, "run.jsonl")
+
+	cfg := parseFlags([]string{"-orders", "7", "-scenario", "double-click", "-timeline", recording})
+	cfg.clock = clock.NewFake(time.Now())
+	cfg.seed = 99
+	closeTimeline, err := openTimeline(&cfg, []string{"-orders", "7", "-scenario", "double-click", "-timeline", recording}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeTimeline(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, _, events, err := loadReplay(config{replay: recording, timeline: filepath.Join(dir, "replay.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.orders != 7 || replayed.scenario != "double-click" || replayed.seed != 99 {
+		t.Fatalf("flags not restored: %+v", replayed)
+	}
+	if replayed.timeline == recording {
+		t.Fatal("replay would overwrite its own recording")
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected only the run event, got %d", len(events))
+	}
+	if _, err := os.Stat(recording); err != nil {
+		t.Fatal(err)
+	}
+}
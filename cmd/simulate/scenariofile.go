@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/database"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/service"
+	"the-phantom-charge/internal/simulation"
+	"the-phantom-charge/internal/worker"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gopkg.in/yaml.v3"
+)
+
+// scenarioFile is a scripted simulation: phases of traffic, each with its
+// own gateway faults and worker state, database outage windows, and the
+// invariants the run must end with. See scenarios/ for examples.
+type scenarioFile struct {
+	Name        string  `yaml:"name"`
+	Description string  `yaml:"description"`
+	Seed        uint64  `yaml:"seed"`
+	Speedup     float64 `yaml:"speedup"`
+	Strategy    string  `yaml:"strategy"`
+	// base fault profile; phases override its chaos
+	Profile        string        `yaml:"fault_profile"`
+	WorkerInterval time.Duration `yaml:"worker_interval"`
+	StuckAfter     time.Duration `yaml:"stuck_after"`
+	// how long the worker reconciles after the last phase
+	Settle  time.Duration `yaml:"settle"`
+	Phases  []phase       `yaml:"phases"`
+	Outages []window      `yaml:"db_outages"`
+	// upper bounds on report metrics, e.g. ghost_orders: 0
+	Expect map[string]float64 `yaml:"expect"`
+}
+
+type phase struct {
+	Name     string        `yaml:"name"`
+	Duration time.Duration `yaml:"duration"`
+	// new orders per second
+	Rate   float64 `yaml:"rate"`
+	Client string  `yaml:"client"`
+	// nil keeps the fault profile's chaos
+	Faults *faults `yaml:"faults"`
+	// nil means on
+	Worker *bool `yaml:"worker"`
+}
+
+// faults is payment.ChaosConfig in scenario terms.
+type faults struct {
+	LatencyProbability float64       `yaml:"latency_probability"`
+	Latency            time.Duration `yaml:"latency"`
+	DropResponse       float64       `yaml:"drop_response"`
+	Error              float64       `yaml:"error"`
+	Duplicate          float64       `yaml:"duplicate"`
+}
+
+func (f faults) chaos() payment.ChaosConfig {
+	return payment.ChaosConfig{
+		Enabled:                 true,
+		LatencyProbability:      f.LatencyProbability,
+		LatencyMs:               int(f.Latency / time.Millisecond),
+		DropResponseProbability: f.DropResponse,
+		ErrorProbability:        f.Error,
+		DuplicateProbability:    f.Duplicate,
+	}
+}
+
+// window is a database outage, relative to the start of the run.
+type window struct {
+	Start    time.Duration `yaml:"start"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+func loadScenarioFile(path string) (*scenarioFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sf := &scenarioFile{
+		Strategy:       string(service.StrategyIdempotent),
+		Profile:        "healthy",
+		Speedup:        1,
+		WorkerInterval: 1 * time.Second,
+		StuckAfter:     5 * time.Second,
+		Settle:         10 * time.Second,
+	}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(sf); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := sf.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return sf, nil
+}
+
+func (sf *scenarioFile) validate() error {
+	if !slices.Contains(service.Strategies, service.Strategy(sf.Strategy)) {
+		return fmt.Errorf("unknown strategy %q", sf.Strategy)
+	}
+	if _, ok := faultProfiles[sf.Profile]; !ok {
+		return fmt.Errorf("unknown fault profile %q", sf.Profile)
+	}
+	if sf.WorkerInterval <= 0 {
+		return errors.New("worker_interval must be positive")
+	}
+	if len(sf.Phases) == 0 {
+		return errors.New("no phases")
+	}
+	for i, ph := range sf.Phases {
+		if ph.Duration <= 0 || ph.Rate <= 0 {
+			return fmt.Errorf("phase %d: duration and rate must be positive", i+1)
+		}
+		if _, ok := scenarios[ph.Client]; !ok {
+			return fmt.Errorf("phase %d: unknown client %q", i+1, ph.Client)
+		}
+	}
+	for i, w := range sf.Outages {
+		if w.Start < 0 || w.Duration <= 0 {
+			return fmt.Errorf("db outage %d: start must not be negative and duration must be positive", i+1)
+		}
+	}
+	var empty simulation.Report
+	for name := range sf.Expect {
+		if _, ok := empty.Metric(name); !ok {
+			return fmt.Errorf("expect: unknown metric %q", name)
+		}
+	}
+	return nil
+}
+
+// check returns a line for every expectation the report breaks.
+func (sf *scenarioFile) check(report simulation.Report) []string {
+	names := make([]string, 0, len(sf.Expect))
+	for name := range sf.Expect {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var failures []string
+	for _, name := range names {
+		got, _ := report.Metric(name)
+		if max := sf.Expect[name]; got > max {
+			failures = append(failures, fmt.Sprintf("%s = %g, expected at most %g", name, got, max))
+		}
+	}
+	return failures
+}
+
+// runScenarioFile plays sf against the store picked by -store and returns the
+// final report. cfg supplies the client settings (clicks, retries,
+// timeouts) the file doesn't.
+func runScenarioFile(ctx context.Context, cfg config, sf *scenarioFile, out io.Writer) (simulation.Report, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cfg.seed = sf.Seed
+	if cfg.seed == 0 {
+		cfg.seed = uint64(time.Now().UnixNano())
+	}
+	cfg.clock = clock.Real
+	if sf.Speedup > 1 {
+		fake := clock.NewFake(time.Now())
+		cfg.clock = fake
+		go driveClock(ctx, fake, sf.Speedup)
+	}
+
+	var down outage
+	var st store
+	switch cfg.store {
+	case storeMemory:
+		if len(sf.Outages) > 0 {
+			return simulation.Report{}, errors.New("db_outages need -store postgres")
+		}
+		st = memoryStore(cfg.clock)
+	case storePostgres:
+		// the outage wraps each driver connection, so this run uses a
+		// database/sql pool with the same limits instead of pgxpool
+		dbCfg := database.ConfigFromEnv()
+		db := down.open(stdlib.GetDefaultDriver(), dbCfg.ConnString())
+		db.SetMaxOpenConns(int(dbCfg.MaxConns))
+		db.SetConnMaxLifetime(dbCfg.MaxConnLifetime)
+		db.SetConnMaxIdleTime(dbCfg.MaxConnIdleTime)
+		defer db.Close()
+		st = sqlStore(db)
+	default:
+		return simulation.Report{}, fmt.Errorf("unknown store %q", cfg.store)
+	}
+
+	profile := faultProfiles[sf.Profile]
+	orderRepo, paymentRepo, txs := st.orders, st.payments, st.txs
+	router, mocks, chaoses := newRouter(profile, cfg.seed, cfg.clock)
+	orderService := service.NewOrderService(txs, orderRepo, paymentRepo, router,
+		service.WithStrategy(service.Strategy(sf.Strategy)), service.WithClock(cfg.clock))
+
+	stopWorker := func() {}
+	setWorker := func(on bool) {
+		stopWorker()
+		stopWorker = func() {}
+		if on {
+			workerCtx, stop := context.WithCancel(ctx)
+			w := worker.NewReconciliationWorker(txs, orderRepo, paymentRepo, router, cfg.clock, sf.WorkerInterval, sf.StuckAfter)
+			go w.Run(workerCtx)
+			stopWorker = stop
+		}
+	}
+	defer func() { stopWorker() }()
+
+	outageCtx, endOutages := context.WithCancel(ctx)
+	for _, w := range sf.Outages {
+		go func() {
+			if clock.Sleep(outageCtx, cfg.clock, w.Start) != nil {
+				return
+			}
+			fmt.Fprintf(out, "--- DATABASE DOWN FOR %s ---\n", w.Duration)
+			down.down.Store(true)
+			clock.Sleep(outageCtx, cfg.clock, w.Duration)
+			down.down.Store(false)
+			fmt.Fprintf(out, "--- DATABASE BACK ---\n")
+		}()
+	}
+
+	fmt.Fprintf(out, "--- SCENARIO %s (STRATEGY %s, PROFILE %s, SEED %d) ---\n", sf.Name, sf.Strategy, sf.Profile, cfg.seed)
+	var (
+		mu       sync.Mutex
+		orderIds []uuid.UUID
+		wg       sync.WaitGroup
+		n        int
+	)
+	for _, ph := range sf.Phases {
+		chaos := profile.chaos
+		if ph.Faults != nil {
+			chaos = ph.Faults.chaos()
+		}
+		for _, c := range chaoses {
+			c.SetConfig(chaos)
+		}
+		workerOn := ph.Worker == nil || *ph.Worker
+		setWorker(workerOn)
+		fmt.Fprintf(out, "--- PHASE %s (%s, %g ORDERS/S, CLIENT %s, WORKER %t) ---\n", ph.Name, ph.Duration, ph.Rate, ph.Client, workerOn)
+
+		run := scenarios[ph.Client]
+		count := int(ph.Rate * ph.Duration.Seconds())
+		interval := ph.Duration / time.Duration(max(count, 1))
+		for range count {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				id, _, line := checkoutOne(ctx, i, cfg, run, orderService, orderRepo)
+				mu.Lock()
+				defer mu.Unlock()
+				fmt.Fprint(out, line)
+				if id != uuid.Nil {
+					orderIds = append(orderIds, id)
+				}
+			}(n)
+			n++
+			clock.Sleep(ctx, cfg.clock, interval)
+		}
+	}
+	wg.Wait()
+
+	endOutages()
+	down.down.Store(false)
+	setWorker(true)
+	fmt.Fprintf(out, "--- %d ORDERS, RECONCILING FOR %s ---\n", len(orderIds), sf.Settle)
+	clock.Sleep(ctx, cfg.clock, sf.Settle)
+	setWorker(false)
+
+	return buildReport(ctx, orderRepo, paymentRepo, orderIds, mocks)
+}
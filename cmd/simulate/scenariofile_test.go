@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func scenarioLibrary(t *testing.T) []string {
+	paths, err := filepath.Glob("../../scenarios/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no scenarios found")
+	}
+	return paths
+}
+
+func TestScenarioLibraryLoads(t *testing.T) {
+	for _, path := range scenarioLibrary(t) {
+		if _, err := loadScenarioFile(path); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestScenarioLibrary replays every checked-in scenario against the local
+// Postgres (make docker-run) and fails on any broken expectation.
+func TestScenarioLibrary(t *testing.T) {
+	if testing.Short() || os.Getenv("BLUEPRINT_DB_HOST") == "" {
+		t.Skip("needs the local Postgres; set BLUEPRINT_DB_* to run")
+	}
+	runScenarioLibrary(t, storePostgres)
+}
+
+// TestScenarioLibraryInMemory replays the scenarios that need no real
+// database against the in-memory store.
+func TestScenarioLibraryInMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("replays minutes of simulated traffic")
+	}
+	runScenarioLibrary(t, storeMemory)
+}
+
+func runScenarioLibrary(t *testing.T, store string) {
+	cfg := config{
+		clicks:        2,
+		retries:       3,
+		clientTimeout: 500 * time.Millisecond,
+		refreshAfter:  300 * time.Millisecond,
+		store:         store,
+	}
+
+	for _, path := range scenarioLibrary(t) {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			sf, err := loadScenarioFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if store == storeMemory && len(sf.Outages) > 0 {
+				t.Skip("database outages need Postgres")
+			}
+			t.Parallel()
+			report, err := runScenarioFile(context.Background(), cfg, sf, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, failure := range sf.check(report) {
+				t.Error(failure)
+			}
+		})
+	}
+}
+
+func TestScenarioFileRejectsUnknownFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.yaml")
+	bad := "name: bad\nphases:\n  - duration: 1m\n    rate: 1\n    client: single\n    fautls: {}\n"
+	if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadScenarioFile(path); err == nil {
+		t.Fatal("expected a typo'd field to be rejected")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/service"
+	"the-phantom-charge/internal/timeline"
+)
+
+// scenario drives the checkout of one order the way a client would and
+// writes what happened to b.
+type scenario func(ctx context.Context, cfg config, orderService service.OrderService, orderRepo repo.OrderRepo, order *domain.Order, b *strings.Builder)
+
+var scenarios = map[string]scenario{
+	"single":         checkoutOnce,
+	"double-click":   doubleClick,
+	"client-timeout": retryAfterTimeout,
+	"refresh":        retryAfterRefresh,
+}
+
+func describe(result *service.CheckoutResult, err error) string {
+	switch {
+	case err != nil:
+		return fmt.Sprintf("FAILED: %v", err)
+	case result.Outcome == service.CheckoutPendingConfirmation:
+		return "PENDING CONFIRMATION"
+	default:
+		return fmt.Sprintf("SUCCESS (%s payment %s, txn %s, amount %.2f, replayed %t)",
+			result.Provider, result.PaymentID, result.FastPayTxnID, result.AmountCharged, result.Replayed)
+	}
+}
+
+// done reports whether a client would stop retrying after this answer.
+func done(result *service.CheckoutResult, err error) bool {
+	if err != nil {
+		return errors.Is(err, service.ErrPaymentFailed) || errors.Is(err, service.ErrOrderNotPending)
+	}
+	return result.Outcome == service.CheckoutPaid
+}
+
+func checkoutOnce(ctx context.Context, cfg config, orderService service.OrderService, orderRepo repo.OrderRepo, order *domain.Order, b *strings.Builder) {
+	result, err := orderService.Checkout(ctx, order.ID)
+	fmt.Fprintf(b, "%s\n", describe(result, err))
+}
+
+// doubleClick fires cfg.clicks concurrent checkouts for the same order, as
+// an impatient user hammering Pay would.
+func doubleClick(ctx context.Context, cfg config, orderService service.OrderService, orderRepo repo.OrderRepo, order *domain.Order, b *strings.Builder) {
+	lines := make([]string, cfg.clicks)
+	var wg sync.WaitGroup
+	for click := 0; click < cfg.clicks; click++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := timeline.WithCorrelation(ctx, fmt.Sprintf("%s/click-%d", timeline.Correlation(ctx), click+1))
+			result, err := orderService.Checkout(ctx, order.ID)
+			lines[click] = describe(result, err)
+		}()
+	}
+	wg.Wait()
+
+	fmt.Fprintf(b, "%d CLICKS\n", cfg.clicks)
+	for click, line := range lines {
+		fmt.Fprintf(b, "    click %d: %s\n", click+1, line)
+	}
+}
+
+// retryAfterTimeout gives every attempt cfg.clientTimeout, as a browser
+// fetch with a timeout would, and retries until a final answer.
+func retryAfterTimeout(ctx context.Context, cfg config, orderService service.OrderService, orderRepo repo.OrderRepo, order *domain.Order, b *strings.Builder) {
+	fmt.Fprintf(b, "\n")
+	for attempt := 0; attempt <= cfg.retries; attempt++ {
+		attemptCtx, cancel := clock.WithTimeout(ctx, cfg.clock, cfg.clientTimeout)
+		result, err := orderService.Checkout(attemptCtx, order.ID)
+		cancel()
+
+		fmt.Fprintf(b, "    attempt %d: %s\n", attempt+1, describe(result, err))
+		if done(result, err) {
+			return
+		}
+	}
+}
+
+// retryAfterRefresh abandons the checkout after cfg.refreshAfter, as a
+// browser refresh would, reloads the order, and pays again if it still
+// looks unpaid.
+func retryAfterRefresh(ctx context.Context, cfg config, orderService service.OrderService, orderRepo repo.OrderRepo, order *domain.Order, b *strings.Builder) {
+	fmt.Fprintf(b, "\n")
+	for attempt := 0; attempt <= cfg.retries; attempt++ {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		finished := make(chan string, 1)
+		go func() {
+			result, err := orderService.Checkout(attemptCtx, order.ID)
+			finished <- describe(result, err)
+		}()
+
+		select {
+		case line := <-finished:
+			fmt.Fprintf(b, "    attempt %d: %s\n", attempt+1, line)
+		case <-cfg.clock.After(cfg.refreshAfter):
+			cancel()
+			fmt.Fprintf(b, "    attempt %d: REFRESHED (abandoned: %s)\n", attempt+1, <-finished)
+		}
+		cancel()
+
+		// the reloaded page shows the order as the database has it
+		fresh, err := orderRepo.FindById(ctx, order.ID)
+		if err != nil || fresh == nil || fresh.Status.Settled() {
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/database"
+	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/repo/memory"
+)
+
+const (
+	storePostgres = "postgres"
+	storeMemory   = "memory"
+)
+
+// store is where a run keeps its orders and payments.
+type store struct {
+	txs      repo.TxManager
+	orders   repo.OrderRepo
+	payments repo.PaymentRepo
+	// pool is set for -store postgres
+	pool *database.Pool
+}
+
+func sqlStore(db *sql.DB) store {
+	return store{txs: repo.NewTxManager(repo.NewSQLTransactor(db)), orders: repo.NewOrderRepo(db), payments: repo.NewPaymentRepo(db)}
+}
+
+// memoryStore needs no database; it lives as long as the process.
+func memoryStore(clk clock.Clock) store {
+	s := memory.NewStore(clk)
+	return store{txs: repo.NewTxManager(s), orders: memory.NewOrderRepo(s), payments: memory.NewPaymentRepo(s)}
+}
+
+// openStore opens the store named by -store.
+func openStore(cfg config) (store, error) {
+	switch cfg.store {
+	case storePostgres:
+		pool, err := database.Open(context.Background(), database.ConfigFromEnv())
+		if err != nil {
+			return store{}, err
+		}
+		st := sqlStore(pool.DB())
+		st.pool = pool
+		return st, nil
+	case storeMemory:
+		return memoryStore(cfg.clock), nil
+	default:
+		return store{}, fmt.Errorf("unknown store %q", cfg.store)
+	}
+}
@@ -0,0 +1,4 @@
+ALTER TABLE payments DROP COLUMN IF EXISTS provider;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS payment_provider;
+ALTER TABLE orders DROP COLUMN IF EXISTS currency;
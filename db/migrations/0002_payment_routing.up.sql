@@ -0,0 +1,6 @@
+-- Orders carry a currency for routing and remember which provider they were
+-- sent to, so status checks and reconciliation go to the same provider.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_provider VARCHAR(32) NOT NULL DEFAULT '';
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS provider VARCHAR(32) NOT NULL DEFAULT 'fastpay';
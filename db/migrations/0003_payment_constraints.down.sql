@@ -0,0 +1,17 @@
+DROP INDEX IF EXISTS payments_provider_txn_key;
+DROP INDEX IF EXISTS payments_one_active_per_order;
+DROP INDEX IF EXISTS payments_order_id_idx;
+
+ALTER TABLE payments
+  DROP CONSTRAINT IF EXISTS payments_amount_check,
+  DROP CONSTRAINT IF EXISTS payments_status_check,
+  DROP CONSTRAINT IF EXISTS payments_order_id_fkey;
+
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_amount_check,
+  DROP CONSTRAINT IF EXISTS orders_status_check;
+
+ALTER TABLE payments ALTER COLUMN status SET DEFAULT 'PENDING';
+
+UPDATE payments SET fastpay_txn_id = '00000000-0000-0000-0000-000000000000' WHERE fastpay_txn_id IS NULL;
+ALTER TABLE payments ALTER COLUMN fastpay_txn_id SET NOT NULL;
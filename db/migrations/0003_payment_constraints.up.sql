@@ -0,0 +1,28 @@
+-- Let the database refuse what the application must never do, even if its
+-- locking has a bug: two live payments for one order, one gateway
+-- transaction recorded twice, payments for orders that don't exist.
+-- Fails, and changes nothing, if existing rows already break a rule.
+
+-- no transaction exists before the charge is sent
+ALTER TABLE payments ALTER COLUMN fastpay_txn_id DROP NOT NULL;
+UPDATE payments SET fastpay_txn_id = NULL WHERE fastpay_txn_id = '00000000-0000-0000-0000-000000000000';
+
+ALTER TABLE payments ALTER COLUMN status SET DEFAULT 'INIT';
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_status_check CHECK (status IN ('PENDING', 'PAID', 'FAILED', 'PAYMENT_UNKNOWN')),
+  ADD CONSTRAINT orders_amount_check CHECK (amount > 0);
+
+ALTER TABLE payments
+  ADD CONSTRAINT payments_order_id_fkey FOREIGN KEY (order_id) REFERENCES orders (id),
+  ADD CONSTRAINT payments_status_check CHECK (status IN ('INIT', 'PROCESSING', 'SUCCEEDED', 'FAILED')),
+  ADD CONSTRAINT payments_amount_check CHECK (amount > 0);
+
+CREATE INDEX payments_order_id_idx ON payments (order_id, created_at);
+
+-- at most one payment per order in flight or captured
+CREATE UNIQUE INDEX payments_one_active_per_order ON payments (order_id)
+  WHERE status IN ('PROCESSING', 'SUCCEEDED');
+
+-- NULLs are distinct, so payments not yet charged don't collide
+CREATE UNIQUE INDEX payments_provider_txn_key ON payments (provider, fastpay_txn_id);
@@ -0,0 +1,10 @@
+// Package migrations embeds the schema migrations, applied in order by
+// internal/migrate. Each version is a pair of files,
+// NNNN_name.up.sql and NNNN_name.down.sql. A migration that has been
+// applied anywhere must not be edited: add a new one instead.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
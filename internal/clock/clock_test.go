@@ -0,0 +1,78 @@
+package clock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFakeAfterFiresOnAdvance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	ch := f.After(time.Minute)
+
+	f.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("fired before its deadline")
+	default:
+	}
+
+	f.Advance(time.Second)
+	select {
+	case at := <-ch:
+		if !at.Equal(start.Add(time.Minute)) {
+			t.Fatalf("fired at %v", at)
+		}
+	default:
+		t.Fatal("did not fire at its deadline")
+	}
+	if f.Waiters() != 0 {
+		t.Fatalf("expected no waiters, got %d", f.Waiters())
+	}
+}
+
+func TestFakeTickerDropsMissedTicks(t *testing.T) {
+	f := NewFake(time.Time{})
+	ticker := f.NewTicker(time.Second)
+
+	f.Advance(10 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatal("expected missed ticks to be dropped")
+	default:
+	}
+
+	f.Advance(time.Second)
+	<-ticker.C()
+
+	ticker.Stop()
+	if f.Waiters() != 0 {
+		t.Fatalf("expected a stopped ticker to be removed, got %d waiters", f.Waiters())
+	}
+}
+
+func TestSleepReturnsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Sleep(ctx, NewFake(time.Time{}), time.Hour); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWithTimeoutOnFake(t *testing.T) {
+	f := NewFake(time.Time{})
+	ctx, cancel := WithTimeout(context.Background(), f, time.Minute)
+	defer cancel()
+
+	for f.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	f.Advance(time.Minute)
+	<-ctx.Done()
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline, got %v", ctx.Err())
+	}
+}
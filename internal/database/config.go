@@ -0,0 +1,119 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Pool defaults, sized for about 50 concurrent checkouts: each holds a
+// connection only for its short transactions, never across a gateway
+// call.
+const (
+	DefaultMaxConns         = 25
+	DefaultMinConns         = 2
+	DefaultMaxConnLifetime  = 30 * time.Minute
+	DefaultMaxConnIdleTime  = 5 * time.Minute
+	DefaultStatementTimeout = 10 * time.Second
+	DefaultApplicationName  = "the-phantom-charge"
+)
+
+// Config describes the connection pool. The zero value of a setting
+// means its default, except MinConns, where 0 keeps no idle connections,
+// and StatementTimeout, where 0 turns the limit off. ConfigFromEnv starts
+// both at their defaults.
+type Config struct {
+	// URL is the postgres:// address, without pool settings.
+	URL             string
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+	// StatementTimeout aborts any statement running longer, so a stuck
+	// query can't hold a pool connection forever.
+	StatementTimeout time.Duration
+	// ApplicationName shows up in pg_stat_activity.
+	ApplicationName string
+}
+
+// ConfigFromEnv reads the BLUEPRINT_DB_* variables:
+//
+//	BLUEPRINT_DB_MAX_CONNS          pool size
+//	BLUEPRINT_DB_MIN_CONNS          connections kept open when idle
+//	BLUEPRINT_DB_MAX_CONN_LIFETIME  e.g. 30m
+//	BLUEPRINT_DB_MAX_CONN_IDLE_TIME e.g. 5m
+//	BLUEPRINT_DB_STATEMENT_TIMEOUT  e.g. 10s, 0 for none
+//	BLUEPRINT_DB_APPLICATION_NAME
+//
+// plus the host, port, database, user, password and schema ones. Unset
+// settings keep their defaults; malformed ones are fatal.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		URL:              fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&search_path=%s", username, password, host, port, database, schema),
+		MaxConns:         DefaultMaxConns,
+		MinConns:         DefaultMinConns,
+		MaxConnLifetime:  DefaultMaxConnLifetime,
+		MaxConnIdleTime:  DefaultMaxConnIdleTime,
+		StatementTimeout: DefaultStatementTimeout,
+		ApplicationName:  DefaultApplicationName,
+	}
+	envInt32("BLUEPRINT_DB_MAX_CONNS", &cfg.MaxConns)
+	envInt32("BLUEPRINT_DB_MIN_CONNS", &cfg.MinConns)
+	envDuration("BLUEPRINT_DB_MAX_CONN_LIFETIME", &cfg.MaxConnLifetime)
+	envDuration("BLUEPRINT_DB_MAX_CONN_IDLE_TIME", &cfg.MaxConnIdleTime)
+	envDuration("BLUEPRINT_DB_STATEMENT_TIMEOUT", &cfg.StatementTimeout)
+	if name := os.Getenv("BLUEPRINT_DB_APPLICATION_NAME"); name != "" {
+		cfg.ApplicationName = name
+	}
+	return cfg
+}
+
+// ConnString is URL with the per-connection settings added, for opening
+// connections without the pool.
+func (c Config) ConnString() string {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return c.URL
+	}
+	q := u.Query()
+	if c.ApplicationName != "" {
+		q.Set("application_name", c.ApplicationName)
+	}
+	q.Set("statement_timeout", strconv.FormatInt(c.StatementTimeout.Milliseconds(), 10))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func envInt32(key string, dst *int32) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || n < 0 {
+		log.Fatalf("%s: want a non-negative integer, got %q", key, v)
+	}
+	*dst = int32(n)
+}
+
+func envDuration(key string, dst *time.Duration) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("%s: want a duration such as 30s, got %q", key, v)
+	}
+	*dst = d
+}
+
+// ForMigrations is c without the statement timeout: a migrator waits on
+// another's lock, and a migration may rewrite a large table.
+func (c Config) ForMigrations() Config {
+	c.StatementTimeout = 0
+	return c
+}
@@ -5,13 +5,11 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"strconv"
-	"the-phantom-charge/internal/domain"
 	"time"
 
-	"github.com/google/uuid"
-	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/joho/godotenv/autoload"
 )
 
@@ -24,10 +22,20 @@ type Service interface {
 	// Close terminates the database connection.
 	// It returns an error if the connection cannot be closed.
 	Close() error
+
+	// DB returns the handle on the connection pool for the repositories.
+	DB() *sql.DB
+
+	// Stats reports the connection pool's state.
+	Stats() PoolStats
+
+	// Ping checks the database answers before ctx is done.
+	Ping(ctx context.Context) error
 }
 
 type service struct {
-	db *sql.DB
+	db   *sql.DB
+	pool *Pool
 }
 
 var (
@@ -40,37 +48,19 @@ var (
 	dbInstance *service
 )
 
-func NewPostgres() *sql.DB {
-	connStr := fmt.Sprintf(
-		"postgres://%s:%s@%s:%s/%s?sslmode=disable&search_path=%s",
-		os.Getenv("BLUEPRINT_DB_USERNAME"),
-		os.Getenv("BLUEPRINT_DB_PASSWORD"),
-		os.Getenv("BLUEPRINT_DB_HOST"),
-		os.Getenv("BLUEPRINT_DB_PORT"),
-		os.Getenv("BLUEPRINT_DB_DATABASE"),
-		os.Getenv("BLUEPRINT_DB_SCHEMA"),
-	)
-
-	db, err := sql.Open("pgx", connStr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return db
-}
-
+// New returns the process-wide pool built from ConfigFromEnv.
 func New() Service {
 	// Reuse Connection
 	if dbInstance != nil {
 		return dbInstance
 	}
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&search_path=%s", username, password, host, port, database, schema)
-	db, err := sql.Open("pgx", connStr)
+	pool, err := Open(context.Background(), ConfigFromEnv())
 	if err != nil {
 		log.Fatal(err)
 	}
 	dbInstance = &service{
-		db: db,
+		db:   pool.DB(),
+		pool: pool,
 	}
 	return dbInstance
 }
@@ -88,7 +78,7 @@ func (s *service) Health() map[string]string {
 	if err != nil {
 		stats["status"] = "down"
 		stats["error"] = fmt.Sprintf("db down: %v", err)
-		log.Fatalf("db down: %v", err) // Log the error and terminate the program
+		slog.Error("database down", "error", err)
 		return stats
 	}
 
@@ -96,34 +86,40 @@ func (s *service) Health() map[string]string {
 	stats["status"] = "up"
 	stats["message"] = "It's healthy"
 
-	// Get database stats (like open connections, in use, idle, etc.)
-	dbStats := s.db.Stats()
-	stats["open_connections"] = strconv.Itoa(dbStats.OpenConnections)
-	stats["in_use"] = strconv.Itoa(dbStats.InUse)
-	stats["idle"] = strconv.Itoa(dbStats.Idle)
-	stats["wait_count"] = strconv.FormatInt(dbStats.WaitCount, 10)
-	stats["wait_duration"] = dbStats.WaitDuration.String()
-	stats["max_idle_closed"] = strconv.FormatInt(dbStats.MaxIdleClosed, 10)
-	stats["max_lifetime_closed"] = strconv.FormatInt(dbStats.MaxLifetimeClosed, 10)
+	// Get pool stats (connections in use, idle, waits for a free one)
+	poolStats := s.pool.Stats()
+	stats["max_connections"] = strconv.Itoa(int(poolStats.MaxConns))
+	stats["open_connections"] = strconv.Itoa(int(poolStats.TotalConns))
+	stats["in_use"] = strconv.Itoa(int(poolStats.AcquiredConns))
+	stats["idle"] = strconv.Itoa(int(poolStats.IdleConns))
+	stats["wait_count"] = strconv.FormatInt(poolStats.WaitCount, 10)
+	stats["wait_duration"] = poolStats.WaitDuration.String()
+	stats["canceled_acquires"] = strconv.FormatInt(poolStats.CanceledAcquires, 10)
+	stats["max_idle_closed"] = strconv.FormatInt(poolStats.IdleClosed, 10)
+	stats["max_lifetime_closed"] = strconv.FormatInt(poolStats.LifetimeClosed, 10)
 
 	// Evaluate stats to provide a health message
-	if dbStats.OpenConnections > 40 { // Assuming 50 is the max for this example
-		stats["message"] = "The database is experiencing heavy load."
+	if poolStats.AcquiredConns >= poolStats.MaxConns {
+		stats["message"] = "The database is experiencing heavy load: every pooled connection is in use."
 	}
 
-	if dbStats.WaitCount > 1000 {
-		stats["message"] = "The database has a high number of wait events, indicating potential bottlenecks."
+	if poolStats.CanceledAcquires > 0 {
+		stats["message"] = "Requests gave up waiting for a database connection, consider raising BLUEPRINT_DB_MAX_CONNS."
 	}
 
-	if dbStats.MaxIdleClosed > int64(dbStats.OpenConnections)/2 {
-		stats["message"] = "Many idle connections are being closed, consider revising the connection pool settings."
-	}
+	return stats
+}
 
-	if dbStats.MaxLifetimeClosed > int64(dbStats.OpenConnections)/2 {
-		stats["message"] = "Many connections are being closed due to max lifetime, consider increasing max lifetime or revising the connection usage pattern."
-	}
+func (s *service) DB() *sql.DB {
+	return s.db
+}
 
-	return stats
+func (s *service) Stats() PoolStats {
+	return s.pool.Stats()
+}
+
+func (s *service) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
 }
 
 // Close closes the database connection.
@@ -131,60 +127,6 @@ func (s *service) Health() map[string]string {
 // If the connection is successfully closed, it returns nil.
 // If an error occurs while closing the connection, it returns the error.
 func (s *service) Close() error {
-	log.Printf("Disconnected from database: %s", database)
-	return s.db.Close()
-}
-
-
-func (r *service) CreatePayment(ctx context.Context, tx *sql.Tx, p *domain.Payment) error {
-	query := `INSERT INTO payments (id, order_id, amount, fastpay_txn_id, status, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-
-	_, err := tx.ExecContext(
-		ctx, query, p.ID, p.OrderID, p.Amount, p.FastPayTxn, p.Status, p.CreatedAt, p.UpdatedAt,
-	)
-
-	if err != nil {
-		return err
-	}
-	return nil
+	slog.Info("disconnected from database", "database", database)
+	return s.pool.Close()
 }
-
-func (r *service) FindById(ctx context.Context, id uuid.UUID) (*domain.Payment, error)  {
-	query := `SELECT * FROM payments WHERE id = $1`
-	row := r.db.QueryRowContext(ctx, query, id)
-	var p domain.Payment
-	err := row.Scan(
-		&p.ID,
-		&p.OrderID,
-		&p.Amount,
-		&p.FastPayTxn,
-		&p.Status,
-		&p.CreatedAt,
-		&p.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return &p, nil
-}
-
-func (r *service) UpdatePaymentStatus(ctx context.Context, tx *sql.Tx, orderId uuid.UUID, status domain.PaymentStatus, fastPayTxn uuid.UUID) error {
-	query := `
-		UPDATE payments
-		SET status = $2,
-		    fastpay_txn_id = COALESCE($3, fastpay_txn_id),
-		    updated_at = now()
-		WHERE id = $1
-	`
-	_, err := tx.ExecContext(
-		ctx,
-		query,
-		orderId,
-		status,
-		fastPayTxn,
-	)
-	if err != nil {
-		return err
-	}
-	return nil
-}
\ No newline at end of file
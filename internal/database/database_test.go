@@ -91,6 +91,25 @@ func TestHealth(t *testing.T) {
 	}
 }
 
+func TestPoolSettings(t *testing.T) {
+	srv := New()
+
+	var appName, timeout string
+	row := srv.DB().QueryRow("SELECT current_setting('application_name'), current_setting('statement_timeout')")
+	if err := row.Scan(&appName, &timeout); err != nil {
+		t.Fatal(err)
+	}
+	if appName != DefaultApplicationName {
+		t.Fatalf("application_name = %q, want %q", appName, DefaultApplicationName)
+	}
+	if timeout != DefaultStatementTimeout.String() {
+		t.Fatalf("statement_timeout = %q, want %q", timeout, DefaultStatementTimeout)
+	}
+	if stats := srv.Stats(); stats.MaxConns != DefaultMaxConns || stats.AcquireCount == 0 {
+		t.Fatalf("stats = %+v, want max %d and the query's acquire", stats, DefaultMaxConns)
+	}
+}
+
 func TestClose(t *testing.T) {
 	srv := New()
 
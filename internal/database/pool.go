@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+
+	"the-phantom-charge/internal/tracing"
+)
+
+// Pool is a pgx connection pool. Repositories reach it through DB, a
+// database/sql handle whose connections are borrowed from the pool, so
+// both share one set of limits.
+type Pool struct {
+	pgx *pgxpool.Pool
+	db  *sql.DB
+}
+
+// Open builds the pool described by cfg. Connections are made lazily; an
+// unreachable database shows up on first use, not here.
+func Open(ctx context.Context, cfg Config) (*Pool, error) {
+	poolCfg, err := pgxpool.ParseConfig(cfg.ConnString())
+	if err != nil {
+		return nil, fmt.Errorf("database: %w", err)
+	}
+	poolCfg.MaxConns = orDefault(cfg.MaxConns, DefaultMaxConns)
+	poolCfg.MinConns = min(cfg.MinConns, poolCfg.MaxConns)
+	poolCfg.MaxConnLifetime = orDefault(cfg.MaxConnLifetime, DefaultMaxConnLifetime)
+	poolCfg.MaxConnIdleTime = orDefault(cfg.MaxConnIdleTime, DefaultMaxConnIdleTime)
+	poolCfg.ConnConfig.Tracer = tracing.QueryTracer{}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	if err != nil {
+		return nil, fmt.Errorf("database: %w", err)
+	}
+	return &Pool{pgx: pool, db: stdlib.OpenDBFromPool(pool)}, nil
+}
+
+func orDefault[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
+	}
+	return v
+}
+
+// DB returns the database/sql handle for the repositories.
+func (p *Pool) DB() *sql.DB {
+	return p.db
+}
+
+// Pgx returns the underlying pool, for code that talks pgx directly.
+func (p *Pool) Pgx() *pgxpool.Pool {
+	return p.pgx
+}
+
+// Close closes the handle and the pool, waiting for borrowed connections
+// to come back.
+func (p *Pool) Close() error {
+	err := p.db.Close()
+	p.pgx.Close()
+	return err
+}
+
+// PoolStats is a snapshot of the pool.
+type PoolStats struct {
+	MaxConns      int32
+	TotalConns    int32
+	AcquiredConns int32
+	IdleConns     int32
+	// AcquireCount counts successful acquires; WaitCount those of them
+	// that had to wait for a connection, and WaitDuration the time they
+	// spent waiting.
+	AcquireCount int64
+	WaitCount    int64
+	WaitDuration time.Duration
+	// CanceledAcquires gave up, usually on a context deadline, before a
+	// connection freed up.
+	CanceledAcquires int64
+	// connections closed for reaching MaxConnLifetime or MaxConnIdleTime
+	LifetimeClosed int64
+	IdleClosed     int64
+}
+
+// Stats reports the pool's current state.
+func (p *Pool) Stats() PoolStats {
+	s := p.pgx.Stat()
+	return PoolStats{
+		MaxConns:         s.MaxConns(),
+		TotalConns:       s.TotalConns(),
+		AcquiredConns:    s.AcquiredConns(),
+		IdleConns:        s.IdleConns(),
+		AcquireCount:     s.AcquireCount(),
+		WaitCount:        s.EmptyAcquireCount(),
+		WaitDuration:     s.EmptyAcquireWaitTime(),
+		CanceledAcquires: s.CanceledAcquireCount(),
+		LifetimeClosed:   s.MaxLifetimeDestroyCount(),
+		IdleClosed:       s.MaxIdleDestroyCount(),
+	}
+}
+
+func (s PoolStats) String() string {
+	return fmt.Sprintf("%d/%d conns (%d in use, %d idle), %d acquires, %d waited %s, %d canceled",
+		s.TotalConns, s.MaxConns, s.AcquiredConns, s.IdleConns,
+		s.AcquireCount, s.WaitCount, s.WaitDuration.Round(time.Millisecond), s.CanceledAcquires)
+}
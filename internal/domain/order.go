@@ -9,17 +9,41 @@ import (
 type OrderStatus string
 
 const (
-	OrderPending           OrderStatus = "PENDING"
-	OrderPaid              OrderStatus = "PAID"
-	OrderFailed            OrderStatus = "FAILED"
+	OrderPending OrderStatus = "PENDING"
+	OrderPaid    OrderStatus = "PAID"
+	OrderFailed  OrderStatus = "FAILED"
+	// OrderPaymentUnknown: the charge timed out and FastPay could not
+	// confirm it yet. The reconciliation worker settles it later.
+	OrderPaymentUnknown OrderStatus = "PAYMENT_UNKNOWN"
 )
 
+// Valid reports whether s is one of the statuses above.
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderPending, OrderPaid, OrderFailed, OrderPaymentUnknown:
+		return true
+	}
+	return false
+}
+
+// Settled reports whether the order reached a final status.
+func (s OrderStatus) Settled() bool {
+	return s == OrderPaid || s == OrderFailed
+}
+
+const DefaultCurrency = "USD"
+
 type Order struct {
-	ID        uuid.UUID
-	UserID    uuid.UUID
-	Amount    float64
+	ID             uuid.UUID
+	UserID         uuid.UUID
+	Amount         float64
 	IdempotencyKey uuid.UUID
-	Status    OrderStatus
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	Status         OrderStatus
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Currency       string
+	// Provider is the payment provider the order was sent to, empty until
+	// the first charge attempt. Every later call for the order must go to
+	// the same provider.
+	Provider string
 }
@@ -9,18 +9,36 @@ import (
 type PaymentStatus string
 
 const (
-	PaymentInitiated   PaymentStatus = "INIT"
-	PaymentProcessing  PaymentStatus = "PROCESSING"
-	PaymentSucceeded PaymentStatus = "SUCCEEDED"
-	PaymentFailed      PaymentStatus = "FAILED"
+	PaymentInitiated  PaymentStatus = "INIT"
+	PaymentProcessing PaymentStatus = "PROCESSING"
+	PaymentSucceeded  PaymentStatus = "SUCCEEDED"
+	PaymentFailed     PaymentStatus = "FAILED"
 )
 
+// Valid reports whether s is one of the statuses above.
+func (s PaymentStatus) Valid() bool {
+	switch s {
+	case PaymentInitiated, PaymentProcessing, PaymentSucceeded, PaymentFailed:
+		return true
+	}
+	return false
+}
+
+// Active reports whether the payment is in flight or captured. An order
+// has at most one active payment.
+func (s PaymentStatus) Active() bool {
+	return s == PaymentProcessing || s == PaymentSucceeded
+}
+
 type Payment struct {
-	ID        uuid.UUID
-	OrderID   uuid.UUID
-	Amount    float64
-	Status    PaymentStatus
+	ID         uuid.UUID
+	OrderID    uuid.UUID
+	Amount     float64
+	Status     PaymentStatus
+	// FastPayTxn is the provider's transaction ID, uuid.Nil until the
+	// provider has answered.
 	FastPayTxn uuid.UUID
-	CreatedAt time.Time
-	UpdatedAt time.Time
-}
\ No newline at end of file
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Provider   string
+}
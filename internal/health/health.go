@@ -0,0 +1,137 @@
+// Package health runs the per-component checks behind the readiness
+// endpoint. A failing check never stops the process: it is reported, and
+// the orchestrator decides what to do with the instance.
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusUp Status = "up"
+	// StatusDegraded: a non-critical component is failing. The instance
+	// still serves, worse.
+	StatusDegraded Status = "degraded"
+	// StatusDown: a critical component is failing and the instance
+	// should not take traffic.
+	StatusDown Status = "down"
+)
+
+// DefaultTimeout bounds each check.
+const DefaultTimeout = 2 * time.Second
+
+// Details are a check's findings, shown as is.
+type Details map[string]string
+
+// Check is one component.
+type Check struct {
+	Name string
+	// Critical checks take the instance out of rotation when they fail;
+	// the others only mark it degraded.
+	Critical bool
+	// Run returns an error when the component is unhealthy. It must give
+	// up when ctx is done.
+	Run func(ctx context.Context) (Details, error)
+}
+
+// Component is the result of one check.
+type Component struct {
+	Status   Status  `json:"status"`
+	Critical bool    `json:"critical"`
+	Error    string  `json:"error,omitempty"`
+	Details  Details `json:"details,omitempty"`
+	Duration string  `json:"duration"`
+}
+
+// Report is the result of every check.
+type Report struct {
+	Status     Status               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+type Checker struct {
+	checks  []Check
+	timeout time.Duration
+}
+
+type Option func(*Checker)
+
+// WithTimeout bounds each check by d instead of DefaultTimeout.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Checker) {
+		c.timeout = d
+	}
+}
+
+func New(checks []Check, opts ...Option) *Checker {
+	c := &Checker{checks: checks, timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Run runs every check concurrently, each under the timeout. A check that
+// overruns it is reported down even if it never returns.
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: StatusUp, Components: make(map[string]Component, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			comp := c.run(ctx, check)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[check.Name] = comp
+			switch {
+			case comp.Status == StatusUp:
+			case check.Critical:
+				report.Status = StatusDown
+			case report.Status == StatusUp:
+				report.Status = StatusDegraded
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, check Check) Component {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	type result struct {
+		details Details
+		err     error
+	}
+	start := time.Now()
+	done := make(chan result, 1)
+	go func() {
+		details, err := check.Run(ctx)
+		done <- result{details, err}
+	}()
+
+	comp := Component{Status: StatusUp, Critical: check.Critical}
+	select {
+	case res := <-done:
+		comp.Details = res.details
+		if res.err != nil {
+			comp.Status = StatusDown
+			comp.Error = res.err.Error()
+		}
+	case <-ctx.Done():
+		comp.Status = StatusDown
+		comp.Error = ctx.Err().Error()
+	}
+	if comp.Status == StatusDown && !check.Critical {
+		comp.Status = StatusDegraded
+	}
+	comp.Duration = time.Since(start).Round(time.Microsecond).String()
+	return comp
+}
@@ -0,0 +1,74 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"the-phantom-charge/internal/health"
+	"time"
+)
+
+func up(ctx context.Context) (health.Details, error) {
+	return health.Details{"ok": "yes"}, nil
+}
+
+func failing(ctx context.Context) (health.Details, error) {
+	return nil, errors.New("broken")
+}
+
+// hangs ignores ctx, like a driver stuck on a dead socket.
+func hangs(release chan struct{}) func(context.Context) (health.Details, error) {
+	return func(context.Context) (health.Details, error) {
+		<-release
+		return nil, nil
+	}
+}
+
+func TestRun(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	tests := []struct {
+		name   string
+		checks []health.Check
+		want   health.Status
+	}{
+		{"all up", []health.Check{{Name: "db", Critical: true, Run: up}, {Name: "worker", Run: up}}, health.StatusUp},
+		{"non-critical fails", []health.Check{{Name: "db", Critical: true, Run: up}, {Name: "worker", Run: failing}}, health.StatusDegraded},
+		{"critical fails", []health.Check{{Name: "db", Critical: true, Run: failing}, {Name: "worker", Run: failing}}, health.StatusDown},
+		{"critical hangs", []health.Check{{Name: "db", Critical: true, Run: hangs(release)}}, health.StatusDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			report := health.New(tt.checks, health.WithTimeout(50*time.Millisecond)).Run(context.Background())
+			if report.Status != tt.want {
+				t.Fatalf("status = %s, want %s: %+v", report.Status, tt.want, report.Components)
+			}
+			if len(report.Components) != len(tt.checks) {
+				t.Fatalf("%d components, want %d", len(report.Components), len(tt.checks))
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("took %s despite the timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestComponentStatus(t *testing.T) {
+	report := health.New([]health.Check{
+		{Name: "db", Critical: true, Run: failing},
+		{Name: "gateway", Run: failing},
+		{Name: "worker", Run: up},
+	}).Run(context.Background())
+
+	if c := report.Components["db"]; c.Status != health.StatusDown || c.Error != "broken" {
+		t.Errorf("db = %+v, want down with its error", c)
+	}
+	if c := report.Components["gateway"]; c.Status != health.StatusDegraded {
+		t.Errorf("gateway = %+v, want degraded", c)
+	}
+	if c := report.Components["worker"]; c.Status != health.StatusUp || c.Details["ok"] != "yes" {
+		t.Errorf("worker = %+v, want up with its details", c)
+	}
+}
@@ -0,0 +1,160 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"the-phantom-charge/internal/clock"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+type BreakerConfig struct {
+	// consecutive failures that open the circuit
+	FailureThreshold int
+	// how long the circuit stays open before a probe call is let through
+	OpenTimeout time.Duration
+	// Clock times OpenTimeout; nil is the wall clock.
+	Clock clock.Clock
+}
+
+var DefaultBreakerConfig = BreakerConfig{
+	FailureThreshold: 5,
+	OpenTimeout:      30 * time.Second,
+}
+
+// CircuitBreaker is a PaymentGateway that stops calling FastPay after
+// repeated failures and fails fast with ErrGatewayUnavailable until a probe
+// call succeeds again.
+type CircuitBreaker struct {
+	next PaymentGateway
+	cfg  BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(next PaymentGateway, cfg BreakerConfig) *CircuitBreaker {
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+	return &CircuitBreaker{next: next, cfg: cfg, state: BreakerClosed}
+}
+
+// State returns the current breaker state, moving an expired open circuit
+// to half-open.
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.expire()
+	return cb.state
+}
+
+func (cb *CircuitBreaker) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	if err := cb.allow(); err != nil {
+		return nil, err
+	}
+	res, err := cb.next.Charge(ctx, amount, idempotencyKey)
+	cb.report(err)
+	return res, err
+}
+
+func (cb *CircuitBreaker) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	if err := cb.allow(); err != nil {
+		return nil, err
+	}
+	res, err := cb.next.CheckStatus(ctx, idempotencyKey)
+	cb.report(err)
+	return res, err
+}
+
+func (cb *CircuitBreaker) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	if err := cb.allow(); err != nil {
+		return nil, err
+	}
+	res, err := cb.next.Authorize(ctx, amount, idempotencyKey)
+	cb.report(err)
+	return res, err
+}
+
+func (cb *CircuitBreaker) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	if err := cb.allow(); err != nil {
+		return nil, err
+	}
+	res, err := cb.next.Capture(ctx, idempotencyKey)
+	cb.report(err)
+	return res, err
+}
+
+func (cb *CircuitBreaker) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	if err := cb.allow(); err != nil {
+		return nil, err
+	}
+	res, err := cb.next.Refund(ctx, idempotencyKey)
+	cb.report(err)
+	return res, err
+}
+
+func (cb *CircuitBreaker) expire() {
+	if cb.state == BreakerOpen && cb.cfg.Clock.Now().Sub(cb.openedAt) >= cb.cfg.OpenTimeout {
+		cb.state = BreakerHalfOpen
+		cb.probing = false
+	}
+}
+
+// allow lets a call through unless the circuit is open or a half-open probe
+// is already in flight.
+func (cb *CircuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.expire()
+
+	switch cb.state {
+	case BreakerOpen:
+		return ErrGatewayUnavailable
+	case BreakerHalfOpen:
+		if cb.probing {
+			return ErrGatewayUnavailable
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+func (cb *CircuitBreaker) report(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	// a cancelled caller says nothing about FastPay's health
+	if errors.Is(err, context.Canceled) {
+		cb.probing = false
+		return
+	}
+
+	// a decline is FastPay working as intended
+	if err == nil || IsDefinite(err) {
+		cb.state = BreakerClosed
+		cb.failures = 0
+		cb.probing = false
+		return
+	}
+
+	cb.failures++
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.cfg.FailureThreshold {
+		cb.state = BreakerOpen
+		cb.openedAt = cb.cfg.Clock.Now()
+		cb.probing = false
+	}
+}
@@ -0,0 +1,177 @@
+package payment
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"the-phantom-charge/internal/clock"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ChaosConfig sets the fault probabilities, each in [0, 1].
+type ChaosConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// add LatencyMs before forwarding
+	LatencyProbability float64 `json:"latency_probability"`
+	LatencyMs          int     `json:"latency_ms"`
+	// forward the call, then lose the response: the charge-then-timeout
+	// phantom charge
+	DropResponseProbability float64 `json:"drop_response_probability"`
+	// fail with ErrConnectionRefused without forwarding
+	ErrorProbability float64 `json:"error_probability"`
+	// forward the call twice concurrently, as a double-clicking client would
+	DuplicateProbability float64 `json:"duplicate_probability"`
+}
+
+// Chaos is a PaymentGateway decorator that injects faults into any gateway.
+// The config can be swapped at runtime.
+type Chaos struct {
+	next  PaymentGateway
+	clock clock.Clock
+
+	mu  sync.Mutex
+	cfg ChaosConfig
+	rng *rand.Rand
+}
+
+// NewChaos wraps next. A zero seed picks a random one; injected latency
+// runs on clk, nil being the wall clock.
+func NewChaos(next PaymentGateway, cfg ChaosConfig, seed uint64, clk clock.Clock) *Chaos {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	if clk == nil {
+		clk = clock.Real
+	}
+	return &Chaos{next: next, clock: clk, cfg: cfg, rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+func (c *Chaos) Config() ChaosConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg
+}
+
+func (c *Chaos) SetConfig(cfg ChaosConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = cfg
+}
+
+// faults is the set of faults drawn for one call.
+type faults struct {
+	latency   time.Duration
+	fail      bool
+	drop      bool
+	duplicate bool
+}
+
+func (c *Chaos) draw() faults {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var f faults
+	if !c.cfg.Enabled {
+		return f
+	}
+	if c.rng.Float64() < c.cfg.LatencyProbability {
+		f.latency = time.Duration(c.cfg.LatencyMs) * time.Millisecond
+	}
+	f.fail = c.rng.Float64() < c.cfg.ErrorProbability
+	f.drop = c.rng.Float64() < c.cfg.DropResponseProbability
+	f.duplicate = c.rng.Float64() < c.cfg.DuplicateProbability
+	return f
+}
+
+func (c *Chaos) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	f := c.draw()
+	if err := c.before(ctx, f); err != nil {
+		return nil, err
+	}
+	if f.duplicate {
+		go c.next.Charge(context.WithoutCancel(ctx), amount, idempotencyKey)
+	}
+
+	res, err := c.next.Charge(ctx, amount, idempotencyKey)
+	if f.drop {
+		return nil, ErrConnectionTimeout
+	}
+	return res, err
+}
+
+func (c *Chaos) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	f := c.draw()
+	if err := c.before(ctx, f); err != nil {
+		return nil, err
+	}
+
+	res, err := c.next.CheckStatus(ctx, idempotencyKey)
+	if f.drop {
+		return nil, ErrConnectionTimeout
+	}
+	return res, err
+}
+
+func (c *Chaos) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	f := c.draw()
+	if err := c.before(ctx, f); err != nil {
+		return nil, err
+	}
+	if f.duplicate {
+		go c.next.Authorize(context.WithoutCancel(ctx), amount, idempotencyKey)
+	}
+
+	res, err := c.next.Authorize(ctx, amount, idempotencyKey)
+	if f.drop {
+		return nil, ErrConnectionTimeout
+	}
+	return res, err
+}
+
+func (c *Chaos) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	f := c.draw()
+	if err := c.before(ctx, f); err != nil {
+		return nil, err
+	}
+	if f.duplicate {
+		go c.next.Capture(context.WithoutCancel(ctx), idempotencyKey)
+	}
+
+	res, err := c.next.Capture(ctx, idempotencyKey)
+	if f.drop {
+		return nil, ErrConnectionTimeout
+	}
+	return res, err
+}
+
+func (c *Chaos) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	f := c.draw()
+	if err := c.before(ctx, f); err != nil {
+		return nil, err
+	}
+	if f.duplicate {
+		go c.next.Refund(context.WithoutCancel(ctx), idempotencyKey)
+	}
+
+	res, err := c.next.Refund(ctx, idempotencyKey)
+	if f.drop {
+		return nil, ErrConnectionTimeout
+	}
+	return res, err
+}
+
+func (c *Chaos) before(ctx context.Context, f faults) error {
+	if f.latency > 0 {
+		if err := clock.Sleep(ctx, c.clock, f.latency); err != nil {
+			return err
+		}
+	}
+	// nothing was forwarded, so the error must not look like a lost answer
+	if f.fail {
+		return ErrConnectionRefused
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestChaosDropResponseChargesThenTimesOut(t *testing.T) {
+	stub := &stubGateway{}
+	chaos := NewChaos(stub, ChaosConfig{Enabled: true, DropResponseProbability: 1}, 1, nil)
+
+	_, err := chaos.Charge(context.Background(), 100, uuid.New())
+	if !errors.Is(err, ErrConnectionTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if stub.calls != 1 {
+		t.Fatalf("expected the charge to be forwarded, got %d calls", stub.calls)
+	}
+}
+
+func TestChaosErrorDoesNotForward(t *testing.T) {
+	stub := &stubGateway{}
+	chaos := NewChaos(stub, ChaosConfig{Enabled: true, ErrorProbability: 1}, 1, nil)
+
+	_, err := chaos.Charge(context.Background(), 100, uuid.New())
+	if !errors.Is(err, ErrConnectionRefused) || !errors.Is(err, ErrGatewayUnavailable) {
+		t.Fatalf("expected a refusal, nothing sent, got %v", err)
+	}
+	if stub.calls != 0 {
+		t.Fatalf("expected no forwarded call, got %d", stub.calls)
+	}
+
+	chaos.SetConfig(ChaosConfig{})
+	if _, err := chaos.Charge(context.Background(), 100, uuid.New()); err != nil {
+		t.Fatalf("disabled chaos should pass through, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrCardDeclined is FastPay refusing the charge. Nothing was captured.
+	ErrCardDeclined = errors.New("Card Declined")
+	// ErrConnectionTimeout means FastPay did not answer in time. The charge
+	// may still have been captured.
+	ErrConnectionTimeout = errors.New("Connection Timeout")
+	// ErrGatewayUnavailable is returned without calling FastPay while the
+	// circuit breaker is open. Nothing was sent, so nothing was captured.
+	ErrGatewayUnavailable = errors.New("payment gateway unavailable")
+	// ErrConnectionRefused means the request never reached FastPay. It is
+	// an ErrGatewayUnavailable: nothing was sent this time, though an
+	// earlier attempt with the same key may have been.
+	ErrConnectionRefused = fmt.Errorf("Connection Refused: %w", ErrGatewayUnavailable)
+	// ErrNoAuthorization is Capture for a key that was never authorized.
+	ErrNoAuthorization = errors.New("no authorization to capture")
+	// ErrNotRefundable is Refund for a key with no captured charge behind
+	// it. Nothing was given back because nothing was taken.
+	ErrNotRefundable = errors.New("no captured charge to refund")
+)
+
+// IsDefinite reports whether err from Charge proves that no money was
+// captured, or err from Refund that none was given back. Any other error is ambiguous: FastPay may have charged the card
+// before the response was lost, so the caller must ask CheckStatus before
+// deciding the order failed.
+func IsDefinite(err error) bool {
+	return errors.Is(err, ErrCardDeclined) || errors.Is(err, ErrNoAuthorization) ||
+		errors.Is(err, ErrNotRefundable)
+}
+
+// IsRetryable reports whether a call that failed with err may be sent again
+// with the same idempotency key. Declines are final and an open breaker
+// should not be hammered.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrConnectionTimeout) || errors.Is(err, ErrConnectionRefused) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// ErrorClass names the kind of err from a gateway call, for metrics and
+// traces: "ok" for nil, then "declined", "timeout", "refused", "unavailable",
+// "no_authorization", "not_refundable", "canceled" or "error".
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrCardDeclined):
+		return "declined"
+	case errors.Is(err, ErrConnectionTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrConnectionRefused):
+		return "refused"
+	case errors.Is(err, ErrGatewayUnavailable):
+		return "unavailable"
+	case errors.Is(err, ErrNoAuthorization):
+		return "no_authorization"
+	case errors.Is(err, ErrNotRefundable):
+		return "not_refundable"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
@@ -2,83 +2,370 @@ package payment
 
 import (
 	"context"
-	"errors"
-	"fmt"
+	"log/slog"
 	"math/rand/v2"
 	"sync"
+	"the-phantom-charge/internal/clock"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type PaymentGateway interface {
-    Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (bool, error)
-		CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (bool, error)
+	Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error)
+	CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error)
+	// Authorize holds the amount on the card without taking it; Capture
+	// takes an authorized amount. Both are idempotent by key, like Charge.
+	Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error)
+	Capture(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error)
+	// Refund gives a captured charge back in full. It is idempotent by key:
+	// refunding again replays the first refund.
+	Refund(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error)
+}
+
+// ChargeResult is FastPay's view of a charge identified by an idempotency key.
+type ChargeResult struct {
+	TxnID  uuid.UUID
+	Amount int64
+	// Paid means the money was captured
+	Paid bool
+	// Authorized means the amount is held but not captured yet
+	Authorized bool
+	// Refunded means captured money was given back; Paid stays true
+	Refunded bool
+	// Replayed is true when FastPay answered from its idempotency cache
+	// instead of processing a new charge.
+	Replayed bool
+}
+
+// MockConfig sets how the mock FastPay answers new charges. Rates are in
+// [0, 1]; whatever is left over succeeds.
+type MockConfig struct {
+	DeclineRate float64
+	// charged, then the response hangs for TimeoutLatency and is lost
+	TimeoutRate    float64
+	Latency        time.Duration
+	TimeoutLatency time.Duration
+	// Clock drives latencies and capture times; nil is the wall clock.
+	Clock clock.Clock
+	// Logger hears about money taken whose response was then lost; nil is
+	// slog.Default().
+	Logger *slog.Logger
+}
+
+// DefaultMockConfig: 70% success, 20% declined, 10% phantom charges.
+var DefaultMockConfig = MockConfig{
+	DeclineRate:    0.2,
+	TimeoutRate:    0.1,
+	Latency:        100 * time.Millisecond,
+	TimeoutLatency: 2 * time.Second,
+}
+
+// LedgerEntry is money actually taken from a customer.
+type LedgerEntry struct {
+	Provider       string
+	OrderRef       uuid.UUID
+	IdempotencyKey uuid.UUID
+	TxnID          uuid.UUID
+	Amount         int64
+	CapturedAt     time.Time
+	// RefundedAt is zero unless the money was given back.
+	RefundedAt time.Time
+}
+
+// Ledger is implemented by gateways that can list what they captured,
+// i.e. the mock. Simulations compare it against the database.
+type Ledger interface {
+	Ledger() []LedgerEntry
 }
 
 type paymentGateway struct {
-	mu           	sync.RWMutex
-	chargeSuccess map[string]bool
+	cfg MockConfig
+
+	mu      sync.RWMutex
+	charges map[string]ChargeResult
+	refs    map[string]uuid.UUID
+	ledger  []LedgerEntry
+
+	rngMu sync.Mutex
+	rng   *rand.Rand
 }
 
 func NewPaymentGateway() PaymentGateway {
-	chargeSuccess := make(map[string]bool)
-	return &paymentGateway{chargeSuccess: chargeSuccess}
+	return NewMockGateway(DefaultMockConfig, 0)
 }
 
-func (pg *paymentGateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (bool, error) {
-	key := idempotencyKey.String()
+// NewMockGateway builds a mock FastPay. A zero seed picks a random one.
+func NewMockGateway(cfg MockConfig, seed uint64) PaymentGateway {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &paymentGateway{
+		cfg:     cfg,
+		charges: make(map[string]ChargeResult),
+		refs:    make(map[string]uuid.UUID),
+		rng:     rand.New(rand.NewPCG(seed, seed)),
+	}
+}
 
-	// check Idempotency Key (if charged, return true)
+type outcome int
+
+const (
+	outcomeDeclined outcome = iota
+	outcomeAnswered
+	// processed by FastPay, but the response never arrives
+	outcomeLost
+)
+
+// draw picks how FastPay handles a new request.
+func (pg *paymentGateway) draw() outcome {
+	pg.rngMu.Lock()
+	chance := pg.rng.Float64()
+	pg.rngMu.Unlock()
+
+	switch {
+	case chance < pg.cfg.DeclineRate:
+		return outcomeDeclined
+	case chance >= pg.cfg.DeclineRate+pg.cfg.TimeoutRate:
+		return outcomeAnswered
+	default:
+		return outcomeLost
+	}
+}
+
+func (pg *paymentGateway) lookup(idempotencyKey uuid.UUID) (ChargeResult, bool) {
 	pg.mu.RLock()
-	if paid, exists := pg.chargeSuccess[key]; exists {
-		pg.mu.RUnlock()
-		return paid, nil
+	defer pg.mu.RUnlock()
+	res, exists := pg.charges[idempotencyKey.String()]
+	return res, exists
+}
+
+func (pg *paymentGateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	// check Idempotency Key (if charged, return the stored response)
+	if res, exists := pg.lookup(idempotencyKey); exists {
+		res.Replayed = true
+		return respond(res)
 	}
-	pg.mu.RUnlock()
 
-	// Tạo số ngẫu nhiên từ 0 đến 99
-	chance := rand.IntN(100)
+	switch pg.draw() {
+	// card declined (DeclineRate)
+	case outcomeDeclined:
+		if err := clock.Sleep(ctx, pg.cfg.Clock, pg.cfg.Latency); err != nil {
+			return nil, err
+		}
+		return respond(pg.record(ctx, idempotencyKey, amount, stateDeclined))
 
-	switch {
-	// --- TRƯỜNG HỢP 1: THÀNH CÔNG (70%) ---
-	case chance < 70:
-		time.Sleep(100 * time.Millisecond)
-		pg.mu.Lock()
-		pg.chargeSuccess[idempotencyKey.String()] = true
-		pg.mu.Unlock()
-		return true, nil
-
-	// --- TRƯỜNG HỢP 2: THẺ LỖI (20%) ---
-	case chance < 90:
-		time.Sleep(100 * time.Millisecond)
-		pg.mu.Lock()
-		pg.chargeSuccess[idempotencyKey.String()] = false
-		pg.mu.Unlock()
-		return false, errors.New("Card Declined")
-
-	// --- TRƯỜNG HỢP 3: MẠNG LAG - THE PHANTOM CHARGE (10%) ---
+	// charged and answered
+	case outcomeAnswered:
+		if err := clock.Sleep(ctx, pg.cfg.Clock, pg.cfg.Latency); err != nil {
+			return nil, err
+		}
+		return respond(pg.record(ctx, idempotencyKey, amount, stateCaptured))
+
+	// the phantom charge (TimeoutRate): FastPay takes the money but the
+	// answer never arrives
+	default:
+		res := pg.record(ctx, idempotencyKey, amount, stateCaptured)
+		pg.lost(ctx, "charged", idempotencyKey, res)
+
+		return nil, pg.hang(ctx)
+	}
+}
+
+func (pg *paymentGateway) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	if res, exists := pg.lookup(idempotencyKey); exists {
+		res.Replayed = true
+		return respond(res)
+	}
+
+	switch pg.draw() {
+	case outcomeDeclined:
+		if err := clock.Sleep(ctx, pg.cfg.Clock, pg.cfg.Latency); err != nil {
+			return nil, err
+		}
+		return respond(pg.record(ctx, idempotencyKey, amount, stateDeclined))
+	case outcomeAnswered:
+		if err := clock.Sleep(ctx, pg.cfg.Clock, pg.cfg.Latency); err != nil {
+			return nil, err
+		}
+		return respond(pg.record(ctx, idempotencyKey, amount, stateAuthorized))
 	default:
-		// Giả lập mạng bị treo 2 giây
-		time.Sleep(2 * time.Second)
-		pg.mu.Lock()
-		pg.chargeSuccess[idempotencyKey.String()] = true
-		pg.mu.Unlock()
-		// THẢM HỌA: Bên FastPay đã thực hiện trừ tiền thành công
-		fmt.Printf("[FastPay] CHARGED MONEY for Key: %s\n", idempotencyKey)
+		// only a hold is lost; no money moved
+		pg.record(ctx, idempotencyKey, amount, stateAuthorized)
+		return nil, pg.hang(ctx)
+	}
+}
+
+func (pg *paymentGateway) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	res, exists := pg.lookup(idempotencyKey)
+	if !exists {
+		return nil, ErrNoAuthorization
+	}
+	if !res.Authorized {
+		res.Replayed = true
+		return respond(res)
+	}
+
+	// a hold can't be declined any more, but the network can still fail
+	if pg.draw() == outcomeLost {
+		pg.lost(ctx, "captured", idempotencyKey, pg.capture(idempotencyKey))
+		return nil, pg.hang(ctx)
+	}
+	if err := clock.Sleep(ctx, pg.cfg.Clock, pg.cfg.Latency); err != nil {
+		return nil, err
+	}
+	return respond(pg.capture(idempotencyKey))
+}
+
+func (pg *paymentGateway) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	res, exists := pg.lookup(idempotencyKey)
+	if !exists || !res.Paid {
+		return nil, ErrNotRefundable
+	}
+	if res.Refunded {
+		res.Replayed = true
+		return respond(res)
+	}
 
-		// Nhưng Backend của mình lại nhận về lỗi Timeout (hoặc chủ động trả về lỗi)
-		return false, errors.New("Connection Timeout")
+	if err := clock.Sleep(ctx, pg.cfg.Clock, pg.cfg.Latency); err != nil {
+		return nil, err
 	}
+	return respond(pg.refund(idempotencyKey))
+}
+
+// lost logs money FastPay took whose response is about to be lost, with
+// the same field names as the rest of the logs.
+func (pg *paymentGateway) lost(ctx context.Context, what string, idempotencyKey uuid.UUID, res ChargeResult) {
+	pg.cfg.Logger.WarnContext(ctx, "mock FastPay "+what+" money, response lost",
+		"provider", ProviderFastPay, "idempotency_key", idempotencyKey, "gateway_txn", res.TxnID, "amount", res.Amount)
+}
+
+// hang simulates a response that never arrives.
+func (pg *paymentGateway) hang(ctx context.Context) error {
+	// the network hangs (the caller may give up first)
+	if err := clock.Sleep(ctx, pg.cfg.Clock, pg.cfg.TimeoutLatency); err != nil {
+		return err
+	}
+
+	// and the caller only ever sees a timeout
+	return ErrConnectionTimeout
 }
 
-func (pg *paymentGateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (bool, error) {
+type chargeState int
+
+const (
+	stateDeclined chargeState = iota
+	stateAuthorized
+	stateCaptured
+)
+
+// record stores the outcome of a charge under its idempotency key. If a
+// concurrent request stored one first, that outcome wins.
+func (pg *paymentGateway) record(ctx context.Context, idempotencyKey uuid.UUID, amount int64, state chargeState) ChargeResult {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	key := idempotencyKey.String()
+	if res, exists := pg.charges[key]; exists {
+		res.Replayed = true
+		return res
+	}
+	res := ChargeResult{
+		TxnID:      uuid.New(),
+		Amount:     amount,
+		Paid:       state == stateCaptured,
+		Authorized: state == stateAuthorized,
+	}
+	pg.charges[key] = res
+	pg.refs[key] = Reference(ctx)
+	if res.Paid {
+		pg.appendLedger(idempotencyKey, res)
+	}
+	return res
+}
+
+// capture takes an authorized amount. Capturing twice is a replay.
+func (pg *paymentGateway) capture(idempotencyKey uuid.UUID) ChargeResult {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	key := idempotencyKey.String()
+	res := pg.charges[key]
+	if !res.Authorized {
+		res.Replayed = true
+		return res
+	}
+	res.Authorized = false
+	res.Paid = true
+	pg.charges[key] = res
+	pg.appendLedger(idempotencyKey, res)
+	return res
+}
+
+// refund gives a captured charge back. Refunding twice is a replay.
+func (pg *paymentGateway) refund(idempotencyKey uuid.UUID) ChargeResult {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	key := idempotencyKey.String()
+	res := pg.charges[key]
+	if res.Refunded {
+		res.Replayed = true
+		return res
+	}
+	res.Refunded = true
+	pg.charges[key] = res
+	for i := range pg.ledger {
+		if pg.ledger[i].IdempotencyKey == idempotencyKey {
+			pg.ledger[i].RefundedAt = pg.cfg.Clock.Now()
+		}
+	}
+	return res
+}
+
+func (pg *paymentGateway) appendLedger(idempotencyKey uuid.UUID, res ChargeResult) {
+	pg.ledger = append(pg.ledger, LedgerEntry{
+		OrderRef:       pg.refs[idempotencyKey.String()],
+		IdempotencyKey: idempotencyKey,
+		TxnID:          res.TxnID,
+		Amount:         res.Amount,
+		CapturedAt:     pg.cfg.Clock.Now(),
+	})
+}
+
+// Ledger returns every charge the mock captured, in capture order,
+// including the ones it later refunded.
+func (pg *paymentGateway) Ledger() []LedgerEntry {
 	pg.mu.RLock()
 	defer pg.mu.RUnlock()
+	return append([]LedgerEntry(nil), pg.ledger...)
+}
+
+func respond(res ChargeResult) (*ChargeResult, error) {
+	if !res.Paid && !res.Authorized {
+		return &res, ErrCardDeclined
+	}
+	return &res, nil
+}
 
-	// Giả lập check status API
-	if paid, exists := pg.chargeSuccess[idempotencyKey.String()]; exists {
-		return paid, nil
+// CheckStatus returns the stored charge for the key, or nil if FastPay has
+// never seen it.
+func (pg *paymentGateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return false, nil // Chưa thấy giao dịch này
-}
\ No newline at end of file
+
+	pg.mu.RLock()
+	defer pg.mu.RUnlock()
+
+	if res, exists := pg.charges[idempotencyKey.String()]; exists {
+		return &res, nil
+	}
+	return nil, nil // no such charge
+}
@@ -0,0 +1,94 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"the-phantom-charge/internal/clock"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMockAuthorizeMovesNoMoneyUntilCapture(t *testing.T) {
+	ctx := WithReference(context.Background(), uuid.New())
+	mock := NewMockGateway(MockConfig{}, 1)
+	key := uuid.New()
+
+	auth, err := mock.Authorize(ctx, 100, key)
+	if err != nil || !auth.Authorized || auth.Paid {
+		t.Fatalf("expected an authorization, got %+v, %v", auth, err)
+	}
+	if n := len(mock.(Ledger).Ledger()); n != 0 {
+		t.Fatalf("authorization captured %d charges", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		res, err := mock.Capture(ctx, key)
+		if err != nil || !res.Paid {
+			t.Fatalf("capture %d: got %+v, %v", i+1, res, err)
+		}
+		if res.Replayed != (i > 0) {
+			t.Fatalf("capture %d: replayed = %t", i+1, res.Replayed)
+		}
+	}
+	ledger := mock.(Ledger).Ledger()
+	if len(ledger) != 1 || ledger[0].OrderRef != Reference(ctx) {
+		t.Fatalf("expected one capture for the order, got %+v", ledger)
+	}
+}
+
+func TestMockCaptureWithoutAuthorization(t *testing.T) {
+	mock := NewMockGateway(MockConfig{}, 1)
+	if _, err := mock.Capture(context.Background(), uuid.New()); !errors.Is(err, ErrNoAuthorization) {
+		t.Fatalf("expected ErrNoAuthorization, got %v", err)
+	}
+}
+
+func TestMockRefundGivesBackACapture(t *testing.T) {
+	ctx := context.Background()
+	mock := NewMockGateway(MockConfig{}, 1)
+	key := uuid.New()
+
+	if _, err := mock.Refund(ctx, key); !errors.Is(err, ErrNotRefundable) {
+		t.Fatalf("refund before charge: expected ErrNotRefundable, got %v", err)
+	}
+	if _, err := mock.Charge(ctx, 100, key); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		res, err := mock.Refund(ctx, key)
+		if err != nil || !res.Refunded {
+			t.Fatalf("refund %d: got %+v, %v", i+1, res, err)
+		}
+		if res.Replayed != (i > 0) {
+			t.Fatalf("refund %d: replayed = %t", i+1, res.Replayed)
+		}
+	}
+	ledger := mock.(Ledger).Ledger()
+	if len(ledger) != 1 || ledger[0].RefundedAt.IsZero() {
+		t.Fatalf("expected one refunded capture, got %+v", ledger)
+	}
+}
+
+func TestMockLatencyFollowsItsClock(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	mock := NewMockGateway(MockConfig{Latency: time.Hour, Clock: fake}, 1)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := mock.Charge(context.Background(), 100, uuid.New())
+		done <- err
+	}()
+
+	for fake.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fake.Advance(time.Hour)
+	if err := <-done; err != nil {
+		t.Fatalf("expected a charge, got %v", err)
+	}
+	if at := mock.(Ledger).Ledger()[0].CapturedAt; !at.Equal(fake.Now()) {
+		t.Fatalf("captured at %v, expected the fake clock's %v", at, fake.Now())
+	}
+}
@@ -0,0 +1,23 @@
+package payment
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+type referenceKey struct{}
+
+// WithReference attaches the merchant's order reference to the provider
+// calls made with ctx, as a real PSP takes it in the request metadata. It
+// is the only link between an order and a charge sent without its
+// idempotency key.
+func WithReference(ctx context.Context, orderId uuid.UUID) context.Context {
+	return context.WithValue(ctx, referenceKey{}, orderId)
+}
+
+// Reference returns the order reference attached to ctx, or uuid.Nil.
+func Reference(ctx context.Context) uuid.UUID {
+	ref, _ := ctx.Value(referenceKey{}).(uuid.UUID)
+	return ref
+}
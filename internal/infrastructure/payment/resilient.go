@@ -0,0 +1,22 @@
+package payment
+
+import (
+	"the-phantom-charge/internal/clock"
+	"time"
+)
+
+// DefaultCallTimeout is the deadline for a single FastPay call.
+const DefaultCallTimeout = 1 * time.Second
+
+// Resilient wraps gw in the standard decorator stack: every attempt gets its
+// own deadline and goes through the breaker, and retryable failures are
+// retried on top. Deadlines, backoff and the breaker's open timeout run on
+// clk. The breaker is returned so callers can report its state.
+func Resilient(gw PaymentGateway, callTimeout time.Duration, clk clock.Clock) (PaymentGateway, *CircuitBreaker) {
+	breakerCfg := DefaultBreakerConfig
+	breakerCfg.Clock = clk
+	breaker := NewCircuitBreaker(&timeoutGateway{next: gw, timeout: callTimeout, clock: clk}, breakerCfg)
+	policy := DefaultRetryPolicy
+	policy.Clock = clk
+	return WithRetry(breaker, policy), breaker
+}
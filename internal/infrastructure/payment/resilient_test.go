@@ -0,0 +1,112 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// stubGateway answers Charge with the queued errors, then succeeds.
+type stubGateway struct {
+	errs  []error
+	calls int
+}
+
+func (g *stubGateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	g.calls++
+	if len(g.errs) > 0 {
+		err := g.errs[0]
+		g.errs = g.errs[1:]
+		return nil, err
+	}
+	return &ChargeResult{TxnID: uuid.New(), Amount: amount, Paid: true}, nil
+}
+
+func (g *stubGateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	return g.Charge(ctx, 0, idempotencyKey)
+}
+
+func (g *stubGateway) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	return g.Charge(ctx, amount, idempotencyKey)
+}
+
+func (g *stubGateway) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	return g.Charge(ctx, 0, idempotencyKey)
+}
+
+func (g *stubGateway) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	res, err := g.Charge(ctx, 0, idempotencyKey)
+	if res != nil {
+		res.Refunded = true
+	}
+	return res, err
+}
+
+var fastRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+func TestRetryRetriesTimeouts(t *testing.T) {
+	stub := &stubGateway{errs: []error{ErrConnectionTimeout, context.DeadlineExceeded}}
+	res, err := WithRetry(stub, fastRetry).Charge(context.Background(), 100, uuid.New())
+	if err != nil || !res.Paid {
+		t.Fatalf("expected paid charge, got %v, %v", res, err)
+	}
+	if stub.calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", stub.calls)
+	}
+}
+
+func TestRetryDoesNotRetryDeclines(t *testing.T) {
+	stub := &stubGateway{errs: []error{ErrCardDeclined}}
+	_, err := WithRetry(stub, fastRetry).Charge(context.Background(), 100, uuid.New())
+	if !errors.Is(err, ErrCardDeclined) {
+		t.Fatalf("expected decline, got %v", err)
+	}
+	if stub.calls != 1 {
+		t.Fatalf("expected 1 call, got %d", stub.calls)
+	}
+}
+
+// TestRetryKeepsAmbiguousError opens the breaker after a timed-out
+// attempt: the charge may have gone through, so the caller must not be
+// told nothing was sent.
+func TestRetryKeepsAmbiguousError(t *testing.T) {
+	stub := &stubGateway{errs: []error{ErrConnectionTimeout, ErrGatewayUnavailable}}
+	policy := fastRetry
+	policy.MaxAttempts = 2
+	_, err := WithRetry(stub, policy).Charge(context.Background(), 100, uuid.New())
+	if !errors.Is(err, ErrConnectionTimeout) {
+		t.Fatalf("expected the timeout, got %v", err)
+	}
+}
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	stub := &stubGateway{errs: []error{ErrConnectionTimeout, ErrConnectionTimeout}}
+	cb := NewCircuitBreaker(stub, BreakerConfig{FailureThreshold: 2, OpenTimeout: 10 * time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		cb.Charge(context.Background(), 100, uuid.New())
+	}
+	if cb.State() != BreakerOpen {
+		t.Fatalf("expected open breaker, got %s", cb.State())
+	}
+	if _, err := cb.Charge(context.Background(), 100, uuid.New()); !errors.Is(err, ErrGatewayUnavailable) {
+		t.Fatalf("expected ErrGatewayUnavailable, got %v", err)
+	}
+	if stub.calls != 2 {
+		t.Fatalf("open breaker should not call FastPay, got %d calls", stub.calls)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if cb.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open breaker, got %s", cb.State())
+	}
+	if _, err := cb.Charge(context.Background(), 100, uuid.New()); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if cb.State() != BreakerClosed {
+		t.Fatalf("expected closed breaker, got %s", cb.State())
+	}
+}
@@ -0,0 +1,108 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"the-phantom-charge/internal/clock"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Clock times the backoff; nil is the wall clock.
+	Clock clock.Clock
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    1 * time.Second,
+}
+
+// backoff returns the wait before the given retry (1-based): exponential
+// growth capped at MaxDelay, with the upper half jittered so concurrent
+// checkouts don't retry in lockstep.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay << (retry - 1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+type retryGateway struct {
+	next   PaymentGateway
+	policy RetryPolicy
+}
+
+// WithRetry resends calls that failed with a retryable error. Retrying
+// Charge is safe only because every attempt carries the same idempotency
+// key: FastPay answers a repeat with the original outcome.
+func WithRetry(next PaymentGateway, policy RetryPolicy) PaymentGateway {
+	if policy.Clock == nil {
+		policy.Clock = clock.Real
+	}
+	return &retryGateway{next: next, policy: policy}
+}
+
+func (g *retryGateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	return g.do(ctx, func() (*ChargeResult, error) {
+		return g.next.Charge(ctx, amount, idempotencyKey)
+	})
+}
+
+func (g *retryGateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	return g.do(ctx, func() (*ChargeResult, error) {
+		return g.next.CheckStatus(ctx, idempotencyKey)
+	})
+}
+
+func (g *retryGateway) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	return g.do(ctx, func() (*ChargeResult, error) {
+		return g.next.Authorize(ctx, amount, idempotencyKey)
+	})
+}
+
+func (g *retryGateway) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	return g.do(ctx, func() (*ChargeResult, error) {
+		return g.next.Capture(ctx, idempotencyKey)
+	})
+}
+
+func (g *retryGateway) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	return g.do(ctx, func() (*ChargeResult, error) {
+		return g.next.Refund(ctx, idempotencyKey)
+	})
+}
+
+func (g *retryGateway) do(ctx context.Context, call func() (*ChargeResult, error)) (*ChargeResult, error) {
+	// the last failure that may have reached FastPay
+	var sent error
+	for attempt := 1; ; attempt++ {
+		res, err := call()
+		switch {
+		case errors.Is(err, ErrGatewayUnavailable) && sent != nil:
+			// the breaker opening now doesn't undo an earlier attempt:
+			// reporting "nothing was sent" would invite a failover charge
+			err = sent
+		case err != nil && !errors.Is(err, ErrGatewayUnavailable):
+			sent = err
+		}
+		if err == nil || !IsRetryable(err) || attempt >= g.policy.MaxAttempts {
+			return res, err
+		}
+		// the caller gave up, not FastPay
+		if ctx.Err() != nil {
+			return res, err
+		}
+		if err := clock.Sleep(ctx, g.policy.Clock, g.policy.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
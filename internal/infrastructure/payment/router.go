@@ -0,0 +1,178 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ProviderFastPay is the name FastPay is registered under. Orders created
+// before routing existed have no provider and belong to it.
+const ProviderFastPay = "fastpay"
+
+// Registry holds the payment providers the service can charge through.
+type Registry struct {
+	mu        sync.RWMutex
+	gateways  map[string]PaymentGateway
+	breakers  map[string]*CircuitBreaker
+	providers []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		gateways: make(map[string]PaymentGateway),
+		breakers: make(map[string]*CircuitBreaker),
+	}
+}
+
+// Register adds a provider. breaker may be nil when the gateway has none.
+func (r *Registry) Register(name string, gw PaymentGateway, breaker *CircuitBreaker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.gateways[name]; !exists {
+		r.providers = append(r.providers, name)
+	}
+	r.gateways[name] = gw
+	if breaker != nil {
+		r.breakers[name] = breaker
+	}
+}
+
+func (r *Registry) Gateway(name string) (PaymentGateway, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if name == "" {
+		name = ProviderFastPay
+	}
+	gw, ok := r.gateways[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown payment provider %q", name)
+	}
+	return gw, nil
+}
+
+// Providers returns the registered provider names in registration order.
+func (r *Registry) Providers() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.providers...)
+}
+
+// BreakerStates returns the circuit state of every provider that has one.
+func (r *Registry) BreakerStates() map[string]BreakerState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	states := make(map[string]BreakerState, len(r.breakers))
+	for name, cb := range r.breakers {
+		states[name] = cb.State()
+	}
+	return states
+}
+
+type WeightedProvider struct {
+	Name   string
+	Weight int
+}
+
+// Rule sends matching orders to its providers. Empty fields match anything.
+type Rule struct {
+	Currency string
+	// amount range [MinAmount, MaxAmount); MaxAmount 0 means no upper bound
+	MinAmount int64
+	MaxAmount int64
+	Providers []WeightedProvider
+}
+
+func (rule Rule) matches(currency string, amount int64) bool {
+	if rule.Currency != "" && rule.Currency != currency {
+		return false
+	}
+	if amount < rule.MinAmount {
+		return false
+	}
+	return rule.MaxAmount == 0 || amount < rule.MaxAmount
+}
+
+// Router picks the provider for an order. The first matching rule wins;
+// orders no rule matches go to the registered providers in order.
+type Router struct {
+	registry *Registry
+	rules    []Rule
+}
+
+func NewRouter(registry *Registry, rules ...Rule) *Router {
+	return &Router{registry: registry, rules: rules}
+}
+
+func (r *Router) Registry() *Registry {
+	return r.registry
+}
+
+// Gateway returns the provider an order was already sent to.
+func (r *Router) Gateway(provider string) (PaymentGateway, error) {
+	return r.registry.Gateway(provider)
+}
+
+// Refund gives back a charge through provider, the one that took it. It
+// never fails over: no other provider holds the money, so while provider
+// is down the refund fails with its error.
+func (r *Router) Refund(ctx context.Context, provider string, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	gw, err := r.registry.Gateway(provider)
+	if err != nil {
+		return nil, err
+	}
+	return gw.Refund(ctx, idempotencyKey)
+}
+
+// Candidates returns the providers to try for a new charge, primary first.
+// The weighted pick hashes the idempotency key, so retries of the same
+// order always start at the same provider.
+func (r *Router) Candidates(currency string, amount int64, idempotencyKey uuid.UUID) []string {
+	for _, rule := range r.rules {
+		if rule.matches(currency, amount) && len(rule.Providers) > 0 {
+			return pickWeighted(rule.Providers, idempotencyKey)
+		}
+	}
+	return r.registry.Providers()
+}
+
+// pickWeighted puts the weighted pick first and the other providers after
+// it, heaviest first, as failover targets.
+func pickWeighted(providers []WeightedProvider, key uuid.UUID) []string {
+	total := 0
+	for _, p := range providers {
+		total += p.Weight
+	}
+
+	primary := 0
+	if total > 0 {
+		h := fnv.New32a()
+		h.Write(key[:])
+		point := int(h.Sum32() % uint32(total))
+		for i, p := range providers {
+			if point < p.Weight {
+				primary = i
+				break
+			}
+			point -= p.Weight
+		}
+	}
+
+	rest := make([]WeightedProvider, 0, len(providers)-1)
+	rest = append(rest, providers[:primary]...)
+	rest = append(rest, providers[primary+1:]...)
+	sort.SliceStable(rest, func(i, j int) bool { return rest[i].Weight > rest[j].Weight })
+
+	names := []string{providers[primary].Name}
+	for _, p := range rest {
+		names = append(names, p.Name)
+	}
+	return names
+}
@@ -0,0 +1,59 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRouterCandidates(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(ProviderFastPay, &stubGateway{}, nil)
+	registry.Register("altpay", &stubGateway{}, nil)
+
+	router := NewRouter(registry,
+		Rule{Currency: "EUR", Providers: []WeightedProvider{{Name: "altpay", Weight: 1}}},
+		Rule{MinAmount: 5000, Providers: []WeightedProvider{{Name: "altpay", Weight: 1}, {Name: ProviderFastPay, Weight: 1}}},
+	)
+
+	if got := router.Candidates("EUR", 10, uuid.New()); len(got) != 1 || got[0] != "altpay" {
+		t.Fatalf("EUR order: expected [altpay], got %v", got)
+	}
+	if got := router.Candidates("USD", 10, uuid.New()); len(got) != 2 || got[0] != ProviderFastPay {
+		t.Fatalf("small USD order: expected registry order, got %v", got)
+	}
+
+	key := uuid.New()
+	first := router.Candidates("USD", 9000, key)
+	if len(first) != 2 {
+		t.Fatalf("large USD order: expected primary and failover, got %v", first)
+	}
+	for i := 0; i < 10; i++ {
+		if got := router.Candidates("USD", 9000, key); got[0] != first[0] {
+			t.Fatalf("same key routed to %s then %s", first[0], got[0])
+		}
+	}
+}
+
+func TestRouterRefundNeverFailsOver(t *testing.T) {
+	down := &stubGateway{errs: []error{ErrGatewayUnavailable}}
+	other := &stubGateway{}
+	registry := NewRegistry()
+	registry.Register(ProviderFastPay, down, nil)
+	registry.Register("altpay", other, nil)
+	router := NewRouter(registry)
+
+	if _, err := router.Refund(context.Background(), ProviderFastPay, uuid.New()); !errors.Is(err, ErrGatewayUnavailable) {
+		t.Fatalf("expected ErrGatewayUnavailable, got %v", err)
+	}
+	if down.calls != 1 || other.calls != 0 {
+		t.Fatalf("expected the refund at fastpay only, got fastpay %d, altpay %d calls", down.calls, other.calls)
+	}
+
+	res, err := router.Refund(context.Background(), "altpay", uuid.New())
+	if err != nil || !res.Refunded || other.calls != 1 {
+		t.Fatalf("expected the refund at altpay, got %+v, %v", res, err)
+	}
+}
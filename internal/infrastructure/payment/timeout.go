@@ -0,0 +1,52 @@
+package payment
+
+import (
+	"context"
+	"the-phantom-charge/internal/clock"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type timeoutGateway struct {
+	next    PaymentGateway
+	timeout time.Duration
+	clock   clock.Clock
+}
+
+// WithTimeout bounds every call to next by its own deadline, independent of
+// the caller's context, so one slow FastPay call cannot eat the whole
+// request budget.
+func WithTimeout(next PaymentGateway, timeout time.Duration) PaymentGateway {
+	return &timeoutGateway{next: next, timeout: timeout, clock: clock.Real}
+}
+
+func (g *timeoutGateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	ctx, cancel := clock.WithTimeout(ctx, g.clock, g.timeout)
+	defer cancel()
+	return g.next.Charge(ctx, amount, idempotencyKey)
+}
+
+func (g *timeoutGateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	ctx, cancel := clock.WithTimeout(ctx, g.clock, g.timeout)
+	defer cancel()
+	return g.next.CheckStatus(ctx, idempotencyKey)
+}
+
+func (g *timeoutGateway) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	ctx, cancel := clock.WithTimeout(ctx, g.clock, g.timeout)
+	defer cancel()
+	return g.next.Authorize(ctx, amount, idempotencyKey)
+}
+
+func (g *timeoutGateway) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	ctx, cancel := clock.WithTimeout(ctx, g.clock, g.timeout)
+	defer cancel()
+	return g.next.Capture(ctx, idempotencyKey)
+}
+
+func (g *timeoutGateway) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*ChargeResult, error) {
+	ctx, cancel := clock.WithTimeout(ctx, g.clock, g.timeout)
+	defer cancel()
+	return g.next.Refund(ctx, idempotencyKey)
+}
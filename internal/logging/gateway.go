@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"the-phantom-charge/internal/infrastructure/payment"
+)
+
+// Gateway wraps provider's gateway next and logs every call with its
+// idempotency key, result and the provider's transaction ID. Under the
+// resilience layer each attempt gets its own line.
+func Gateway(provider string, next payment.PaymentGateway, logger *slog.Logger) payment.PaymentGateway {
+	return &gateway{next: next, provider: provider, logger: logger}
+}
+
+type gateway struct {
+	next     payment.PaymentGateway
+	provider string
+	logger   *slog.Logger
+}
+
+func (g *gateway) log(ctx context.Context, method string, idempotencyKey uuid.UUID, start time.Time, res *payment.ChargeResult, err error) {
+	args := []any{
+		"method", method,
+		Provider, g.provider,
+		IdempotencyKey, idempotencyKey,
+		"result", payment.ErrorClass(err),
+		"duration_ms", time.Since(start).Milliseconds(),
+	}
+	if res != nil {
+		args = append(args, "paid", res.Paid, "authorized", res.Authorized, "refunded", res.Refunded, "replayed", res.Replayed)
+		if res.TxnID != uuid.Nil {
+			args = append(args, GatewayTxn, res.TxnID)
+		}
+	}
+	if err != nil {
+		g.logger.WarnContext(ctx, "gateway call failed", append(args, "error", err)...)
+		return
+	}
+	g.logger.InfoContext(ctx, "gateway call", args...)
+}
+
+func (g *gateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.Charge(ctx, amount, idempotencyKey)
+	g.log(ctx, "Charge", idempotencyKey, start, res, err)
+	return res, err
+}
+
+func (g *gateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.CheckStatus(ctx, idempotencyKey)
+	g.log(ctx, "CheckStatus", idempotencyKey, start, res, err)
+	return res, err
+}
+
+func (g *gateway) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.Authorize(ctx, amount, idempotencyKey)
+	g.log(ctx, "Authorize", idempotencyKey, start, res, err)
+	return res, err
+}
+
+func (g *gateway) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.Capture(ctx, idempotencyKey)
+	g.log(ctx, "Capture", idempotencyKey, start, res, err)
+	return res, err
+}
+
+func (g *gateway) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.Refund(ctx, idempotencyKey)
+	g.log(ctx, "Refund", idempotencyKey, start, res, err)
+	return res, err
+}
@@ -0,0 +1,149 @@
+// Package logging sets up structured JSON logs and carries per-request
+// fields through the context, so every line logged while handling an order
+// names it and support can pull one order's history with a single grep.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Field names shared by every component. Use these rather than ad hoc keys
+// so one order's lines match the same query everywhere.
+const (
+	RequestID      = "request_id"
+	OrderID        = "order_id"
+	IdempotencyKey = "idempotency_key"
+	PaymentID      = "payment_id"
+	GatewayTxn     = "gateway_txn"
+	Provider       = "provider"
+	TraceID        = "trace_id"
+)
+
+// New returns a logger writing JSON lines to w at level and above. Fields
+// added to the context with With are appended to every line, as is the
+// trace ID of the span in the context, if any.
+func New(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(NewHandler(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+// LevelFromEnv reads LOG_LEVEL (debug, info, warn or error), defaulting to
+// info.
+func LevelFromEnv() slog.Level {
+	var level slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(strings.ToUpper(v))); err != nil {
+			return slog.LevelInfo
+		}
+	}
+	return level
+}
+
+// Discard drops everything; it is the default for components that only log
+// when given a logger.
+var Discard = slog.New(slog.DiscardHandler)
+
+type ctxKey struct{}
+
+// With returns a copy of ctx whose log lines carry args, given as
+// alternating keys and values like slog.Logger.With. A key already in ctx
+// is replaced.
+func With(ctx context.Context, args ...any) context.Context {
+	added := argsToAttrs(args)
+	prev := attrs(ctx)
+	merged := make([]slog.Attr, 0, len(prev)+len(added))
+	for _, a := range prev {
+		if !hasKey(added, a.Key) {
+			merged = append(merged, a)
+		}
+	}
+	return context.WithValue(ctx, ctxKey{}, append(merged, added...))
+}
+
+// WithRequestID tags ctx with the ID of the HTTP request it serves.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return With(ctx, RequestID, id)
+}
+
+// RequestIDFrom returns the ID set by WithRequestID, or "".
+func RequestIDFrom(ctx context.Context) string {
+	for _, a := range attrs(ctx) {
+		if a.Key == RequestID {
+			return a.Value.String()
+		}
+	}
+	return ""
+}
+
+func attrs(ctx context.Context) []slog.Attr {
+	a, _ := ctx.Value(ctxKey{}).([]slog.Attr)
+	return a
+}
+
+func argsToAttrs(args []any) []slog.Attr {
+	var r slog.Record
+	r.Add(args...)
+	out := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		out = append(out, a)
+		return true
+	})
+	return out
+}
+
+func hasKey(attrs []slog.Attr, key string) bool {
+	for _, a := range attrs {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler adds the context's fields to each record. A field the call site
+// logs itself wins over the context's copy, so lines never repeat a key.
+type Handler struct {
+	next slog.Handler
+}
+
+// NewHandler wraps next.
+func NewHandler(next slog.Handler) *Handler {
+	return &Handler{next: next}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	fields := attrs(ctx)
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		fields = append(fields[:len(fields):len(fields)], slog.String(TraceID, sc.TraceID().String()))
+	}
+	if len(fields) > 0 {
+		var own []slog.Attr
+		r.Attrs(func(a slog.Attr) bool {
+			own = append(own, a)
+			return true
+		})
+		for _, a := range fields {
+			if !hasKey(own, a.Key) {
+				r.AddAttrs(a)
+			}
+		}
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &Handler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name)}
+}
@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"the-phantom-charge/internal/infrastructure/payment"
+)
+
+// lines decodes every JSON line logged to buf.
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]any
+		if err := json.Unmarshal([]byte(l), &m); err != nil {
+			t.Fatalf("not JSON: %q", l)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestContextFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo)
+	orderID := uuid.New()
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	ctx = With(ctx, OrderID, orderID, Provider, "fastpay")
+	ctx = With(ctx, Provider, "slowpay")
+	ctx, span := sdktrace.NewTracerProvider().Tracer("test").Start(ctx, "checkout")
+	defer span.End()
+
+	logger.InfoContext(ctx, "settled", PaymentID, "p-1")
+	logger.InfoContext(ctx, "explicit", OrderID, "other")
+	logger.DebugContext(ctx, "hidden")
+
+	got := lines(t, &buf)
+	if len(got) != 2 {
+		t.Fatalf("%d lines, want 2", len(got))
+	}
+	first := got[0]
+	if first[RequestID] != "req-1" || first[OrderID] != orderID.String() || first[PaymentID] != "p-1" {
+		t.Errorf("context fields missing: %v", first)
+	}
+	if first[Provider] != "slowpay" {
+		t.Errorf("With should replace a key, got provider %v", first[Provider])
+	}
+	if first[TraceID] != span.SpanContext().TraceID().String() {
+		t.Errorf("trace_id %v, want %s", first[TraceID], span.SpanContext().TraceID())
+	}
+	if got[1][OrderID] != "other" || strings.Count(buf.String(), `"order_id"`) != 2 {
+		t.Errorf("the call site's field should win without repeating the key: %s", buf.String())
+	}
+	if RequestIDFrom(ctx) != "req-1" || RequestIDFrom(context.Background()) != "" {
+		t.Errorf("RequestIDFrom(ctx) = %q", RequestIDFrom(ctx))
+	}
+}
+
+func TestLevelFromEnv(t *testing.T) {
+	for env, want := range map[string]slog.Level{"": slog.LevelInfo, "debug": slog.LevelDebug, "WARN": slog.LevelWarn, "loud": slog.LevelInfo} {
+		t.Setenv("LOG_LEVEL", env)
+		if got := LevelFromEnv(); got != want {
+			t.Errorf("LOG_LEVEL=%q: %v, want %v", env, got, want)
+		}
+	}
+}
+
+func TestGatewayLogs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo)
+	ctx := With(context.Background(), OrderID, uuid.New())
+	key := uuid.New()
+
+	gw := Gateway(payment.ProviderFastPay, payment.NewMockGateway(payment.MockConfig{Logger: Discard}, 1), logger)
+	res, err := gw.Charge(ctx, 100, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := Gateway(payment.ProviderFastPay,
+		payment.NewChaos(payment.NewMockGateway(payment.MockConfig{Logger: Discard}, 1), payment.ChaosConfig{Enabled: true, DropResponseProbability: 1}, 1, nil), logger)
+	if _, err := failing.Charge(ctx, 100, key); err == nil {
+		t.Fatal("chaos let the call through")
+	}
+
+	got := lines(t, &buf)
+	if len(got) != 2 {
+		t.Fatalf("%d lines, want 2", len(got))
+	}
+	ok, lost := got[0], got[1]
+	if ok[IdempotencyKey] != key.String() || ok[GatewayTxn] != res.TxnID.String() || ok["result"] != "ok" || ok[OrderID] == nil {
+		t.Errorf("charge line: %v", ok)
+	}
+	if lost["level"] != "WARN" || lost["result"] != "timeout" || lost["error"] == nil {
+		t.Errorf("lost charge line: %v", lost)
+	}
+}
@@ -0,0 +1,340 @@
+// Package metrics exposes the service's Prometheus metrics: checkout
+// outcomes, gateway calls, reconciliation passes, pending orders and the
+// database pool. Components are instrumented by wrapping them, the way
+// the resilience layer wraps gateways, so none of them import Prometheus.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/database"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/service"
+	"the-phantom-charge/internal/worker"
+)
+
+const namespace = "phantom"
+
+// scrapeTimeout bounds the database query behind the pending order gauges.
+const scrapeTimeout = 2 * time.Second
+
+// Metrics holds the collectors on a registry of its own, so tests and the
+// simulator can build several.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	checkouts        *prometheus.CounterVec
+	checkoutDuration *prometheus.HistogramVec
+	gatewayCalls     *prometheus.HistogramVec
+
+	passes          *prometheus.CounterVec
+	passDuration    prometheus.Histogram
+	stuckOrders     prometheus.Counter
+	ghostsFound     prometheus.Counter
+	ghostsFixed     prometheus.Counter
+	abandonedFixed  prometheus.Counter
+	checksFailed    prometheus.Counter
+	lastPassSuccess prometheus.Gauge
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		checkouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "checkouts_total",
+			Help:      "Checkouts by outcome.",
+		}, []string{"outcome"}),
+		checkoutDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "checkout_duration_seconds",
+			Help:      "Checkout latency by outcome, including gateway calls and retries.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"outcome"}),
+		gatewayCalls: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "gateway_call_duration_seconds",
+			Help:      "Payment gateway call latency, one observation per attempt, by provider, method and result.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"provider", "method", "result"}),
+		passes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconciliation_passes_total",
+			Help:      "Reconciliation passes by result.",
+		}, []string{"result"}),
+		passDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "reconciliation_pass_duration_seconds",
+			Help:      "Reconciliation pass duration.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+		stuckOrders: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconciliation_stuck_orders_total",
+			Help:      "Stuck orders found by reconciliation passes.",
+		}),
+		ghostsFound: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconciliation_ghost_orders_found_total",
+			Help:      "Stuck orders the provider had charged.",
+		}),
+		ghostsFixed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconciliation_ghost_orders_fixed_total",
+			Help:      "Ghost orders settled PAID by reconciliation.",
+		}),
+		abandonedFixed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconciliation_abandoned_orders_fixed_total",
+			Help:      "Stuck orders the provider had not charged, settled FAILED by reconciliation.",
+		}),
+		checksFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconciliation_status_checks_failed_total",
+			Help:      "Stuck orders left for the next pass because the provider's status was unknown.",
+		}),
+		lastPassSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "reconciliation_last_success_timestamp_seconds",
+			Help:      "When the last reconciliation pass finished without error.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.checkouts, m.checkoutDuration, m.gatewayCalls,
+		m.passes, m.passDuration, m.stuckOrders, m.ghostsFound, m.ghostsFixed, m.abandonedFixed, m.checksFailed, m.lastPassSuccess,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Checkout outcomes. The first two are service.CheckoutOutcome; the rest
+// are errors.
+const (
+	outcomePaid                = "paid"
+	outcomePendingConfirmation = "pending_confirmation"
+	outcomeDeclined            = "declined"
+	outcomeNotFound            = "not_found"
+	outcomeNotPending          = "not_pending"
+	outcomeGatewayUnavailable  = "gateway_unavailable"
+	outcomeCrashed             = "crashed"
+	outcomeError               = "error"
+)
+
+func checkoutOutcome(result *service.CheckoutResult, err error) string {
+	switch {
+	case err == nil && result.Outcome == service.CheckoutPaid:
+		return outcomePaid
+	case err == nil:
+		return outcomePendingConfirmation
+	case errors.Is(err, service.ErrPaymentFailed):
+		return outcomeDeclined
+	case errors.Is(err, service.ErrOrderNotFound):
+		return outcomeNotFound
+	case errors.Is(err, service.ErrOrderNotPending):
+		return outcomeNotPending
+	case errors.Is(err, payment.ErrGatewayUnavailable):
+		return outcomeGatewayUnavailable
+	case errors.Is(err, service.ErrCrashed):
+		return outcomeCrashed
+	default:
+		return outcomeError
+	}
+}
+
+// OrderService counts next's checkouts by outcome and times them.
+func (m *Metrics) OrderService(next service.OrderService) service.OrderService {
+	return &orderService{OrderService: next, m: m}
+}
+
+type orderService struct {
+	service.OrderService
+	m *Metrics
+}
+
+func (s *orderService) Checkout(ctx context.Context, orderId uuid.UUID) (*service.CheckoutResult, error) {
+	start := time.Now()
+	result, err := s.OrderService.Checkout(ctx, orderId)
+	outcome := checkoutOutcome(result, err)
+	s.m.checkouts.WithLabelValues(outcome).Inc()
+	s.m.checkoutDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	return result, err
+}
+
+// Gateway times every call to provider's gateway next. Put it under the
+// resilience layer to see each attempt.
+func (m *Metrics) Gateway(provider string, next payment.PaymentGateway) payment.PaymentGateway {
+	return &gateway{next: next, provider: provider, m: m}
+}
+
+type gateway struct {
+	next     payment.PaymentGateway
+	provider string
+	m        *Metrics
+}
+
+func (g *gateway) observe(method string, start time.Time, err error) {
+	g.m.gatewayCalls.WithLabelValues(g.provider, method, payment.ErrorClass(err)).Observe(time.Since(start).Seconds())
+}
+
+func (g *gateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.Charge(ctx, amount, idempotencyKey)
+	g.observe("charge", start, err)
+	return res, err
+}
+
+func (g *gateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.CheckStatus(ctx, idempotencyKey)
+	g.observe("check_status", start, err)
+	return res, err
+}
+
+func (g *gateway) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.Authorize(ctx, amount, idempotencyKey)
+	g.observe("authorize", start, err)
+	return res, err
+}
+
+func (g *gateway) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.Capture(ctx, idempotencyKey)
+	g.observe("capture", start, err)
+	return res, err
+}
+
+func (g *gateway) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	start := time.Now()
+	res, err := g.next.Refund(ctx, idempotencyKey)
+	g.observe("refund", start, err)
+	return res, err
+}
+
+// ObservePass records a reconciliation pass; pass it to
+// worker.WithPassHook.
+func (m *Metrics) ObservePass(stats worker.PassStats) {
+	result := "ok"
+	if stats.Err != nil {
+		result = "error"
+	} else {
+		m.lastPassSuccess.SetToCurrentTime()
+	}
+	m.passes.WithLabelValues(result).Inc()
+	m.passDuration.Observe(stats.Duration.Seconds())
+	m.stuckOrders.Add(float64(stats.Stuck))
+	m.ghostsFound.Add(float64(stats.GhostsFound))
+	m.ghostsFixed.Add(float64(stats.GhostsFixed))
+	m.abandonedFixed.Add(float64(stats.AbandonedFixed))
+	m.checksFailed.Add(float64(stats.CheckFailed))
+}
+
+// RegisterPool reports the database pool, read from stats at every
+// scrape.
+func (m *Metrics) RegisterPool(stats func() database.PoolStats) {
+	m.registry.MustRegister(&poolCollector{stats: stats})
+}
+
+var (
+	poolMaxConns = prometheus.NewDesc(namespace+"_db_pool_max_conns",
+		"Size limit of the database pool.", nil, nil)
+	poolTotalConns = prometheus.NewDesc(namespace+"_db_pool_conns",
+		"Open database connections by state.", []string{"state"}, nil)
+	poolAcquires = prometheus.NewDesc(namespace+"_db_pool_acquires_total",
+		"Connections handed out by the pool.", nil, nil)
+	poolWaits = prometheus.NewDesc(namespace+"_db_pool_acquire_waits_total",
+		"Acquires that had to wait for a free connection.", nil, nil)
+	poolWaitSeconds = prometheus.NewDesc(namespace+"_db_pool_acquire_wait_seconds_total",
+		"Time spent waiting for a free connection.", nil, nil)
+	poolCanceled = prometheus.NewDesc(namespace+"_db_pool_canceled_acquires_total",
+		"Acquires given up before a connection freed up.", nil, nil)
+)
+
+type poolCollector struct {
+	stats func() database.PoolStats
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolMaxConns
+	ch <- poolTotalConns
+	ch <- poolAcquires
+	ch <- poolWaits
+	ch <- poolWaitSeconds
+	ch <- poolCanceled
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stats()
+	ch <- prometheus.MustNewConstMetric(poolMaxConns, prometheus.GaugeValue, float64(s.MaxConns))
+	ch <- prometheus.MustNewConstMetric(poolTotalConns, prometheus.GaugeValue, float64(s.AcquiredConns), "in_use")
+	ch <- prometheus.MustNewConstMetric(poolTotalConns, prometheus.GaugeValue, float64(s.IdleConns), "idle")
+	ch <- prometheus.MustNewConstMetric(poolAcquires, prometheus.CounterValue, float64(s.AcquireCount))
+	ch <- prometheus.MustNewConstMetric(poolWaits, prometheus.CounterValue, float64(s.WaitCount))
+	ch <- prometheus.MustNewConstMetric(poolWaitSeconds, prometheus.CounterValue, s.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(poolCanceled, prometheus.CounterValue, float64(s.CanceledAcquires))
+}
+
+// RegisterPendingOrders reports the orders not yet settled, summarized by
+// orders at every scrape, and how far reconciliation is behind: an order
+// is the worker's once untouched for stuckAfter.
+func (m *Metrics) RegisterPendingOrders(orders repo.OrderRepo, clk clock.Clock, stuckAfter time.Duration) {
+	m.registry.MustRegister(&pendingCollector{orders: orders, clock: clk, stuckAfter: stuckAfter})
+}
+
+var (
+	pendingOrders = prometheus.NewDesc(namespace+"_orders_pending",
+		"Orders PENDING or PAYMENT_UNKNOWN, by status.", []string{"status"}, nil)
+	pendingOldest = prometheus.NewDesc(namespace+"_orders_pending_oldest_age_seconds",
+		"Time since the least recently updated order not yet settled was touched; 0 when there is none.", nil, nil)
+	reconciliationLag = prometheus.NewDesc(namespace+"_reconciliation_lag_seconds",
+		"How long the oldest order due for reconciliation has waited past the stuck threshold; 0 when none is due.", nil, nil)
+)
+
+type pendingCollector struct {
+	orders     repo.OrderRepo
+	clock      clock.Clock
+	stuckAfter time.Duration
+}
+
+func (c *pendingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingOrders
+	ch <- pendingOldest
+	ch <- reconciliationLag
+}
+
+func (c *pendingCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+	summary, err := c.orders.SummarizePending(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(pendingOrders, err)
+		ch <- prometheus.NewInvalidMetric(pendingOldest, err)
+		ch <- prometheus.NewInvalidMetric(reconciliationLag, err)
+		return
+	}
+	var oldest time.Duration
+	if !summary.OldestUpdate.IsZero() {
+		oldest = c.clock.Now().Sub(summary.OldestUpdate)
+	}
+	for status, n := range summary.Counts {
+		ch <- prometheus.MustNewConstMetric(pendingOrders, prometheus.GaugeValue, float64(n), string(status))
+	}
+	ch <- prometheus.MustNewConstMetric(pendingOldest, prometheus.GaugeValue, oldest.Seconds())
+	ch <- prometheus.MustNewConstMetric(reconciliationLag, prometheus.GaugeValue, max(oldest-c.stuckAfter, 0).Seconds())
+}
@@ -0,0 +1,139 @@
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/database"
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/metrics"
+	"the-phantom-charge/internal/repo/memory"
+	"the-phantom-charge/internal/service"
+	"the-phantom-charge/internal/worker"
+)
+
+type stubOrderService struct {
+	service.OrderService
+	result *service.CheckoutResult
+	err    error
+}
+
+func (s *stubOrderService) Checkout(ctx context.Context, orderId uuid.UUID) (*service.CheckoutResult, error) {
+	return s.result, s.err
+}
+
+// scrape returns the metrics page.
+func scrape(t *testing.T, m *metrics.Metrics) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func requireLines(t *testing.T, page string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(page, "\n"+line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+}
+
+func TestCheckoutOutcomes(t *testing.T) {
+	m := metrics.New()
+	paid := m.OrderService(&stubOrderService{result: &service.CheckoutResult{Outcome: service.CheckoutPaid}})
+	pending := m.OrderService(&stubOrderService{result: &service.CheckoutResult{Outcome: service.CheckoutPendingConfirmation}})
+	declined := m.OrderService(&stubOrderService{err: service.ErrPaymentFailed})
+
+	ctx := context.Background()
+	paid.Checkout(ctx, uuid.New())
+	paid.Checkout(ctx, uuid.New())
+	pending.Checkout(ctx, uuid.New())
+	declined.Checkout(ctx, uuid.New())
+
+	requireLines(t, scrape(t, m),
+		`phantom_checkouts_total{outcome="paid"} 2`,
+		`phantom_checkouts_total{outcome="pending_confirmation"} 1`,
+		`phantom_checkouts_total{outcome="declined"} 1`,
+		`phantom_checkout_duration_seconds_count{outcome="paid"} 2`,
+	)
+}
+
+func TestGatewayResults(t *testing.T) {
+	m := metrics.New()
+	ctx := context.Background()
+	ok := m.Gateway(payment.ProviderFastPay, payment.NewMockGateway(payment.MockConfig{}, 1))
+	if _, err := ok.Charge(ctx, 100, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	failing := m.Gateway(payment.ProviderFastPay,
+		payment.NewChaos(payment.NewMockGateway(payment.MockConfig{}, 1), payment.ChaosConfig{Enabled: true, DropResponseProbability: 1}, 1, nil))
+	if _, err := failing.CheckStatus(ctx, uuid.New()); err == nil {
+		t.Fatal("chaos let the call through")
+	}
+
+	requireLines(t, scrape(t, m),
+		`phantom_gateway_call_duration_seconds_count{method="charge",provider="fastpay",result="ok"} 1`,
+		`phantom_gateway_call_duration_seconds_count{method="check_status",provider="fastpay",result="timeout"} 1`,
+	)
+}
+
+func TestObservePass(t *testing.T) {
+	m := metrics.New()
+	m.ObservePass(worker.PassStats{Stuck: 3, GhostsFound: 2, GhostsFixed: 1, AbandonedFixed: 1})
+	m.ObservePass(worker.PassStats{Err: context.DeadlineExceeded})
+
+	requireLines(t, scrape(t, m),
+		`phantom_reconciliation_passes_total{result="ok"} 1`,
+		`phantom_reconciliation_passes_total{result="error"} 1`,
+		`phantom_reconciliation_stuck_orders_total 3`,
+		`phantom_reconciliation_ghost_orders_found_total 2`,
+		`phantom_reconciliation_ghost_orders_fixed_total 1`,
+		`phantom_reconciliation_abandoned_orders_fixed_total 1`,
+	)
+}
+
+func TestPendingOrdersAndPool(t *testing.T) {
+	ctx := context.Background()
+	fake := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := memory.NewStore(fake)
+	orders := memory.NewOrderRepo(store)
+	old := &domain.Order{ID: uuid.New(), UserID: uuid.New(), Amount: 10, IdempotencyKey: uuid.New(), Status: domain.OrderPending, CreatedAt: fake.Now(), UpdatedAt: fake.Now(), Currency: "USD"}
+	if err := orders.CreateOrder(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(90 * time.Second)
+	unknown := &domain.Order{ID: uuid.New(), UserID: uuid.New(), Amount: 10, IdempotencyKey: uuid.New(), Status: domain.OrderPaymentUnknown, CreatedAt: fake.Now(), UpdatedAt: fake.Now(), Currency: "USD"}
+	if err := orders.CreateOrder(ctx, unknown); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(time.Second)
+
+	m := metrics.New()
+	m.RegisterPendingOrders(orders, fake, time.Minute)
+	m.RegisterPool(func() database.PoolStats {
+		return database.PoolStats{MaxConns: 25, AcquiredConns: 4, IdleConns: 2, WaitCount: 7}
+	})
+
+	requireLines(t, scrape(t, m),
+		`phantom_orders_pending{status="PENDING"} 1`,
+		`phantom_orders_pending{status="PAYMENT_UNKNOWN"} 1`,
+		`phantom_orders_pending_oldest_age_seconds 91`,
+		`phantom_reconciliation_lag_seconds 31`,
+		`phantom_db_pool_max_conns 25`,
+		`phantom_db_pool_conns{state="in_use"} 4`,
+		`phantom_db_pool_acquire_waits_total 7`,
+	)
+}
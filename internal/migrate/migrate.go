@@ -0,0 +1,311 @@
+// Package migrate applies numbered SQL migrations to Postgres and records
+// them in schema_migrations. Each migration runs in its own transaction
+// together with its bookkeeping row, so a failed one leaves nothing
+// half-applied. A session advisory lock keeps replicas that start at the
+// same time from racing each other.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"the-phantom-charge/db/migrations"
+	"time"
+)
+
+var (
+	// ErrChecksumMismatch means a migration was edited after it was
+	// applied.
+	ErrChecksumMismatch = errors.New("migrate: applied migration has changed")
+	// ErrUnknownVersion means the database has a migration applied that
+	// this build does not know, so it cannot be rolled back from here.
+	ErrUnknownVersion = errors.New("migrate: unknown applied migration")
+)
+
+// lockKey is the pg_advisory_lock key every migrator takes.
+const lockKey int64 = 0x70_68_61_6e_74_6f_6d // "phantom"
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum identifies the migration's up script.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in the root of fsys, in version order. Every
+// version needs both an up and a down script.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migrate: %s: want NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: %s: %w", entry.Name(), err)
+		}
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrate: version %d is both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	list := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrate: %s needs both an up and a down script", m)
+		}
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func New(db *sql.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// NewEmbedded returns a migrator for the migrations built into the binary
+// from db/migrations.
+func NewEmbedded(db *sql.DB) (*Migrator, error) {
+	list, err := Load(migrations.FS)
+	if err != nil {
+		return nil, err
+	}
+	return New(db, list), nil
+}
+
+// Status is a migration and whether the database has it.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	// Modified is true when the applied script differs from this build's.
+	Modified bool
+}
+
+type applied struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// Up applies every pending migration in version order and returns the
+// ones it applied. Versions the database has and this build doesn't are
+// left alone: a newer replica may have applied them.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn, have map[int64]applied) error {
+		for _, mig := range m.migrations {
+			if _, ok := have[mig.Version]; ok {
+				continue
+			}
+			if err := run(ctx, conn, mig, mig.Up, true); err != nil {
+				return err
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down rolls back the latest steps applied migrations, newest first, and
+// returns the ones it rolled back.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	known := make(map[int64]Migration, len(m.migrations))
+	for _, mig := range m.migrations {
+		known[mig.Version] = mig
+	}
+
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn, have map[int64]applied) error {
+		versions := make([]int64, 0, len(have))
+		for version := range have {
+			versions = append(versions, version)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+		for _, version := range versions {
+			if len(done) == steps {
+				break
+			}
+			mig, ok := known[version]
+			if !ok {
+				return fmt.Errorf("%w: version %d", ErrUnknownVersion, version)
+			}
+			if err := run(ctx, conn, mig, mig.Down, false); err != nil {
+				return err
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists this build's migrations and whether each is applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	// read-only: before the first Up there is no table, and nothing applied
+	var exists bool
+	if err := m.db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	have := make(map[int64]applied)
+	if exists {
+		var err error
+		if have, err = load(ctx, m.db); err != nil {
+			return nil, err
+		}
+	}
+	list := make([]Status, len(m.migrations))
+	for i, mig := range m.migrations {
+		list[i] = Status{Migration: mig}
+		if a, ok := have[mig.Version]; ok {
+			list[i].Applied = true
+			list[i].AppliedAt = a.appliedAt
+			list[i].Modified = a.checksum != mig.Checksum()
+		}
+	}
+	return list, nil
+}
+
+// locked runs fn on one connection holding the advisory lock, after
+// checking that no applied migration has changed since.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, have map[int64]applied) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// session-level: it spans the per-migration transactions, and is
+	// released with the session if this process dies
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return fmt.Errorf("migrate: lock: %w", err)
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	if err := ensureTable(ctx, conn); err != nil {
+		return err
+	}
+	have, err := load(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, mig := range m.migrations {
+		if a, ok := have[mig.Version]; ok && a.checksum != mig.Checksum() {
+			return fmt.Errorf("%w: %s", ErrChecksumMismatch, mig)
+		}
+	}
+	return fn(conn, have)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func ensureTable(ctx context.Context, db execer) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	return err
+}
+
+func load(ctx context.Context, db execer) (map[int64]applied, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	have := make(map[int64]applied)
+	for rows.Next() {
+		var version int64
+		var a applied
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		have[version] = a
+	}
+	return have, rows.Err()
+}
+
+// run executes script and records the migration as applied or rolled
+// back, in one transaction.
+func run(ctx context.Context, conn *sql.Conn, mig Migration, script string, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	direction := "down"
+	if up {
+		direction = "up"
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migrate: %s %s: %w", mig, direction, err)
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)", mig.Version, mig.Name, mig.Checksum())
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", mig.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
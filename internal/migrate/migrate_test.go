@@ -0,0 +1,189 @@
+package migrate_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"the-phantom-charge/db/migrations"
+	"the-phantom-charge/internal/database/dbtest"
+	"the-phantom-charge/internal/migrate"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_second.up.sql":   {Data: []byte("CREATE TABLE b (id INT);")},
+		"0002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"0001_first.up.sql":    {Data: []byte("CREATE TABLE a (id INT);")},
+		"0001_first.down.sql":  {Data: []byte("DROP TABLE a;")},
+		"README.md":            {Data: []byte("not a migration")},
+	}
+	list, err := migrate.Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].String() != "0001_first" || list[1].String() != "0002_second" {
+		t.Fatalf("loaded %v, want 0001_first and 0002_second", list)
+	}
+	if list[1].Down != "DROP TABLE b;" {
+		t.Fatalf("down = %q", list[1].Down)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing down": {
+			"0001_first.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"bad name": {
+			"first.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"two names": {
+			"0001_first.up.sql":   {Data: []byte("SELECT 1;")},
+			"0001_other.down.sql": {Data: []byte("SELECT 1;")},
+		},
+	}
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if list, err := migrate.Load(fsys); err == nil {
+				t.Fatalf("loaded %v, want an error", list)
+			}
+		})
+	}
+}
+
+// TestEmbedded checks the migrations shipped in db/migrations load.
+func TestEmbedded(t *testing.T) {
+	list, err := migrate.Load(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range list {
+		if m.Version != int64(i+1) {
+			t.Fatalf("migration %d is %s: versions must count up from 1 without gaps", i, m)
+		}
+	}
+}
+
+var testMigrations = []migrate.Migration{
+	{Version: 1, Name: "first", Up: "CREATE TABLE a (id INT);", Down: "DROP TABLE a;"},
+	{Version: 2, Name: "second", Up: "CREATE TABLE b (id INT);", Down: "DROP TABLE b;"},
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.Open(t)
+	m := migrate.New(db, testMigrations)
+
+	done, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 {
+		t.Fatalf("applied %v, want both", done)
+	}
+	if done, err := m.Up(ctx); err != nil || len(done) != 0 {
+		t.Fatalf("second up applied %v, %v; want nothing", done, err)
+	}
+	if _, err := db.Exec("INSERT INTO b VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err = m.Down(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || done[0].Version != 2 {
+		t.Fatalf("rolled back %v, want 0002_second", done)
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status[0].Applied || status[1].Applied {
+		t.Fatalf("status = %+v, want only 0001 applied", status)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.Open(t)
+	if _, err := migrate.New(db, testMigrations).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := append([]migrate.Migration(nil), testMigrations...)
+	edited[0].Up = "CREATE TABLE a (id BIGINT);"
+	m := migrate.New(db, edited)
+	if _, err := m.Up(ctx); !errors.Is(err, migrate.ErrChecksumMismatch) {
+		t.Fatalf("err = %v, want %v", err, migrate.ErrChecksumMismatch)
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status[0].Modified || status[1].Modified {
+		t.Fatalf("status = %+v, want 0001 modified", status)
+	}
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.Open(t)
+	broken := append([]migrate.Migration(nil), testMigrations...)
+	broken[1].Up = "CREATE TABLE b (id INT); SELECT no_such_column FROM b;"
+	m := migrate.New(db, broken)
+	if _, err := m.Up(ctx); err == nil {
+		t.Fatal("broken migration applied")
+	}
+
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status[0].Applied || status[1].Applied {
+		t.Fatalf("status = %+v, want only 0001 applied", status)
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('b') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("table from the failed migration exists")
+	}
+}
+
+// TestConcurrentUp starts several replicas at once: each migration is
+// applied exactly once.
+func TestConcurrentUp(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.Open(t)
+
+	var wg sync.WaitGroup
+	applied := make(chan int, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done, err := migrate.New(db, testMigrations).Up(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+			applied <- len(done)
+		}()
+	}
+	wg.Wait()
+	close(applied)
+
+	total := 0
+	for n := range applied {
+		total += n
+	}
+	if total != len(testMigrations) {
+		t.Fatalf("applied %d migrations in total, want %d", total, len(testMigrations))
+	}
+}
@@ -0,0 +1,63 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Writes the schema refuses. Every backend returns these, wrapped, so
+// callers can tell them apart with errors.Is.
+var (
+	// ErrDuplicateKey: the row's ID or the order's idempotency key is
+	// taken.
+	ErrDuplicateKey = errors.New("repo: duplicate key")
+	// ErrDuplicatePayment: the order already has a PROCESSING or
+	// SUCCEEDED payment.
+	ErrDuplicatePayment = errors.New("repo: order already has an active payment")
+	// ErrDuplicateGatewayTxn: the provider's transaction is already
+	// recorded against another payment.
+	ErrDuplicateGatewayTxn = errors.New("repo: gateway transaction already recorded")
+	// ErrUnknownOrder: the payment's order does not exist.
+	ErrUnknownOrder = errors.New("repo: payment for an unknown order")
+	// ErrInvalidValue: a status outside the allowed set, or an amount that
+	// isn't positive.
+	ErrInvalidValue = errors.New("repo: invalid value")
+)
+
+// Postgres error codes for constraint violations.
+const (
+	pgUniqueViolation     = "23505"
+	pgForeignKeyViolation = "23503"
+	pgCheckViolation      = "23514"
+)
+
+// constraintError maps a Postgres constraint violation to the matching
+// error above, keeping the original in the chain. Other errors pass
+// through.
+func constraintError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	var kind error
+	switch pgErr.Code {
+	case pgUniqueViolation:
+		switch pgErr.ConstraintName {
+		case "payments_one_active_per_order":
+			kind = ErrDuplicatePayment
+		case "payments_provider_txn_key":
+			kind = ErrDuplicateGatewayTxn
+		default:
+			kind = ErrDuplicateKey
+		}
+	case pgForeignKeyViolation:
+		kind = ErrUnknownOrder
+	case pgCheckViolation:
+		kind = ErrInvalidValue
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
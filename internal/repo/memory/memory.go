@@ -0,0 +1,605 @@
+// Package memory keeps orders and payments in process, for tests and
+// simulations that should not need Postgres. A transaction's writes stay
+// private until it commits, and rows it locks or updates stay locked until
+// it ends, the way they would under READ COMMITTED. Writes are checked
+// against the same constraints as the Postgres schema and fail with the
+// same repo errors.
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/repo"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type orderRow struct {
+	order domain.Order
+	seq   uint64
+}
+
+type paymentRow struct {
+	payment domain.Payment
+	seq     uint64
+}
+
+// Store is an in-memory database. Its zero value is not usable; use
+// NewStore.
+type Store struct {
+	clock clock.Clock
+
+	mu       sync.Mutex
+	orders   map[uuid.UUID]orderRow
+	payments map[uuid.UUID]paymentRow
+	// row locks, by row ID or unique key, held until the owning
+	// transaction ends
+	locks map[uuid.UUID]*tx
+	// closed and replaced whenever a lock is released
+	released chan struct{}
+	seq      uint64
+}
+
+// NewStore returns an empty store. clk stamps payment updates the way
+// now() does in Postgres; nil is the wall clock.
+func NewStore(clk clock.Clock) *Store {
+	if clk == nil {
+		clk = clock.Real
+	}
+	return &Store{
+		clock:    clk,
+		orders:   make(map[uuid.UUID]orderRow),
+		payments: make(map[uuid.UUID]paymentRow),
+		locks:    make(map[uuid.UUID]*tx),
+		released: make(chan struct{}),
+	}
+}
+
+func (s *Store) nextSeq() uint64 {
+	s.seq++
+	return s.seq
+}
+
+type tx struct {
+	store *Store
+	done  bool
+
+	orders   map[uuid.UUID]orderRow
+	payments map[uuid.UUID]paymentRow
+	locked   []uuid.UUID
+}
+
+func (s *Store) newTx() *tx {
+	return &tx{
+		store:    s,
+		orders:   make(map[uuid.UUID]orderRow),
+		payments: make(map[uuid.UUID]paymentRow),
+	}
+}
+
+// BeginTx makes the store a repo.Transactor, for repo.NewTxManager.
+func (s *Store) BeginTx(ctx context.Context) (repo.Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.newTx(), nil
+}
+
+func (t *tx) Commit() error {
+	s := t.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.apply()
+	t.end()
+	return nil
+}
+
+func (t *tx) Rollback() error {
+	s := t.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.end()
+	return nil
+}
+
+// apply publishes t's writes. The caller holds the store's mutex.
+func (t *tx) apply() {
+	s := t.store
+	for id, row := range t.orders {
+		s.orders[id] = row
+	}
+	for id, row := range t.payments {
+		s.payments[id] = row
+	}
+}
+
+// end releases t's locks. The caller holds the store's mutex.
+func (t *tx) end() {
+	s := t.store
+	t.done = true
+	for _, id := range t.locked {
+		delete(s.locks, id)
+	}
+	if len(t.locked) > 0 {
+		close(s.released)
+		s.released = make(chan struct{})
+	}
+	t.locked = nil
+}
+
+// txFrom returns the transaction ctx carries, nil outside one. The caller
+// holds the store's mutex.
+func (s *Store) txFrom(ctx context.Context) (*tx, error) {
+	rtx := repo.TxFromContext(ctx)
+	if rtx == nil {
+		return nil, nil
+	}
+	t, ok := rtx.(*tx)
+	if !ok || t.store != s {
+		return nil, errors.New("memory: transaction from another store")
+	}
+	if t.done {
+		return nil, sql.ErrTxDone
+	}
+	return t, nil
+}
+
+// read runs fn with the store's mutex held. t is the transaction ctx
+// carries, nil outside one.
+func (s *Store) read(ctx context.Context, fn func(t *tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.txFrom(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(t)
+}
+
+// write runs fn with the store's mutex held, in the transaction ctx
+// carries. Outside one, fn gets a transaction of its own that commits if
+// fn succeeds, like a statement run outside BEGIN.
+func (s *Store) write(ctx context.Context, fn func(t *tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.txFrom(ctx)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		return fn(t)
+	}
+	t = s.newTx()
+	err = fn(t)
+	if err == nil {
+		t.apply()
+	}
+	t.end()
+	return err
+}
+
+// lock takes the row lock on id for t, waiting for another transaction to
+// release it. The caller holds the store's mutex; lock lets go of it while
+// it waits and holds it again when it returns.
+func (s *Store) lock(ctx context.Context, t *tx, id uuid.UUID) error {
+	for {
+		owner, held := s.locks[id]
+		if !held {
+			s.locks[id] = t
+			t.locked = append(t.locked, id)
+			return nil
+		}
+		if owner == t {
+			return nil
+		}
+		released := s.released
+		s.mu.Unlock()
+		var err error
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-released:
+		}
+		s.mu.Lock()
+		if err != nil {
+			return err
+		}
+		if t.done {
+			return sql.ErrTxDone
+		}
+	}
+}
+
+// order returns the order as t sees it: its own write, else the committed
+// row. t may be nil. The caller holds the store's mutex.
+func (s *Store) order(t *tx, id uuid.UUID) (orderRow, bool) {
+	if t != nil {
+		if row, ok := t.orders[id]; ok {
+			return row, true
+		}
+	}
+	row, ok := s.orders[id]
+	return row, ok
+}
+
+// orderRows returns every order t sees, in insertion order. t may be nil.
+// The caller holds the store's mutex.
+func (s *Store) orderRows(t *tx) []orderRow {
+	rows := make([]orderRow, 0, len(s.orders))
+	for id, row := range s.orders {
+		if t != nil {
+			if own, ok := t.orders[id]; ok {
+				row = own
+			}
+		}
+		rows = append(rows, row)
+	}
+	if t != nil {
+		for id, row := range t.orders {
+			if _, ok := s.orders[id]; !ok {
+				rows = append(rows, row)
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].seq < rows[j].seq })
+	return rows
+}
+
+type orderRepo struct {
+	store *Store
+}
+
+func NewOrderRepo(s *Store) repo.OrderRepo {
+	return &orderRepo{store: s}
+}
+
+func (r *orderRepo) FindById(ctx context.Context, id uuid.UUID) (*domain.Order, error) {
+	var order *domain.Order
+	err := r.store.read(ctx, func(t *tx) error {
+		if row, ok := r.store.order(t, id); ok {
+			order = &row.order
+		}
+		return nil
+	})
+	return order, err
+}
+
+func (r *orderRepo) FindByIdForUpdate(ctx context.Context, id uuid.UUID) (*domain.Order, error) {
+	s := r.store
+	var order *domain.Order
+	err := s.write(ctx, func(t *tx) error {
+		if err := s.lock(ctx, t, id); err != nil {
+			return err
+		}
+		if row, ok := s.order(t, id); ok {
+			order = &row.order
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// update applies fn to the order as the transaction in ctx sees it,
+// locking the row first.
+func (r *orderRepo) update(ctx context.Context, id uuid.UUID, fn func(*domain.Order)) error {
+	s := r.store
+	return s.write(ctx, func(t *tx) error {
+		if err := s.lock(ctx, t, id); err != nil {
+			return err
+		}
+		row, ok := s.order(t, id)
+		if !ok {
+			return nil // UPDATE matched no rows
+		}
+		fn(&row.order)
+		t.orders[id] = row
+		return nil
+	})
+}
+
+func (r *orderRepo) UpdateOrderStatus(ctx context.Context, order *domain.Order) error {
+	if !order.Status.Valid() {
+		return repo.ErrInvalidValue
+	}
+	return r.update(ctx, order.ID, func(o *domain.Order) {
+		o.Status = order.Status
+		o.UpdatedAt = order.UpdatedAt
+	})
+}
+
+func (r *orderRepo) UpdateOrderProvider(ctx context.Context, order *domain.Order) error {
+	return r.update(ctx, order.ID, func(o *domain.Order) {
+		o.Provider = order.Provider
+		o.UpdatedAt = order.UpdatedAt
+	})
+}
+
+func (r *orderRepo) CreateOrder(ctx context.Context, order *domain.Order) error {
+	if !order.Status.Valid() || order.Amount <= 0 {
+		return repo.ErrInvalidValue
+	}
+	s := r.store
+	return s.write(ctx, func(t *tx) error {
+		// a concurrent insert of the same keys waits for this one to end,
+		// as on a unique index
+		if err := s.lock(ctx, t, order.ID); err != nil {
+			return err
+		}
+		if err := s.lock(ctx, t, order.IdempotencyKey); err != nil {
+			return err
+		}
+		for _, row := range s.orderRows(t) {
+			if row.order.ID == order.ID || row.order.IdempotencyKey == order.IdempotencyKey {
+				return repo.ErrDuplicateKey
+			}
+		}
+		t.orders[order.ID] = orderRow{order: *order, seq: s.nextSeq()}
+		return nil
+	})
+}
+
+func (r *orderRepo) FindStuckOrders(ctx context.Context, updatedBefore time.Time) ([]domain.Order, error) {
+	var orders []domain.Order
+	err := r.store.read(ctx, func(t *tx) error {
+		for _, row := range r.store.orderRows(t) {
+			stuck := row.order.Status == domain.OrderPending || row.order.Status == domain.OrderPaymentUnknown
+			if stuck && row.order.UpdatedAt.Before(updatedBefore) {
+				orders = append(orders, row.order)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (r *orderRepo) SummarizePending(ctx context.Context) (repo.PendingSummary, error) {
+	summary := repo.PendingSummary{Counts: map[domain.OrderStatus]int{domain.OrderPending: 0, domain.OrderPaymentUnknown: 0}}
+	err := r.store.read(ctx, func(t *tx) error {
+		for _, row := range r.store.orderRows(t) {
+			if row.order.Status != domain.OrderPending && row.order.Status != domain.OrderPaymentUnknown {
+				continue
+			}
+			summary.Counts[row.order.Status]++
+			if summary.OldestUpdate.IsZero() || row.order.UpdatedAt.Before(summary.OldestUpdate) {
+				summary.OldestUpdate = row.order.UpdatedAt
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return repo.PendingSummary{}, err
+	}
+	return summary, nil
+}
+
+type paymentRepo struct {
+	store *Store
+}
+
+func NewPaymentRepo(s *Store) repo.PaymentRepo {
+	return &paymentRepo{store: s}
+}
+
+func (r *paymentRepo) CreatePayment(ctx context.Context, payment *domain.Payment) error {
+	if !payment.Status.Valid() || payment.Amount <= 0 {
+		return repo.ErrInvalidValue
+	}
+	s := r.store
+	return s.write(ctx, func(t *tx) error {
+		if err := s.lock(ctx, t, payment.ID); err != nil {
+			return err
+		}
+		if _, ok := s.payment(t, payment.ID); ok {
+			return repo.ErrDuplicateKey
+		}
+		if _, ok := s.order(t, payment.OrderID); !ok {
+			return repo.ErrUnknownOrder
+		}
+		if err := s.checkUnique(ctx, t, *payment); err != nil {
+			return err
+		}
+		t.payments[payment.ID] = paymentRow{payment: *payment, seq: s.nextSeq()}
+		return nil
+	})
+}
+
+// checkUnique enforces the payments' unique indexes for p as written by t:
+// one active payment per order, and each provider transaction recorded
+// once. Like an index, it waits for a concurrent write of the same key to
+// end. The caller holds the store's mutex.
+func (s *Store) checkUnique(ctx context.Context, t *tx, p domain.Payment) error {
+	if p.Status.Active() {
+		if err := s.lock(ctx, t, uuid.NewSHA1(p.OrderID, []byte("active payment"))); err != nil {
+			return err
+		}
+		others := s.ordered(t, func(other domain.Payment) bool {
+			return other.ID != p.ID && other.OrderID == p.OrderID && other.Status.Active()
+		})
+		if len(others) > 0 {
+			return repo.ErrDuplicatePayment
+		}
+	}
+	if p.FastPayTxn != uuid.Nil {
+		if err := s.lock(ctx, t, uuid.NewSHA1(p.FastPayTxn, []byte("provider txn "+p.Provider))); err != nil {
+			return err
+		}
+		others := s.ordered(t, func(other domain.Payment) bool {
+			return other.ID != p.ID && other.Provider == p.Provider && other.FastPayTxn == p.FastPayTxn
+		})
+		if len(others) > 0 {
+			return repo.ErrDuplicateGatewayTxn
+		}
+	}
+	return nil
+}
+
+// payment returns the payment as t sees it. t may be nil. The caller holds
+// the store's mutex.
+func (s *Store) payment(t *tx, id uuid.UUID) (paymentRow, bool) {
+	if t != nil {
+		if row, ok := t.payments[id]; ok {
+			return row, true
+		}
+	}
+	row, ok := s.payments[id]
+	return row, ok
+}
+
+func (r *paymentRepo) FindById(ctx context.Context, id uuid.UUID) (*domain.Payment, error) {
+	var p *domain.Payment
+	err := r.store.read(ctx, func(t *tx) error {
+		row, ok := r.store.payment(t, id)
+		if !ok {
+			return sql.ErrNoRows
+		}
+		p = &row.payment
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ordered lists the payments t sees that match, oldest first. Payments
+// created at the same instant keep their insertion order. t may be nil.
+// The caller holds the store's mutex.
+func (s *Store) ordered(t *tx, match func(domain.Payment) bool) []domain.Payment {
+	var rows []paymentRow
+	for id, row := range s.payments {
+		if t != nil {
+			if own, ok := t.payments[id]; ok {
+				row = own
+			}
+		}
+		if match(row.payment) {
+			rows = append(rows, row)
+		}
+	}
+	if t != nil {
+		for id, row := range t.payments {
+			if _, ok := s.payments[id]; !ok && match(row.payment) {
+				rows = append(rows, row)
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if !a.payment.CreatedAt.Equal(b.payment.CreatedAt) {
+			return a.payment.CreatedAt.Before(b.payment.CreatedAt)
+		}
+		return a.seq < b.seq
+	})
+	payments := make([]domain.Payment, len(rows))
+	for i, row := range rows {
+		payments[i] = row.payment
+	}
+	return payments
+}
+
+func (r *paymentRepo) FindByOrderId(ctx context.Context, orderId uuid.UUID) (*domain.Payment, error) {
+	var latest *domain.Payment
+	err := r.store.read(ctx, func(t *tx) error {
+		payments := r.store.ordered(t, func(p domain.Payment) bool { return p.OrderID == orderId })
+		if len(payments) > 0 {
+			latest = &payments[len(payments)-1]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return latest, nil
+}
+
+func (r *paymentRepo) ListByOrderId(ctx context.Context, orderId uuid.UUID) ([]domain.Payment, error) {
+	var payments []domain.Payment
+	err := r.store.read(ctx, func(t *tx) error {
+		payments = r.store.ordered(t, func(p domain.Payment) bool { return p.OrderID == orderId })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+func (r *paymentRepo) UpdatePaymentStatus(ctx context.Context, id uuid.UUID, status domain.PaymentStatus, fastPayTxn uuid.UUID) error {
+	if !status.Valid() {
+		return repo.ErrInvalidValue
+	}
+	s := r.store
+	return s.write(ctx, func(t *tx) error {
+		if err := s.lock(ctx, t, id); err != nil {
+			return err
+		}
+		row, ok := s.payment(t, id)
+		if !ok {
+			return nil // UPDATE matched no rows
+		}
+		row.payment.Status = status
+		if fastPayTxn != uuid.Nil {
+			row.payment.FastPayTxn = fastPayTxn
+		}
+		if err := s.checkUnique(ctx, t, row.payment); err != nil {
+			return err
+		}
+		row.payment.UpdatedAt = s.clock.Now()
+		t.payments[id] = row
+		return nil
+	})
+}
+
+func (r *paymentRepo) FindProcessingBefore(ctx context.Context, before time.Time, limit int) ([]domain.Payment, error) {
+	var payments []domain.Payment
+	err := r.store.read(ctx, func(t *tx) error {
+		payments = r.store.ordered(t, func(p domain.Payment) bool {
+			return p.Status == domain.PaymentProcessing && p.CreatedAt.Before(before)
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(payments) > limit {
+		payments = payments[:limit]
+	}
+	return payments, nil
+}
+
+// Orders returns every committed order, in insertion order.
+func (s *Store) Orders() []domain.Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := s.orderRows(nil)
+	orders := make([]domain.Order, len(rows))
+	for i, row := range rows {
+		orders[i] = row.order
+	}
+	return orders
+}
+
+// Payments returns every committed payment, oldest first.
+func (s *Store) Payments() []domain.Payment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ordered(nil, func(domain.Payment) bool { return true })
+}
@@ -0,0 +1,15 @@
+package memory_test
+
+import (
+	"testing"
+	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/repo/memory"
+	"the-phantom-charge/internal/repo/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repotest.Backend {
+		s := memory.NewStore(nil)
+		return repotest.Backend{Tx: repo.NewTxManager(s), Orders: memory.NewOrderRepo(s), Payments: memory.NewPaymentRepo(s)}
+	})
+}
@@ -11,9 +11,24 @@ import (
 
 type OrderRepo interface {
 	FindById(ctx context.Context, id uuid.UUID) (*domain.Order, error)
-	UpdateOrderStatus(ctx context.Context, tx *sql.Tx, order *domain.Order) error
-	CreateOrder(ctx context.Context, tx *sql.Tx, order *domain.Order) error
-	FindStuckOrders(ctx context.Context, olderThan time.Duration) ([]domain.Order, error)
+	// lock the order row until the transaction in ctx ends, so concurrent
+	// checkouts settle it once
+	FindByIdForUpdate(ctx context.Context, id uuid.UUID) (*domain.Order, error)
+	UpdateOrderStatus(ctx context.Context, order *domain.Order) error
+	CreateOrder(ctx context.Context, order *domain.Order) error
+	// record the provider before charging so a crash can't lose it
+	UpdateOrderProvider(ctx context.Context, order *domain.Order) error
+	FindStuckOrders(ctx context.Context, updatedBefore time.Time) ([]domain.Order, error)
+	// summarize the unsettled orders without loading them, for metrics
+	SummarizePending(ctx context.Context) (PendingSummary, error)
+}
+
+// PendingSummary describes the orders PENDING or PAYMENT_UNKNOWN.
+type PendingSummary struct {
+	Counts map[domain.OrderStatus]int
+	// OldestUpdate is when the least recently updated of them was last
+	// touched; zero when there is none.
+	OldestUpdate time.Time
 }
 
 type orderRepo struct {
@@ -25,48 +40,59 @@ func NewOrderRepo(db *sql.DB) OrderRepo {
 }
 
 func (r *orderRepo) FindById(ctx context.Context, id uuid.UUID) (*domain.Order, error) {
-	var order domain.Order
-	err := r.db.QueryRowContext(ctx, "SELECT * FROM orders WHERE id = $1", id).Scan(
-		&order.ID,
-		&order.UserID,
-		&order.Amount,
-		&order.IdempotencyKey,
-		&order.Status,
-		&order.CreatedAt,
-		&order.UpdatedAt,
-	)
+	row := conn(ctx, r.db).QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = $1", id)
+	order, err := scanOrder(row)
 	if err == sql.ErrNoRows {
 		return nil, nil // not found
 	}
 	if err != nil {
 		return nil, err // system error
 	}
-	return &order, nil
+	return order, nil
+}
+
+func (r *orderRepo) FindByIdForUpdate(ctx context.Context, id uuid.UUID) (*domain.Order, error) {
+	row := conn(ctx, r.db).QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = $1 FOR UPDATE", id)
+	order, err := scanOrder(row)
+	if err == sql.ErrNoRows {
+		return nil, nil // not found
+	}
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
 }
 
-func (r *orderRepo) UpdateOrderStatus(ctx context.Context, tx *sql.Tx, order *domain.Order) error {
-	_, err := tx.ExecContext(ctx, "UPDATE orders SET status = $1, updated_at = $2 WHERE id = $3", order.Status, order.UpdatedAt, order.ID)
+func (r *orderRepo) UpdateOrderStatus(ctx context.Context, order *domain.Order) error {
+	_, err := conn(ctx, r.db).ExecContext(ctx, "UPDATE orders SET status = $1, updated_at = $2 WHERE id = $3", order.Status, order.UpdatedAt, order.ID)
 	if err != nil {
-		return err
+		return constraintError(err)
 	}
 	return nil
 }
 
-func (or *orderRepo) CreateOrder(ctx context.Context, tx *sql.Tx, order *domain.Order) error {
-	_, err := tx.ExecContext(ctx, "INSERT INTO orders (id, user_id, amount, status, idempotency_key, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)", order.ID, order.UserID, order.Amount, order.Status, order.IdempotencyKey, order.CreatedAt, order.UpdatedAt)
+func (r *orderRepo) UpdateOrderProvider(ctx context.Context, order *domain.Order) error {
+	_, err := conn(ctx, r.db).ExecContext(ctx, "UPDATE orders SET payment_provider = $1, updated_at = $2 WHERE id = $3", order.Provider, order.UpdatedAt, order.ID)
 	if err != nil {
-		return err
+		return constraintError(err)
 	}
 	return nil
 }
 
+func (or *orderRepo) CreateOrder(ctx context.Context, order *domain.Order) error {
+	_, err := conn(ctx, or.db).ExecContext(ctx, "INSERT INTO orders ("+orderColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)", orderValues(order)...)
+	if err != nil {
+		return constraintError(err)
+	}
+	return nil
+}
 
-func (or *orderRepo) FindStuckOrders(ctx context.Context, olderThan time.Duration) ([]domain.Order, error) {
+func (or *orderRepo) FindStuckOrders(ctx context.Context, updatedBefore time.Time) ([]domain.Order, error) {
 	var orders []domain.Order
 
-	rows, err := or.db.QueryContext(ctx,
-		"SELECT * FROM orders WHERE status = 'PENDING' AND updated_at < $1",
-		time.Now().Add(-olderThan),
+	rows, err := conn(ctx, or.db).QueryContext(ctx,
+		"SELECT "+orderColumns+" FROM orders WHERE status IN ($1, $2) AND updated_at < $3",
+		domain.OrderPending, domain.OrderPaymentUnknown, updatedBefore,
 	)
 	if err != nil {
 		return nil, err
@@ -74,19 +100,38 @@ func (or *orderRepo) FindStuckOrders(ctx context.Context, olderThan time.Duratio
 	defer rows.Close()
 
 	for rows.Next() {
-		var order domain.Order
-		if err := rows.Scan(
-			&order.ID,
-			&order.UserID,
-			&order.Amount,
-			&order.IdempotencyKey,
-			&order.Status,
-			&order.CreatedAt,
-			&order.UpdatedAt,
-		); err != nil {
+		order, err := scanOrder(rows)
+		if err != nil {
 			return nil, err
 		}
-		orders = append(orders, order)
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+func (or *orderRepo) SummarizePending(ctx context.Context) (PendingSummary, error) {
+	summary := PendingSummary{Counts: map[domain.OrderStatus]int{domain.OrderPending: 0, domain.OrderPaymentUnknown: 0}}
+
+	rows, err := conn(ctx, or.db).QueryContext(ctx,
+		"SELECT status, COUNT(*), MIN(updated_at) FROM orders WHERE status IN ($1, $2) GROUP BY status",
+		domain.OrderPending, domain.OrderPaymentUnknown,
+	)
+	if err != nil {
+		return PendingSummary{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status domain.OrderStatus
+		var count int
+		var oldest time.Time
+		if err := rows.Scan(&status, &count, &oldest); err != nil {
+			return PendingSummary{}, err
+		}
+		summary.Counts[status] = count
+		if summary.OldestUpdate.IsZero() || oldest.Before(summary.OldestUpdate) {
+			summary.OldestUpdate = oldest
+		}
 	}
-	return orders, nil
-}
\ No newline at end of file
+	return summary, rows.Err()
+}
@@ -8,13 +8,19 @@ import (
 
 	"github.com/google/uuid"
 )
+
 type PaymentRepo interface {
-	// tx *sql.Tx -> kiểm soát transaction
-	CreatePayment(ctx context.Context, tx *sql.Tx, payment *domain.Payment) error
-  // id uuid.UUID -> tìm kiếm theo id
+	// writes join the transaction in ctx, if any
+	CreatePayment(ctx context.Context, payment *domain.Payment) error
+	// id uuid.UUID -> tìm kiếm theo id
 	FindById(ctx context.Context, id uuid.UUID) (*domain.Payment, error)
-	// update order status when charge success
-	UpdatePaymentStatus(ctx context.Context, tx *sql.Tx, orderId uuid.UUID, status domain.PaymentStatus, fastPayTxn uuid.UUID) error
+	// latest payment of an order, nil if the order has none
+	FindByOrderId(ctx context.Context, orderId uuid.UUID) (*domain.Payment, error)
+	// every payment of an order, oldest first
+	ListByOrderId(ctx context.Context, orderId uuid.UUID) ([]domain.Payment, error)
+	// update order status when charge success; a nil fastPayTxn keeps
+	// the one already recorded
+	UpdatePaymentStatus(ctx context.Context, orderId uuid.UUID, status domain.PaymentStatus, fastPayTxn uuid.UUID) error
 	FindProcessingBefore(
 		ctx context.Context,
 		before time.Time,
@@ -30,39 +36,60 @@ func NewPaymentRepo(db *sql.DB) PaymentRepo {
 	return &paymentRepo{db: db}
 }
 
-func (r *paymentRepo) CreatePayment(ctx context.Context, tx *sql.Tx, payment *domain.Payment) error {
-	query := `INSERT INTO payments (id, order_id, amount, fastpay_txn_id, status, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+func (r *paymentRepo) CreatePayment(ctx context.Context, payment *domain.Payment) error {
+	query := `INSERT INTO payments (` + paymentColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
 
-	_, err := tx.ExecContext(
-		ctx, query, payment.ID, payment.OrderID, payment.Amount, payment.FastPayTxn, payment.Status, payment.CreatedAt, payment.UpdatedAt,
-	)
+	_, err := conn(ctx, r.db).ExecContext(ctx, query, paymentValues(payment)...)
 
 	if err != nil {
-		return err
+		return constraintError(err)
 	}
 	return nil
 }
 
-func (r *paymentRepo) FindById(ctx context.Context, id uuid.UUID) (*domain.Payment, error)  {
-	query := `SELECT * FROM payments WHERE id = $1`
-	row := r.db.QueryRowContext(ctx, query, id)
-	var p domain.Payment
-	err := row.Scan(
-		&p.ID,
-		&p.OrderID,
-		&p.Amount,
-		&p.FastPayTxn,
-		&p.Status,
-		&p.CreatedAt,
-		&p.UpdatedAt,
-	)
+func (r *paymentRepo) FindById(ctx context.Context, id uuid.UUID) (*domain.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE id = $1`
+	row := conn(ctx, r.db).QueryRowContext(ctx, query, id)
+	p, err := scanPayment(row)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (r *paymentRepo) FindByOrderId(ctx context.Context, orderId uuid.UUID) (*domain.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE order_id = $1 ORDER BY created_at DESC LIMIT 1`
+	row := conn(ctx, r.db).QueryRowContext(ctx, query, orderId)
+	p, err := scanPayment(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &p, nil
+	return p, nil
 }
 
-func (r *paymentRepo) UpdatePaymentStatus(ctx context.Context, tx *sql.Tx, orderId uuid.UUID, status domain.PaymentStatus, fastPayTxn uuid.UUID) error {
+func (r *paymentRepo) ListByOrderId(ctx context.Context, orderId uuid.UUID) ([]domain.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE order_id = $1 ORDER BY created_at`
+	rows, err := conn(ctx, r.db).QueryContext(ctx, query, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []domain.Payment
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, *p)
+	}
+	return payments, rows.Err()
+}
+
+func (r *paymentRepo) UpdatePaymentStatus(ctx context.Context, orderId uuid.UUID, status domain.PaymentStatus, fastPayTxn uuid.UUID) error {
 	query := `
 		UPDATE payments
 		SET status = $2,
@@ -70,27 +97,27 @@ func (r *paymentRepo) UpdatePaymentStatus(ctx context.Context, tx *sql.Tx, order
 		    updated_at = now()
 		WHERE id = $1
 	`
-	_, err := tx.ExecContext(
+	_, err := conn(ctx, r.db).ExecContext(
 		ctx,
 		query,
 		orderId,
 		status,
-		fastPayTxn,
+		nullUUID(fastPayTxn),
 	)
 	if err != nil {
-		return err
+		return constraintError(err)
 	}
 	return nil
 }
 
 func (r *paymentRepo) FindProcessingBefore(ctx context.Context, before time.Time, limit int) ([]domain.Payment, error) {
 	query := `
-		SELECT * FROM payments
+		SELECT ` + paymentColumns + ` FROM payments
 		WHERE status = $1
 		AND created_at < $2
 		LIMIT $3
 	`
-	rows, err := r.db.QueryContext(ctx, query, domain.PaymentProcessing, before, limit)
+	rows, err := conn(ctx, r.db).QueryContext(ctx, query, domain.PaymentProcessing, before, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -98,20 +125,11 @@ func (r *paymentRepo) FindProcessingBefore(ctx context.Context, before time.Time
 
 	var payments []domain.Payment
 	for rows.Next() {
-		var p domain.Payment
-		err := rows.Scan(
-			&p.ID,
-			&p.OrderID,
-			&p.Amount,
-			&p.FastPayTxn,
-			&p.Status,
-			&p.CreatedAt,
-			&p.UpdatedAt,
-		)
+		p, err := scanPayment(rows)
 		if err != nil {
 			return nil, err
 		}
-		payments = append(payments, p)
+		payments = append(payments, *p)
 	}
-	return payments, nil
-}
\ No newline at end of file
+	return payments, rows.Err()
+}
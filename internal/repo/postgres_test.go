@@ -0,0 +1,28 @@
+package repo_test
+
+import (
+	"context"
+	"testing"
+	"the-phantom-charge/internal/database/dbtest"
+	"the-phantom-charge/internal/migrate"
+	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/repo/repotest"
+)
+
+func TestPostgresConformance(t *testing.T) {
+	db := dbtest.Open(t)
+	m, err := migrate.NewEmbedded(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	repotest.Run(t, func(t *testing.T) repotest.Backend {
+		if _, err := db.Exec("TRUNCATE payments, orders"); err != nil {
+			t.Fatal(err)
+		}
+		return repotest.Backend{Tx: repo.NewTxManager(repo.NewSQLTransactor(db)), Orders: repo.NewOrderRepo(db), Payments: repo.NewPaymentRepo(db)}
+	})
+}
@@ -0,0 +1,769 @@
+// Package repotest is the conformance suite for OrderRepo and PaymentRepo
+// implementations. Every backend runs the same tests, so the in-memory
+// repos behave like the Postgres ones wherever the service relies on it.
+package repotest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/repo"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Backend is one storage implementation under test.
+type Backend struct {
+	Tx       repo.TxManager
+	Orders   repo.OrderRepo
+	Payments repo.PaymentRepo
+}
+
+// Run runs the suite. open is called once per test and must return an
+// empty backend.
+func Run(t *testing.T, open func(t *testing.T) Backend) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, b Backend)
+	}{
+		{"CreateAndFindOrder", testCreateAndFindOrder},
+		{"FindMissingOrder", testFindMissingOrder},
+		{"DuplicateIdempotencyKey", testDuplicateIdempotencyKey},
+		{"ConcurrentDuplicateKey", testConcurrentDuplicateKey},
+		{"UncommittedInvisible", testUncommittedInvisible},
+		{"Rollback", testRollback},
+		{"NestedTx", testNestedTx},
+		{"StaleTx", testStaleTx},
+		{"UpdateOrder", testUpdateOrder},
+		{"ForUpdateBlocks", testForUpdateBlocks},
+		{"ForUpdateCanceled", testForUpdateCanceled},
+		{"FindStuckOrders", testFindStuckOrders},
+		{"SummarizePending", testSummarizePending},
+		{"Payments", testPayments},
+		{"UpdatePaymentStatus", testUpdatePaymentStatus},
+		{"FindMissingPayment", testFindMissingPayment},
+		{"PaymentWithoutTxn", testPaymentWithoutTxn},
+		{"OneActivePayment", testOneActivePayment},
+		{"ConcurrentActivePayment", testConcurrentActivePayment},
+		{"GatewayTxnUnique", testGatewayTxnUnique},
+		{"PaymentForUnknownOrder", testPaymentForUnknownOrder},
+		{"InvalidValues", testInvalidValues},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open(t))
+		})
+	}
+}
+
+// now is a timestamp every backend stores exactly: Postgres keeps
+// microseconds and no zone.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+func newOrder(status domain.OrderStatus, updatedAt time.Time) *domain.Order {
+	return &domain.Order{
+		ID:             uuid.New(),
+		UserID:         uuid.New(),
+		Amount:         1999,
+		IdempotencyKey: uuid.New(),
+		Status:         status,
+		CreatedAt:      updatedAt,
+		UpdatedAt:      updatedAt,
+		Currency:       domain.DefaultCurrency,
+		Provider:       "fastpay",
+	}
+}
+
+func newPayment(orderId uuid.UUID, createdAt time.Time) *domain.Payment {
+	return &domain.Payment{
+		ID:         uuid.New(),
+		OrderID:    orderId,
+		Amount:     1999,
+		Status:     domain.PaymentSucceeded,
+		FastPayTxn: uuid.New(),
+		CreatedAt:  createdAt,
+		UpdatedAt:  createdAt,
+		Provider:   "fastpay",
+	}
+}
+
+var errRollback = errors.New("repotest: rollback")
+
+// within runs fn in a transaction and commits it.
+func within(t *testing.T, b Backend, fn func(ctx context.Context) error) {
+	t.Helper()
+	if err := b.Tx.WithinTx(context.Background(), fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// begin opens a transaction and holds it open across the test. The
+// context it returns carries the transaction; end finishes it, committing
+// if err is nil and rolling back otherwise, and returns what WithinTx
+// returned. A transaction still open when the test ends is rolled back.
+func begin(t *testing.T, b Backend) (ctx context.Context, end func(err error) error) {
+	t.Helper()
+	txCtx := make(chan context.Context)
+	finish := make(chan error)
+	result := make(chan error, 1)
+	go func() {
+		result <- b.Tx.WithinTx(context.Background(), func(ctx context.Context) error {
+			txCtx <- ctx
+			return <-finish
+		})
+	}()
+	select {
+	case ctx = <-txCtx:
+	case err := <-result:
+		t.Fatalf("begin: %v", err)
+	}
+
+	ended := false
+	end = func(err error) error {
+		ended = true
+		finish <- err
+		return <-result
+	}
+	t.Cleanup(func() {
+		if !ended {
+			end(errRollback)
+		}
+	})
+	return ctx, end
+}
+
+func createOrder(t *testing.T, b Backend, order *domain.Order) {
+	t.Helper()
+	if err := b.Orders.CreateOrder(context.Background(), order); err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+}
+
+func findOrder(t *testing.T, b Backend, id uuid.UUID) *domain.Order {
+	t.Helper()
+	order, err := b.Orders.FindById(context.Background(), id)
+	if err != nil {
+		t.Fatalf("find order: %v", err)
+	}
+	return order
+}
+
+func assertOrder(t *testing.T, got, want *domain.Order) {
+	t.Helper()
+	if got == nil {
+		t.Fatalf("order %s not found", want.ID)
+	}
+	if got.ID != want.ID || got.UserID != want.UserID || got.Amount != want.Amount ||
+		got.IdempotencyKey != want.IdempotencyKey || got.Status != want.Status ||
+		!got.CreatedAt.Equal(want.CreatedAt) || !got.UpdatedAt.Equal(want.UpdatedAt) ||
+		got.Currency != want.Currency || got.Provider != want.Provider {
+		t.Fatalf("order = %+v, want %+v", *got, *want)
+	}
+}
+
+func testCreateAndFindOrder(t *testing.T, b Backend) {
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+	assertOrder(t, findOrder(t, b, order.ID), order)
+}
+
+func testFindMissingOrder(t *testing.T, b Backend) {
+	if order := findOrder(t, b, uuid.New()); order != nil {
+		t.Fatalf("found %+v, want nil", *order)
+	}
+	within(t, b, func(ctx context.Context) error {
+		order, err := b.Orders.FindByIdForUpdate(ctx, uuid.New())
+		if err == nil && order != nil {
+			t.Errorf("found %+v for update, want nil", *order)
+		}
+		return err
+	})
+}
+
+func testDuplicateIdempotencyKey(t *testing.T, b Backend) {
+	first := newOrder(domain.OrderPending, now())
+	createOrder(t, b, first)
+
+	second := newOrder(domain.OrderPending, now())
+	second.IdempotencyKey = first.IdempotencyKey
+	if err := b.Orders.CreateOrder(context.Background(), second); !errors.Is(err, repo.ErrDuplicateKey) {
+		t.Fatalf("second order with the same idempotency key: err = %v, want %v", err, repo.ErrDuplicateKey)
+	}
+}
+
+// testConcurrentDuplicateKey inserts the same idempotency key from two
+// transactions: the second waits for the first and fails once it commits.
+func testConcurrentDuplicateKey(t *testing.T, b Backend) {
+	ctx, end := begin(t, b)
+	first := newOrder(domain.OrderPending, now())
+	if err := b.Orders.CreateOrder(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newOrder(domain.OrderPending, now())
+	second.IdempotencyKey = first.IdempotencyKey
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Tx.WithinTx(context.Background(), func(ctx context.Context) error {
+			return b.Orders.CreateOrder(ctx, second)
+		})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("second insert finished while the first was open: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := end(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("both inserts of the same idempotency key committed")
+	}
+}
+
+func testUncommittedInvisible(t *testing.T, b Backend) {
+	ctx, end := begin(t, b)
+	order := newOrder(domain.OrderPending, now())
+	if err := b.Orders.CreateOrder(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	if got := findOrder(t, b, order.ID); got != nil {
+		t.Fatal("uncommitted order visible outside its transaction")
+	}
+	// but visible inside it
+	got, err := b.Orders.FindById(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, got, order)
+	got, err = b.Orders.FindByIdForUpdate(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, got, order)
+
+	if err := end(nil); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, findOrder(t, b, order.ID), order)
+}
+
+func testRollback(t *testing.T, b Backend) {
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+
+	ctx, end := begin(t, b)
+	changed := *order
+	changed.Status = domain.OrderPaid
+	changed.UpdatedAt = now()
+	if err := b.Orders.UpdateOrderStatus(ctx, &changed); err != nil {
+		t.Fatal(err)
+	}
+	created := newOrder(domain.OrderPending, now())
+	if err := b.Orders.CreateOrder(ctx, created); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Payments.CreatePayment(ctx, newPayment(order.ID, now())); err != nil {
+		t.Fatal(err)
+	}
+	if err := end(errRollback); !errors.Is(err, errRollback) {
+		t.Fatalf("WithinTx = %v, want %v", err, errRollback)
+	}
+
+	assertOrder(t, findOrder(t, b, order.ID), order)
+	if got := findOrder(t, b, created.ID); got != nil {
+		t.Fatal("rolled back order exists")
+	}
+	payments, err := b.Payments.ListByOrderId(context.Background(), order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 0 {
+		t.Fatalf("rolled back payments exist: %+v", payments)
+	}
+}
+
+// testNestedTx joins an inner WithinTx to the outer transaction: rolling
+// back the outer one undoes the inner one's writes too.
+func testNestedTx(t *testing.T, b Backend) {
+	outer := newOrder(domain.OrderPending, now())
+	inner := newOrder(domain.OrderPending, now())
+	err := b.Tx.WithinTx(context.Background(), func(ctx context.Context) error {
+		if err := b.Orders.CreateOrder(ctx, outer); err != nil {
+			return err
+		}
+		err := b.Tx.WithinTx(ctx, func(ctx context.Context) error {
+			got, err := b.Orders.FindById(ctx, outer.ID)
+			if err != nil {
+				return err
+			}
+			if got == nil {
+				t.Error("inner transaction does not see the outer one's write")
+			}
+			return b.Orders.CreateOrder(ctx, inner)
+		})
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("WithinTx = %v, want %v", err, errRollback)
+	}
+	for _, order := range []*domain.Order{outer, inner} {
+		if got := findOrder(t, b, order.ID); got != nil {
+			t.Fatalf("rolled back order %s exists", order.ID)
+		}
+	}
+}
+
+// testStaleTx writes through a context whose transaction has ended.
+func testStaleTx(t *testing.T, b Backend) {
+	ctx, end := begin(t, b)
+	if err := end(nil); err != nil {
+		t.Fatal(err)
+	}
+	order := newOrder(domain.OrderPending, now())
+	if err := b.Orders.CreateOrder(ctx, order); err == nil {
+		t.Error("wrote through a committed transaction")
+	}
+	if got := findOrder(t, b, order.ID); got != nil {
+		t.Error("write through a committed transaction is visible")
+	}
+}
+
+func testUpdateOrder(t *testing.T, b Backend) {
+	order := newOrder(domain.OrderPending, now())
+	order.Provider = ""
+	createOrder(t, b, order)
+
+	want := *order
+	want.Provider = "altpay"
+	want.UpdatedAt = now().Add(time.Second)
+	within(t, b, func(ctx context.Context) error {
+		return b.Orders.UpdateOrderProvider(ctx, &want)
+	})
+	assertOrder(t, findOrder(t, b, order.ID), &want)
+
+	want.Status = domain.OrderPaid
+	want.UpdatedAt = want.UpdatedAt.Add(time.Second)
+	// only the status and updated_at are written, and outside a
+	// transaction the update commits on its own
+	update := want
+	update.Provider = "ignored"
+	if err := b.Orders.UpdateOrderStatus(context.Background(), &update); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, findOrder(t, b, order.ID), &want)
+
+	// an update of a missing order is not an error
+	within(t, b, func(ctx context.Context) error {
+		return b.Orders.UpdateOrderStatus(ctx, newOrder(domain.OrderPaid, now()))
+	})
+}
+
+// testForUpdateBlocks locks an order in one transaction: a second
+// FindByIdForUpdate waits until the first commits, then sees its write.
+func testForUpdateBlocks(t *testing.T, b Backend) {
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+
+	ctx, end := begin(t, b)
+	if _, err := b.Orders.FindByIdForUpdate(ctx, order.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	type found struct {
+		order *domain.Order
+		err   error
+	}
+	done := make(chan found, 1)
+	go func() {
+		var o *domain.Order
+		err := b.Tx.WithinTx(context.Background(), func(ctx context.Context) error {
+			var err error
+			o, err = b.Orders.FindByIdForUpdate(ctx, order.ID)
+			return err
+		})
+		done <- found{o, err}
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("second FindByIdForUpdate did not wait for the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	paid := *order
+	paid.Status = domain.OrderPaid
+	paid.UpdatedAt = now()
+	if err := b.Orders.UpdateOrderStatus(ctx, &paid); err != nil {
+		t.Fatal(err)
+	}
+	// readers outside a transaction are not blocked
+	assertOrder(t, findOrder(t, b, order.ID), order)
+	if err := end(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-done
+	if got.err != nil {
+		t.Fatal(got.err)
+	}
+	assertOrder(t, got.order, &paid)
+}
+
+func testForUpdateCanceled(t *testing.T, b Backend) {
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+
+	ctx, _ := begin(t, b)
+	if _, err := b.Orders.FindByIdForUpdate(ctx, order.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := b.Tx.WithinTx(waitCtx, func(ctx context.Context) error {
+		_, err := b.Orders.FindByIdForUpdate(ctx, order.ID)
+		return err
+	})
+	if err == nil {
+		t.Fatal("took a lock another transaction holds")
+	}
+}
+
+func testFindStuckOrders(t *testing.T, b Backend) {
+	ctx := context.Background()
+	cutoff := now().Add(-time.Minute)
+	old := cutoff.Add(-time.Minute)
+	pending := newOrder(domain.OrderPending, old)
+	unknown := newOrder(domain.OrderPaymentUnknown, old)
+	fresh := newOrder(domain.OrderPending, now())
+	paid := newOrder(domain.OrderPaid, old)
+	failed := newOrder(domain.OrderFailed, old)
+	for _, order := range []*domain.Order{pending, unknown, fresh, paid, failed} {
+		createOrder(t, b, order)
+	}
+
+	stuck, err := b.Orders.FindStuckOrders(ctx, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uuid.UUID
+	for _, order := range stuck {
+		ids = append(ids, order.ID)
+	}
+	if len(ids) != 2 || !slices.Contains(ids, pending.ID) || !slices.Contains(ids, unknown.ID) {
+		t.Fatalf("stuck = %v, want %s and %s", ids, pending.ID, unknown.ID)
+	}
+}
+
+func testSummarizePending(t *testing.T, b Backend) {
+	ctx := context.Background()
+	summary, err := b.Orders.SummarizePending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Counts[domain.OrderPending] != 0 || !summary.OldestUpdate.IsZero() {
+		t.Fatalf("empty summary = %+v", summary)
+	}
+
+	oldest := now().Add(-time.Hour)
+	for _, order := range []*domain.Order{
+		newOrder(domain.OrderPending, now()),
+		newOrder(domain.OrderPending, now()),
+		newOrder(domain.OrderPaymentUnknown, oldest),
+		newOrder(domain.OrderPaid, oldest.Add(-time.Hour)),
+		newOrder(domain.OrderFailed, oldest.Add(-time.Hour)),
+	} {
+		createOrder(t, b, order)
+	}
+
+	summary, err = b.Orders.SummarizePending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Counts[domain.OrderPending] != 2 || summary.Counts[domain.OrderPaymentUnknown] != 1 || len(summary.Counts) != 2 {
+		t.Fatalf("counts = %v, want 2 PENDING and 1 PAYMENT_UNKNOWN", summary.Counts)
+	}
+	if !summary.OldestUpdate.Equal(oldest) {
+		t.Fatalf("oldest update = %s, want %s", summary.OldestUpdate, oldest)
+	}
+}
+
+func assertPayment(t *testing.T, got, want *domain.Payment) {
+	t.Helper()
+	if got == nil {
+		t.Fatalf("payment %s not found", want.ID)
+	}
+	if got.ID != want.ID || got.OrderID != want.OrderID || got.Amount != want.Amount ||
+		got.Status != want.Status || got.FastPayTxn != want.FastPayTxn ||
+		!got.CreatedAt.Equal(want.CreatedAt) || got.Provider != want.Provider {
+		t.Fatalf("payment = %+v, want %+v", *got, *want)
+	}
+}
+
+func testPayments(t *testing.T, b Backend) {
+	ctx := context.Background()
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+
+	latest, err := b.Payments.FindByOrderId(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != nil {
+		t.Fatalf("latest payment = %+v, want nil", *latest)
+	}
+
+	first := newPayment(order.ID, now().Add(-time.Second))
+	first.Status = domain.PaymentFailed
+	second := newPayment(order.ID, now())
+	// inserted out of order: ordering is by created_at
+	within(t, b, func(ctx context.Context) error {
+		if err := b.Payments.CreatePayment(ctx, second); err != nil {
+			return err
+		}
+		return b.Payments.CreatePayment(ctx, first)
+	})
+	other := newOrder(domain.OrderPending, now())
+	createOrder(t, b, other)
+	within(t, b, func(ctx context.Context) error {
+		return b.Payments.CreatePayment(ctx, newPayment(other.ID, now()))
+	})
+
+	got, err := b.Payments.FindById(ctx, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPayment(t, got, first)
+
+	latest, err = b.Payments.FindByOrderId(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPayment(t, latest, second)
+
+	payments, err := b.Payments.ListByOrderId(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 {
+		t.Fatalf("listed %d payments, want 2", len(payments))
+	}
+	assertPayment(t, &payments[0], first)
+	assertPayment(t, &payments[1], second)
+}
+
+func testUpdatePaymentStatus(t *testing.T, b Backend) {
+	ctx := context.Background()
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+	p := newPayment(order.ID, now())
+	p.Status = domain.PaymentProcessing
+	within(t, b, func(ctx context.Context) error {
+		return b.Payments.CreatePayment(ctx, p)
+	})
+
+	want := *p
+	want.Status = domain.PaymentSucceeded
+	want.FastPayTxn = uuid.New()
+	within(t, b, func(ctx context.Context) error {
+		return b.Payments.UpdatePaymentStatus(ctx, p.ID, want.Status, want.FastPayTxn)
+	})
+	got, err := b.Payments.FindById(ctx, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPayment(t, got, &want)
+	if got.UpdatedAt.Before(p.UpdatedAt) {
+		t.Errorf("updated_at went back from %s to %s", p.UpdatedAt, got.UpdatedAt)
+	}
+}
+
+func testFindMissingPayment(t *testing.T, b Backend) {
+	if _, err := b.Payments.FindById(context.Background(), uuid.New()); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func createPayment(t *testing.T, b Backend, p *domain.Payment) {
+	t.Helper()
+	if err := b.Payments.CreatePayment(context.Background(), p); err != nil {
+		t.Fatalf("create payment: %v", err)
+	}
+}
+
+func findPayment(t *testing.T, b Backend, id uuid.UUID) *domain.Payment {
+	t.Helper()
+	p, err := b.Payments.FindById(context.Background(), id)
+	if err != nil {
+		t.Fatalf("find payment: %v", err)
+	}
+	return p
+}
+
+// testPaymentWithoutTxn records payments before the provider answered:
+// any number of them may have no transaction ID, and a status update
+// without one keeps the ID already recorded.
+func testPaymentWithoutTxn(t *testing.T, b Backend) {
+	ctx := context.Background()
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+	failed := newPayment(order.ID, now())
+	failed.Status = domain.PaymentFailed
+	failed.FastPayTxn = uuid.Nil
+	createPayment(t, b, failed)
+	intent := newPayment(order.ID, now())
+	intent.Status = domain.PaymentProcessing
+	intent.FastPayTxn = uuid.Nil
+	createPayment(t, b, intent)
+	assertPayment(t, findPayment(t, b, intent.ID), intent)
+
+	want := *intent
+	want.Status = domain.PaymentSucceeded
+	want.FastPayTxn = uuid.New()
+	if err := b.Payments.UpdatePaymentStatus(ctx, intent.ID, want.Status, want.FastPayTxn); err != nil {
+		t.Fatal(err)
+	}
+	want.Status = domain.PaymentFailed
+	if err := b.Payments.UpdatePaymentStatus(ctx, intent.ID, want.Status, uuid.Nil); err != nil {
+		t.Fatal(err)
+	}
+	assertPayment(t, findPayment(t, b, intent.ID), &want)
+}
+
+// testOneActivePayment allows an order one PROCESSING or SUCCEEDED
+// payment, however many FAILED ones it has.
+func testOneActivePayment(t *testing.T, b Backend) {
+	ctx := context.Background()
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+	failed := newPayment(order.ID, now())
+	failed.Status = domain.PaymentFailed
+	createPayment(t, b, failed)
+	succeeded := newPayment(order.ID, now())
+	createPayment(t, b, succeeded)
+
+	second := newPayment(order.ID, now())
+	if err := b.Payments.CreatePayment(ctx, second); !errors.Is(err, repo.ErrDuplicatePayment) {
+		t.Fatalf("second succeeded payment: err = %v, want %v", err, repo.ErrDuplicatePayment)
+	}
+	second.Status = domain.PaymentProcessing
+	if err := b.Payments.CreatePayment(ctx, second); !errors.Is(err, repo.ErrDuplicatePayment) {
+		t.Fatalf("processing payment next to a succeeded one: err = %v, want %v", err, repo.ErrDuplicatePayment)
+	}
+	if err := b.Payments.UpdatePaymentStatus(ctx, failed.ID, domain.PaymentSucceeded, uuid.Nil); !errors.Is(err, repo.ErrDuplicatePayment) {
+		t.Fatalf("failed payment updated to succeeded: err = %v, want %v", err, repo.ErrDuplicatePayment)
+	}
+
+	// closing the live one frees the slot, within one transaction
+	within(t, b, func(ctx context.Context) error {
+		if err := b.Payments.UpdatePaymentStatus(ctx, succeeded.ID, domain.PaymentFailed, uuid.Nil); err != nil {
+			return err
+		}
+		return b.Payments.CreatePayment(ctx, second)
+	})
+}
+
+// testConcurrentActivePayment records a capture for one order from two
+// transactions, as two checkouts that both slipped past the order lock
+// would: the second waits for the first and fails once it commits.
+func testConcurrentActivePayment(t *testing.T, b Backend) {
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+
+	ctx, end := begin(t, b)
+	if err := b.Payments.CreatePayment(ctx, newPayment(order.ID, now())); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Tx.WithinTx(context.Background(), func(ctx context.Context) error {
+			return b.Payments.CreatePayment(ctx, newPayment(order.ID, now()))
+		})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("second capture finished while the first was open: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := end(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, repo.ErrDuplicatePayment) {
+		t.Fatalf("second capture: err = %v, want %v", err, repo.ErrDuplicatePayment)
+	}
+}
+
+func testGatewayTxnUnique(t *testing.T, b Backend) {
+	ctx := context.Background()
+	order := newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+	first := newPayment(order.ID, now())
+	createPayment(t, b, first)
+
+	other := newOrder(domain.OrderPending, now())
+	createOrder(t, b, other)
+	dup := newPayment(other.ID, now())
+	dup.FastPayTxn = first.FastPayTxn
+	if err := b.Payments.CreatePayment(ctx, dup); !errors.Is(err, repo.ErrDuplicateGatewayTxn) {
+		t.Fatalf("err = %v, want %v", err, repo.ErrDuplicateGatewayTxn)
+	}
+	// transaction IDs are the provider's: another provider may reuse one
+	dup.Provider = "altpay"
+	createPayment(t, b, dup)
+}
+
+func testPaymentForUnknownOrder(t *testing.T, b Backend) {
+	err := b.Payments.CreatePayment(context.Background(), newPayment(uuid.New(), now()))
+	if !errors.Is(err, repo.ErrUnknownOrder) {
+		t.Fatalf("err = %v, want %v", err, repo.ErrUnknownOrder)
+	}
+}
+
+func testInvalidValues(t *testing.T, b Backend) {
+	ctx := context.Background()
+	order := newOrder("SHIPPED", now())
+	if err := b.Orders.CreateOrder(ctx, order); !errors.Is(err, repo.ErrInvalidValue) {
+		t.Errorf("order status SHIPPED: err = %v, want %v", err, repo.ErrInvalidValue)
+	}
+	order = newOrder(domain.OrderPending, now())
+	order.Amount = 0
+	if err := b.Orders.CreateOrder(ctx, order); !errors.Is(err, repo.ErrInvalidValue) {
+		t.Errorf("order amount 0: err = %v, want %v", err, repo.ErrInvalidValue)
+	}
+
+	order = newOrder(domain.OrderPending, now())
+	createOrder(t, b, order)
+	bad := *order
+	bad.Status = "SHIPPED"
+	if err := b.Orders.UpdateOrderStatus(ctx, &bad); !errors.Is(err, repo.ErrInvalidValue) {
+		t.Errorf("order updated to SHIPPED: err = %v, want %v", err, repo.ErrInvalidValue)
+	}
+
+	p := newPayment(order.ID, now())
+	p.Amount = -1
+	if err := b.Payments.CreatePayment(ctx, p); !errors.Is(err, repo.ErrInvalidValue) {
+		t.Errorf("payment amount -1: err = %v, want %v", err, repo.ErrInvalidValue)
+	}
+	p = newPayment(order.ID, now())
+	p.Status = "REFUNDED"
+	if err := b.Payments.CreatePayment(ctx, p); !errors.Is(err, repo.ErrInvalidValue) {
+		t.Errorf("payment status REFUNDED: err = %v, want %v", err, repo.ErrInvalidValue)
+	}
+	p = newPayment(order.ID, now())
+	createPayment(t, b, p)
+	if err := b.Payments.UpdatePaymentStatus(ctx, p.ID, "REFUNDED", uuid.Nil); !errors.Is(err, repo.ErrInvalidValue) {
+		t.Errorf("payment updated to REFUNDED: err = %v, want %v", err, repo.ErrInvalidValue)
+	}
+}
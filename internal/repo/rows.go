@@ -0,0 +1,76 @@
+package repo
+
+import (
+	"the-phantom-charge/internal/domain"
+
+	"github.com/google/uuid"
+)
+
+// Every query names its columns so a migration that adds one can't shift
+// the positional Scan. The lists, the scanners and the values below must
+// stay in the same order; rows_test.go fails if they or the schema drift.
+const (
+	orderColumns   = "id, user_id, amount, idempotency_key, status, created_at, updated_at, currency, payment_provider"
+	paymentColumns = "id, order_id, amount, fastpay_txn_id, status, created_at, updated_at, provider"
+)
+
+// rowScanner is what *sql.Row and *sql.Rows have in common.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanOrder reads a row selected with orderColumns.
+func scanOrder(row rowScanner) (*domain.Order, error) {
+	var o domain.Order
+	err := row.Scan(
+		&o.ID,
+		&o.UserID,
+		&o.Amount,
+		&o.IdempotencyKey,
+		&o.Status,
+		&o.CreatedAt,
+		&o.UpdatedAt,
+		&o.Currency,
+		&o.Provider,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// orderValues are o's fields in orderColumns order, for INSERT.
+func orderValues(o *domain.Order) []any {
+	return []any{o.ID, o.UserID, o.Amount, o.IdempotencyKey, o.Status, o.CreatedAt, o.UpdatedAt, o.Currency, o.Provider}
+}
+
+// scanPayment reads a row selected with paymentColumns.
+func scanPayment(row rowScanner) (*domain.Payment, error) {
+	var p domain.Payment
+	var txn uuid.NullUUID
+	err := row.Scan(
+		&p.ID,
+		&p.OrderID,
+		&p.Amount,
+		&txn,
+		&p.Status,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+		&p.Provider,
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.FastPayTxn = txn.UUID
+	return &p, nil
+}
+
+// paymentValues are p's fields in paymentColumns order, for INSERT.
+func paymentValues(p *domain.Payment) []any {
+	return []any{p.ID, p.OrderID, p.Amount, nullUUID(p.FastPayTxn), p.Status, p.CreatedAt, p.UpdatedAt, p.Provider}
+}
+
+// nullUUID stores uuid.Nil as NULL.
+func nullUUID(id uuid.UUID) uuid.NullUUID {
+	return uuid.NullUUID{UUID: id, Valid: id != uuid.Nil}
+}
@@ -0,0 +1,170 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"the-phantom-charge/internal/database/dbtest"
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/migrate"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// fakeRow hands back values the way database/sql would.
+type fakeRow []any
+
+func (r fakeRow) Scan(dest ...any) error {
+	if len(dest) != len(r) {
+		return sql.ErrNoRows
+	}
+	for i, d := range dest {
+		v := r[i]
+		if valuer, ok := v.(driver.Valuer); ok {
+			var err error
+			if v, err = valuer.Value(); err != nil {
+				return err
+			}
+		}
+		if scanner, ok := d.(sql.Scanner); ok {
+			if err := scanner.Scan(v); err != nil {
+				return err
+			}
+			continue
+		}
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(v))
+	}
+	return nil
+}
+
+func columns(list string) []string {
+	return strings.Split(list, ", ")
+}
+
+// requireFilled fails if v has a zero field: a field the fixture, and so
+// probably the column list, doesn't know about.
+func requireFilled(t *testing.T, v any) {
+	t.Helper()
+	rv := reflect.ValueOf(v).Elem()
+	for i := range rv.NumField() {
+		if rv.Field(i).IsZero() {
+			t.Fatalf("%s.%s is zero in the fixture: add it to the fixture and the column list", rv.Type().Name(), rv.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestOrderRowRoundTrip(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := &domain.Order{
+		ID:             uuid.New(),
+		UserID:         uuid.New(),
+		Amount:         12.5,
+		IdempotencyKey: uuid.New(),
+		Status:         domain.OrderPaid,
+		CreatedAt:      now,
+		UpdatedAt:      now.Add(time.Minute),
+		Currency:       "EUR",
+		Provider:       "fastpay",
+	}
+	requireFilled(t, want)
+
+	values := orderValues(want)
+	if n := len(columns(orderColumns)); len(values) != n || reflect.TypeOf(*want).NumField() != n {
+		t.Fatalf("%d columns, %d values, %d fields", n, len(values), reflect.TypeOf(*want).NumField())
+	}
+	got, err := scanOrder(fakeRow(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("scanned %+v, want %+v", got, want)
+	}
+}
+
+func TestPaymentRowRoundTrip(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := &domain.Payment{
+		ID:         uuid.New(),
+		OrderID:    uuid.New(),
+		Amount:     12.5,
+		Status:     domain.PaymentSucceeded,
+		FastPayTxn: uuid.New(),
+		CreatedAt:  now,
+		UpdatedAt:  now.Add(time.Minute),
+		Provider:   "fastpay",
+	}
+	requireFilled(t, want)
+
+	values := paymentValues(want)
+	if n := len(columns(paymentColumns)); len(values) != n || reflect.TypeOf(*want).NumField() != n {
+		t.Fatalf("%d columns, %d values, %d fields", n, len(values), reflect.TypeOf(*want).NumField())
+	}
+	got, err := scanPayment(fakeRow(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("scanned %+v, want %+v", got, want)
+	}
+
+	// no gateway transaction yet: NULL and back
+	want.FastPayTxn = uuid.Nil
+	got, err = scanPayment(fakeRow(paymentValues(want)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FastPayTxn != uuid.Nil {
+		t.Fatalf("FastPayTxn = %s, want uuid.Nil", got.FastPayTxn)
+	}
+}
+
+// TestSchemaMatchesColumns fails when a migration adds or drops a column
+// the repos don't select.
+func TestSchemaMatchesColumns(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.Open(t)
+	m, err := migrate.NewEmbedded(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := map[string]string{
+		"orders":   orderColumns,
+		"payments": paymentColumns,
+	}
+	for table, list := range tables {
+		rows, err := db.QueryContext(ctx,
+			"SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1",
+			table,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, name)
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := columns(list)
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s has columns %v, the repo selects %v", table, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Tx is a transaction as a Transactor begins it.
+type Tx interface {
+	Commit() error
+	Rollback() error
+}
+
+// Transactor begins transactions for a set of repositories. Services don't
+// use it directly; they go through a TxManager.
+type Transactor interface {
+	BeginTx(ctx context.Context) (Tx, error)
+}
+
+// TxManager runs units of work in a transaction.
+type TxManager interface {
+	// WithinTx runs fn in a transaction carried by the context fn is given:
+	// repository calls made with it join the transaction, calls made
+	// outside it each run on their own. The transaction commits if fn
+	// returns nil and rolls back otherwise. A WithinTx nested in another
+	// joins the outer transaction. A deadlock runs fn again in a new
+	// transaction, so fn must not have effects outside the database that
+	// can't be repeated.
+	WithinTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// DefaultTxAttempts bounds how often WithinTx runs fn.
+const DefaultTxAttempts = 3
+
+type txKey struct{}
+
+// TxFromContext returns the transaction WithinTx put in ctx, nil outside
+// one.
+func TxFromContext(ctx context.Context) Tx {
+	tx, _ := ctx.Value(txKey{}).(Tx)
+	return tx
+}
+
+type txManager struct {
+	transactor Transactor
+	attempts   int
+}
+
+type TxOption func(*txManager)
+
+// WithTxAttempts sets how often WithinTx runs fn before it gives up on
+// deadlocks.
+func WithTxAttempts(n int) TxOption {
+	return func(m *txManager) {
+		m.attempts = n
+	}
+}
+
+func NewTxManager(transactor Transactor, opts ...TxOption) TxManager {
+	m := &txManager{transactor: transactor, attempts: DefaultTxAttempts}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *txManager) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if TxFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+	for attempt := 1; ; attempt++ {
+		err := m.run(ctx, fn)
+		if err == nil || !IsDeadlock(err) || attempt >= m.attempts || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func (m *txManager) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx, err := m.transactor.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(context.WithValue(ctx, txKey{}, tx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsDeadlock reports whether Postgres aborted a transaction to break a
+// deadlock; run again, it may succeed. Transactions run at READ COMMITTED,
+// ordered by row locks (FOR UPDATE), so serialization failures (40001)
+// don't happen and aren't retried.
+func IsDeadlock(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40P01"
+}
+
+type sqlTransactor struct {
+	db *sql.DB
+}
+
+func NewSQLTransactor(db *sql.DB) Transactor {
+	return sqlTransactor{db: db}
+}
+
+func (t sqlTransactor) BeginTx(ctx context.Context) (Tx, error) {
+	return t.db.BeginTx(ctx, nil)
+}
+
+// querier is what *sql.DB and *sql.Tx have in common.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// conn returns the transaction ctx carries, or db outside one.
+func conn(ctx context.Context, db *sql.DB) querier {
+	if tx, ok := TxFromContext(ctx).(*sql.Tx); ok {
+		return tx
+	}
+	return db
+}
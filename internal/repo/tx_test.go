@@ -0,0 +1,110 @@
+package repo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"the-phantom-charge/internal/repo"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type stubTx struct {
+	committed, rolledBack *int
+	done                  bool
+}
+
+func (t *stubTx) Commit() error {
+	if !t.done {
+		t.done = true
+		*t.committed++
+	}
+	return nil
+}
+
+func (t *stubTx) Rollback() error {
+	if !t.done {
+		t.done = true
+		*t.rolledBack++
+	}
+	return nil
+}
+
+type stubTransactor struct {
+	begun, committed, rolledBack int
+}
+
+func (s *stubTransactor) BeginTx(ctx context.Context) (repo.Tx, error) {
+	s.begun++
+	return &stubTx{committed: &s.committed, rolledBack: &s.rolledBack}, nil
+}
+
+func TestWithinTxRetriesDeadlocks(t *testing.T) {
+	stub := &stubTransactor{}
+	calls := 0
+	err := repo.NewTxManager(stub).WithinTx(context.Background(), func(ctx context.Context) error {
+		calls++
+		if repo.TxFromContext(ctx) == nil {
+			t.Fatal("no transaction in ctx")
+		}
+		if calls < 3 {
+			return &pgconn.PgError{Code: "40P01"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || stub.committed != 1 || stub.rolledBack != 2 {
+		t.Fatalf("calls = %d, commits = %d, rollbacks = %d, want 3, 1, 2", calls, stub.committed, stub.rolledBack)
+	}
+}
+
+func TestWithinTxGivesUp(t *testing.T) {
+	stub := &stubTransactor{}
+	deadlock := &pgconn.PgError{Code: "40P01"}
+	err := repo.NewTxManager(stub, repo.WithTxAttempts(2)).WithinTx(context.Background(), func(ctx context.Context) error {
+		return deadlock
+	})
+	if !errors.Is(err, deadlock) {
+		t.Fatalf("err = %v, want %v", err, deadlock)
+	}
+	if stub.begun != 2 || stub.committed != 0 {
+		t.Fatalf("begun = %d, commits = %d, want 2, 0", stub.begun, stub.committed)
+	}
+}
+
+func TestWithinTxDoesNotRetryOtherErrors(t *testing.T) {
+	for _, code := range []string{"23505", "40001"} {
+		stub := &stubTransactor{}
+		pgErr := &pgconn.PgError{Code: code}
+		err := repo.NewTxManager(stub).WithinTx(context.Background(), func(ctx context.Context) error {
+			return pgErr
+		})
+		if !errors.Is(err, pgErr) || stub.begun != 1 || stub.rolledBack != 1 {
+			t.Fatalf("%s: err = %v, begun = %d, rollbacks = %d", code, err, stub.begun, stub.rolledBack)
+		}
+	}
+}
+
+// TestWithinTxNested checks a nested WithinTx joins the outer transaction
+// and leaves retries to it.
+func TestWithinTxNested(t *testing.T) {
+	stub := &stubTransactor{}
+	txs := repo.NewTxManager(stub)
+	err := txs.WithinTx(context.Background(), func(ctx context.Context) error {
+		outer := repo.TxFromContext(ctx)
+		return txs.WithinTx(ctx, func(ctx context.Context) error {
+			if repo.TxFromContext(ctx) != outer {
+				t.Error("nested WithinTx began its own transaction")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub.begun != 1 || stub.committed != 1 {
+		t.Fatalf("begun = %d, commits = %d, want 1, 1", stub.begun, stub.committed)
+	}
+}
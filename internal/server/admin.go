@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"the-phantom-charge/internal/infrastructure/payment"
+)
+
+// requireAdmin lets a request through only with "Authorization: Bearer
+// <token>". An empty token locks everyone out.
+func requireAdmin(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin token required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *Server) getChaosHandler(c *gin.Context) {
+	resp := make(map[string]payment.ChaosConfig, len(s.chaos))
+	for provider, chaos := range s.chaos {
+		resp[provider] = chaos.Config()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) putChaosHandler(c *gin.Context) {
+	chaos, ok := s.chaos[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown payment provider"})
+		return
+	}
+
+	var cfg payment.ChaosConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if cfg.LatencyMs < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "latency_ms must not be negative"})
+		return
+	}
+	for _, p := range []float64{cfg.LatencyProbability, cfg.DropResponseProbability, cfg.ErrorProbability, cfg.DuplicateProbability} {
+		if p < 0 || p > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "probabilities must be between 0 and 1"})
+			return
+		}
+	}
+
+	chaos.SetConfig(cfg)
+	c.JSON(http.StatusOK, cfg)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/database"
+	"the-phantom-charge/internal/health"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/migrate"
+)
+
+// workerStaleAfter is how many reconcile intervals may pass without a
+// successful pass before the worker is reported degraded.
+const workerStaleAfter = 3
+
+// livezHandler answers as long as the process serves HTTP. It checks no
+// dependency: restarting the API does not fix a database outage.
+func (s *Server) livezHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": health.StatusUp})
+}
+
+// readyzHandler runs the component checks. 503 takes the instance out of
+// rotation until its critical components recover; a degraded instance
+// keeps serving.
+func (s *Server) readyzHandler(c *gin.Context) {
+	report := s.health.Run(c.Request.Context())
+	status := http.StatusOK
+	if report.Status == health.StatusDown {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
+
+// databaseCheck pings the database and reports the pool.
+func databaseCheck(db database.Service) health.Check {
+	return health.Check{
+		Name:     "database",
+		Critical: true,
+		Run: func(ctx context.Context) (health.Details, error) {
+			stats := db.Stats()
+			details := health.Details{
+				"in_use":     fmt.Sprintf("%d/%d", stats.AcquiredConns, stats.MaxConns),
+				"wait_count": strconv.FormatInt(stats.WaitCount, 10),
+			}
+			return details, db.Ping(ctx)
+		},
+	}
+}
+
+// migrationCheck fails until the schema has every migration this build
+// ships, unmodified: the queries expect it.
+func migrationCheck(db *sql.DB) health.Check {
+	m, err := migrate.NewEmbedded(db)
+	return health.Check{
+		Name:     "migrations",
+		Critical: true,
+		Run: func(ctx context.Context) (health.Details, error) {
+			if err != nil {
+				return nil, err
+			}
+			status, err := m.Status(ctx)
+			if err != nil {
+				return nil, err
+			}
+			var version int64
+			var pending, modified []string
+			for _, s := range status {
+				switch {
+				case !s.Applied:
+					pending = append(pending, s.String())
+				case s.Modified:
+					modified = append(modified, s.String())
+				default:
+					version = s.Version
+				}
+			}
+			details := health.Details{"version": strconv.FormatInt(version, 10)}
+			if len(pending) > 0 {
+				return details, fmt.Errorf("pending: %s", strings.Join(pending, ", "))
+			}
+			if len(modified) > 0 {
+				return details, fmt.Errorf("%w: %s", migrate.ErrChecksumMismatch, strings.Join(modified, ", "))
+			}
+			return details, nil
+		},
+	}
+}
+
+// gatewayCheck reports each provider's circuit. An open circuit degrades
+// the instance but leaves it in rotation: another instance would find
+// the provider just as unreachable.
+func gatewayCheck(registry *payment.Registry) health.Check {
+	return health.Check{
+		Name: "payment_gateway",
+		Run: func(ctx context.Context) (health.Details, error) {
+			details := health.Details{}
+			var open []string
+			for provider, state := range registry.BreakerStates() {
+				details[provider] = string(state)
+				if state == payment.BreakerOpen {
+					open = append(open, provider)
+				}
+			}
+			if len(open) > 0 {
+				sort.Strings(open)
+				return details, fmt.Errorf("circuit open: %s", strings.Join(open, ", "))
+			}
+			return details, nil
+		},
+	}
+}
+
+// workerCheck fails when the reconciliation worker has gone maxAge
+// without a successful pass, counting from started before its first.
+func workerCheck(lastSuccess func() time.Time, started time.Time, maxAge time.Duration, clk clock.Clock) health.Check {
+	return health.Check{
+		Name: "reconciliation_worker",
+		Run: func(ctx context.Context) (health.Details, error) {
+			last := lastSuccess()
+			details := health.Details{"last_success": "never"}
+			since := started
+			if !last.IsZero() {
+				details["last_success"] = last.UTC().Format(time.RFC3339)
+				since = last
+			}
+			age := clk.Now().Sub(since)
+			details["age"] = age.Round(time.Second).String()
+			if age > maxAge {
+				return details, fmt.Errorf("no successful pass in %s", age.Round(time.Second))
+			}
+			return details, nil
+		},
+	}
+}
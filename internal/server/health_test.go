@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/health"
+	"the-phantom-charge/internal/infrastructure/payment"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	up := func(ctx context.Context) (health.Details, error) { return nil, nil }
+	down := func(ctx context.Context) (health.Details, error) { return nil, errors.New("connection refused") }
+	tests := []struct {
+		name   string
+		checks []health.Check
+		status int
+		want   health.Status
+	}{
+		{"up", []health.Check{{Name: "database", Critical: true, Run: up}}, http.StatusOK, health.StatusUp},
+		{"degraded", []health.Check{{Name: "database", Critical: true, Run: up}, {Name: "payment_gateway", Run: down}}, http.StatusOK, health.StatusDegraded},
+		{"database down", []health.Check{{Name: "database", Critical: true, Run: down}}, http.StatusServiceUnavailable, health.StatusDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{health: health.New(tt.checks)}
+			r := gin.New()
+			r.GET("/readyz", s.readyzHandler)
+			r.GET("/livez", s.livezHandler)
+
+			req, _ := http.NewRequest("GET", "/readyz", nil)
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Fatalf("Handler returned wrong status code: got %v want %v (%s)", rr.Code, tt.status, rr.Body)
+			}
+			var report health.Report
+			if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil || report.Status != tt.want {
+				t.Fatalf("report = %s, %v; want status %s", rr.Body, err, tt.want)
+			}
+
+			// liveness ignores the components
+			req, _ = http.NewRequest("GET", "/livez", nil)
+			rr = httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("livez returned %v, want %v", rr.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestGatewayCheck(t *testing.T) {
+	chaos := payment.NewChaos(payment.NewPaymentGateway(), payment.ChaosConfig{Enabled: true, ErrorProbability: 1}, 1, nil)
+	breaker := payment.NewCircuitBreaker(chaos, payment.BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Hour})
+	registry := payment.NewRegistry()
+	registry.Register(payment.ProviderFastPay, breaker, breaker)
+	check := gatewayCheck(registry)
+
+	if details, err := check.Run(context.Background()); err != nil || details[payment.ProviderFastPay] != string(payment.BreakerClosed) {
+		t.Fatalf("closed circuit: %v, %v", details, err)
+	}
+	breaker.Charge(context.Background(), 100, uuid.New())
+	if details, err := check.Run(context.Background()); err == nil || details[payment.ProviderFastPay] != string(payment.BreakerOpen) {
+		t.Fatalf("open circuit: %v, %v; want an error", details, err)
+	}
+}
+
+func TestWorkerCheck(t *testing.T) {
+	started := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(started)
+	var last time.Time
+	check := workerCheck(func() time.Time { return last }, started, time.Minute, fake)
+
+	// no pass yet, but only just started
+	if _, err := check.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(2 * time.Minute)
+	if _, err := check.Run(context.Background()); err == nil {
+		t.Fatal("no pass in two minutes, want an error")
+	}
+	last = fake.Now()
+	if details, err := check.Run(context.Background()); err != nil || details["age"] != "0s" {
+		t.Fatalf("fresh pass: %v, %v", details, err)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"the-phantom-charge/internal/logging"
+)
+
+// requestIDHeader carries the request ID both ways: a caller's ID is kept,
+// otherwise one is made up, and the response echoes it.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen keeps a caller from stuffing the logs.
+const maxRequestIDLen = 128
+
+// requestID tags the request's context with its ID, so every line logged
+// while serving it carries request_id.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLen {
+			id = uuid.NewString()
+		}
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+// accessLog logs every request once it is answered, with whatever fields
+// the handlers added to its context, such as order_id. Probes are logged
+// at debug level.
+func accessLog(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		level := slog.LevelInfo
+		switch {
+		case probes[c.Request.URL.Path]:
+			level = slog.LevelDebug
+		case c.Writer.Status() >= 500:
+			level = slog.LevelError
+		}
+		args := []any{
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		}
+		logger.Log(c.Request.Context(), level, "request", args...)
+	}
+}
+
+// withOrder adds the order's ID to the request's context, for the handler's
+// own calls and the access log.
+func withOrder(c *gin.Context, id uuid.UUID) {
+	c.Request = c.Request.WithContext(logging.With(c.Request.Context(), logging.OrderID, id))
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"the-phantom-charge/internal/logging"
+	"the-phantom-charge/internal/service"
+)
+
+func TestRequestIDAndAccessLog(t *testing.T) {
+	orderId := uuid.New()
+	var buf bytes.Buffer
+	s := &Server{
+		orders: &stubOrderService{result: &service.CheckoutResult{OrderID: orderId, Outcome: service.CheckoutPaid}},
+		logger: logging.New(&buf, slog.LevelInfo),
+	}
+	r := gin.New()
+	r.Use(requestID(), accessLog(s.logger))
+	r.POST("/orders/:id/checkout", s.checkoutHandler)
+	r.GET("/livez", s.livezHandler)
+
+	req, _ := http.NewRequest("POST", "/orders/"+orderId.String()+"/checkout", nil)
+	req.Header.Set(requestIDHeader, "support-ticket-42")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if got := rr.Header().Get(requestIDHeader); got != "support-ticket-42" {
+		t.Errorf("echoed request ID %q", got)
+	}
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("access log %q: %v", buf.String(), err)
+	}
+	if line[logging.RequestID] != "support-ticket-42" || line[logging.OrderID] != orderId.String() ||
+		line["route"] != "/orders/:id/checkout" || line["status"] != float64(http.StatusOK) {
+		t.Errorf("access log line: %v", line)
+	}
+
+	// no ID from the caller: one is made up; probes stay out of the info log
+	buf.Reset()
+	req, _ = http.NewRequest("GET", "/livez", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if _, err := uuid.Parse(rr.Header().Get(requestIDHeader)); err != nil {
+		t.Errorf("generated request ID %q: %v", rr.Header().Get(requestIDHeader), err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("probe logged at info: %s", buf.String())
+	}
+}
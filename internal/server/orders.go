@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/service"
+)
+
+type orderResponse struct {
+	ID        uuid.UUID          `json:"id"`
+	Amount    float64            `json:"amount"`
+	Currency  string             `json:"currency"`
+	Status    domain.OrderStatus `json:"status"`
+	Provider  string             `json:"provider,omitempty"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+func newOrderResponse(order *domain.Order) orderResponse {
+	return orderResponse{
+		ID:        order.ID,
+		Amount:    order.Amount,
+		Currency:  order.Currency,
+		Status:    order.Status,
+		Provider:  order.Provider,
+		CreatedAt: order.CreatedAt,
+		UpdatedAt: order.UpdatedAt,
+	}
+}
+
+type checkoutResponse struct {
+	OrderID       uuid.UUID               `json:"order_id"`
+	OrderStatus   domain.OrderStatus      `json:"order_status"`
+	Outcome       service.CheckoutOutcome `json:"outcome"`
+	PaymentID     uuid.UUID               `json:"payment_id,omitempty"`
+	TxnID         uuid.UUID               `json:"txn_id,omitempty"`
+	AmountCharged float64                 `json:"amount_charged,omitempty"`
+	Provider      string                  `json:"provider,omitempty"`
+	Replayed      bool                    `json:"replayed"`
+}
+
+func (s *Server) createOrderHandler(c *gin.Context) {
+	order, err := s.orders.CreateOrder(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	withOrder(c, order.ID)
+	c.JSON(http.StatusCreated, newOrderResponse(order))
+}
+
+func (s *Server) getOrderHandler(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+	withOrder(c, id)
+	order, err := s.orders.GetOrder(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(checkoutErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, newOrderResponse(order))
+}
+
+// checkoutHandler answers 200 when the order is paid and 202 when the
+// charge is still being confirmed; the client should poll the order.
+func (s *Server) checkoutHandler(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+	withOrder(c, id)
+	result, err := s.orders.Checkout(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(checkoutErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	if result.Outcome == service.CheckoutPendingConfirmation {
+		status = http.StatusAccepted
+	}
+	c.JSON(status, checkoutResponse{
+		OrderID:       result.OrderID,
+		OrderStatus:   result.OrderStatus,
+		Outcome:       result.Outcome,
+		PaymentID:     result.PaymentID,
+		TxnID:         result.FastPayTxnID,
+		AmountCharged: result.AmountCharged,
+		Provider:      result.Provider,
+		Replayed:      result.Replayed,
+	})
+}
+
+func checkoutErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrOrderNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrOrderNotPending):
+		return http.StatusConflict
+	case errors.Is(err, service.ErrPaymentFailed):
+		return http.StatusPaymentRequired
+	case errors.Is(err, payment.ErrGatewayUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/service"
+)
+
+type stubOrderService struct {
+	result *service.CheckoutResult
+	err    error
+}
+
+func (s *stubOrderService) Checkout(ctx context.Context, orderId uuid.UUID) (*service.CheckoutResult, error) {
+	return s.result, s.err
+}
+
+func (s *stubOrderService) CreateOrder(ctx context.Context) (*domain.Order, error) {
+	return &domain.Order{ID: uuid.New(), Status: domain.OrderPending}, nil
+}
+
+func (s *stubOrderService) GetOrder(ctx context.Context, orderId uuid.UUID) (*domain.Order, error) {
+	return nil, service.ErrOrderNotFound
+}
+
+func (s *stubOrderService) Refund(ctx context.Context, orderId uuid.UUID) (*payment.ChargeResult, error) {
+	return nil, service.ErrOrderNotFound
+}
+
+func TestCheckoutHandler(t *testing.T) {
+	orderId := uuid.New()
+	tests := []struct {
+		name   string
+		stub   *stubOrderService
+		path   string
+		status int
+	}{
+		{"paid", &stubOrderService{result: &service.CheckoutResult{OrderID: orderId, Outcome: service.CheckoutPaid}}, "/orders/" + orderId.String() + "/checkout", http.StatusOK},
+		{"pending confirmation", &stubOrderService{result: &service.CheckoutResult{OrderID: orderId, Outcome: service.CheckoutPendingConfirmation}}, "/orders/" + orderId.String() + "/checkout", http.StatusAccepted},
+		{"declined", &stubOrderService{err: service.ErrPaymentFailed}, "/orders/" + orderId.String() + "/checkout", http.StatusPaymentRequired},
+		{"not pending", &stubOrderService{err: service.ErrOrderNotPending}, "/orders/" + orderId.String() + "/checkout", http.StatusConflict},
+		{"bad id", &stubOrderService{}, "/orders/nope/checkout", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{orders: tt.stub}
+			r := gin.New()
+			r.POST("/orders/:id/checkout", s.checkoutHandler)
+
+			req, err := http.NewRequest("POST", tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Fatalf("Handler returned wrong status code: got %v want %v (%s)", rr.Code, tt.status, rr.Body)
+			}
+		})
+	}
+}
+
+func TestCreateAndGetOrderHandlers(t *testing.T) {
+	s := &Server{orders: &stubOrderService{}}
+	r := gin.New()
+	r.POST("/orders", s.createOrderHandler)
+	r.GET("/orders/:id", s.getOrderHandler)
+
+	req, _ := http.NewRequest("POST", "/orders", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	var order orderResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil || order.Status != domain.OrderPending {
+		t.Fatalf("unexpected body %s: %v", rr.Body, err)
+	}
+
+	req, _ = http.NewRequest("GET", "/orders/"+uuid.NewString(), nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
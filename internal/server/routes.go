@@ -5,21 +5,47 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
+// probes are hit every few seconds; their spans and log lines would bury
+// the checkouts.
+var probes = map[string]bool{"/health": true, "/livez": true, "/readyz": true, "/metrics": true}
+
 func (s *Server) RegisterRoutes() http.Handler {
-	r := gin.Default()
+	r := gin.New()
+
+	r.Use(otelgin.Middleware("the-phantom-charge", otelgin.WithFilter(func(req *http.Request) bool {
+		return !probes[req.URL.Path]
+	})))
+	r.Use(requestID(), accessLog(s.logger), gin.Recovery())
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5173"}, // Add your frontend URL
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowHeaders:     []string{"Accept", "Authorization", "Content-Type"},
+		AllowHeaders:     []string{"Accept", "Authorization", "Content-Type", requestIDHeader},
+		ExposeHeaders:    []string{requestIDHeader},
 		AllowCredentials: true, // Enable cookies/auth
 	}))
 
 	r.GET("/", s.HelloWorldHandler)
 
 	r.GET("/health", s.healthHandler)
+	r.GET("/livez", s.livezHandler)
+	r.GET("/readyz", s.readyzHandler)
+	r.GET("/metrics", gin.WrapH(s.metrics.Handler()))
+
+	orders := r.Group("/orders")
+	orders.POST("", s.createOrderHandler)
+	orders.GET("/:id", s.getOrderHandler)
+	orders.POST("/:id/checkout", s.checkoutHandler)
+
+	// fault injection for QA, only when CHAOS_ENABLED=true
+	if s.chaos != nil {
+		admin := r.Group("/admin", requireAdmin(s.adminToken))
+		admin.GET("/chaos", s.getChaosHandler)
+		admin.PUT("/chaos/:provider", s.putChaosHandler)
+	}
 
 	return r
 }
@@ -32,5 +58,15 @@ func (s *Server) HelloWorldHandler(c *gin.Context) {
 }
 
 func (s *Server) healthHandler(c *gin.Context) {
-	c.JSON(http.StatusOK, s.db.Health())
+	health := s.db.Health()
+	if s.router != nil {
+		for provider, state := range s.router.Registry().BreakerStates() {
+			health["payment_gateway_"+provider] = string(state)
+		}
+	}
+	status := http.StatusOK
+	if health["status"] != "up" {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, health)
 }
@@ -2,9 +2,14 @@ package server
 
 import (
 	"github.com/gin-gonic/gin"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/metrics"
 )
 
 func TestHelloWorldHandler(t *testing.T) {
@@ -30,3 +35,67 @@ func TestHelloWorldHandler(t *testing.T) {
 		t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
 }
+
+func TestPutChaosHandler(t *testing.T) {
+	chaos := payment.NewChaos(payment.NewPaymentGateway(), payment.ChaosConfig{}, 1, nil)
+	s := &Server{chaos: map[string]*payment.Chaos{payment.ProviderFastPay: chaos}}
+	r := gin.New()
+	r.PUT("/admin/chaos/:provider", s.putChaosHandler)
+
+	body := `{"enabled":true,"drop_response_probability":0.4}`
+	req, err := http.NewRequest("PUT", "/admin/chaos/fastpay", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if cfg := chaos.Config(); !cfg.Enabled || cfg.DropResponseProbability != 0.4 {
+		t.Errorf("config not applied: %+v", cfg)
+	}
+
+	req, _ = http.NewRequest("PUT", "/admin/chaos/fastpay", strings.NewReader(`{"error_probability":2}`))
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestChaosRoutes(t *testing.T) {
+	chaos := payment.NewChaos(payment.NewPaymentGateway(), payment.ChaosConfig{}, 1, nil)
+	tests := []struct {
+		name   string
+		chaos  map[string]*payment.Chaos
+		token  string
+		header string
+		status int
+	}{
+		{"chaos off", nil, "secret", "Bearer secret", http.StatusNotFound},
+		{"no token sent", map[string]*payment.Chaos{payment.ProviderFastPay: chaos}, "secret", "", http.StatusUnauthorized},
+		{"wrong token", map[string]*payment.Chaos{payment.ProviderFastPay: chaos}, "secret", "Bearer guess", http.StatusUnauthorized},
+		{"no token configured", map[string]*payment.Chaos{payment.ProviderFastPay: chaos}, "", "Bearer ", http.StatusUnauthorized},
+		{"admin", map[string]*payment.Chaos{payment.ProviderFastPay: chaos}, "secret", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{chaos: tt.chaos, adminToken: tt.token, metrics: metrics.New(), logger: slog.New(slog.DiscardHandler)}
+			r := s.RegisterRoutes()
+
+			req, err := http.NewRequest("GET", "/admin/chaos", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("GET /admin/chaos returned %v, want %v", rr.Code, tt.status)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
@@ -9,22 +12,82 @@ import (
 
 	_ "github.com/joho/godotenv/autoload"
 
+	"the-phantom-charge/internal/clock"
 	"the-phantom-charge/internal/database"
+	"the-phantom-charge/internal/health"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/logging"
+	"the-phantom-charge/internal/metrics"
+	"the-phantom-charge/internal/migrate"
+	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/service"
+	"the-phantom-charge/internal/tracing"
+	"the-phantom-charge/internal/worker"
 )
 
+// reconcileInterval is how often the in-process worker looks for stuck orders.
+const reconcileInterval = 10 * time.Second
+
+// migrateTimeout bounds MIGRATE_ON_START, including the wait for another
+// replica's migration lock.
+const migrateTimeout = 5 * time.Minute
+
 type Server struct {
 	port int
 
-	db database.Service
+	db     database.Service
+	router *payment.Router
+	// fault injectors per provider, driven by the admin endpoints; nil
+	// unless CHAOS_ENABLED=true
+	chaos map[string]*payment.Chaos
+	// bearer token the admin endpoints require
+	adminToken string
+	orders     service.OrderService
+	// component checks behind /readyz
+	health  *health.Checker
+	metrics *metrics.Metrics
+	logger  *slog.Logger
 }
 
+// NewServer wires the service, the worker and the gateways to log through
+// slog.Default(); main sets it up first.
 func NewServer() *http.Server {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
 	NewServer := &Server{
 		port: port,
 
-		db: database.New(),
+		db:         database.New(),
+		adminToken: os.Getenv("ADMIN_TOKEN"),
+		metrics:    metrics.New(),
+		logger:     slog.Default(),
+	}
+	chaosEnabled := os.Getenv("CHAOS_ENABLED") == "true"
+	if chaosEnabled && NewServer.adminToken == "" {
+		log.Fatal("CHAOS_ENABLED=true needs an ADMIN_TOKEN for /admin/chaos")
+	}
+	NewServer.router, NewServer.chaos = newPaymentRouter(NewServer.metrics, NewServer.logger, chaosEnabled)
+
+	if os.Getenv("MIGRATE_ON_START") == "true" {
+		migrateSchema(NewServer.logger)
 	}
+	db := NewServer.db.DB()
+	orderRepo := repo.NewOrderRepo(db)
+	paymentRepo := repo.NewPaymentRepo(db)
+	txs := repo.NewTxManager(repo.NewSQLTransactor(db))
+	NewServer.orders = NewServer.metrics.OrderService(service.NewOrderService(txs, orderRepo, paymentRepo, NewServer.router,
+		service.WithLogger(NewServer.logger)))
+	reconciler := worker.NewReconciliationWorker(txs, orderRepo, paymentRepo, NewServer.router, clock.Real, reconcileInterval, worker.DefaultStuckAfter,
+		worker.WithPassHook(NewServer.metrics.ObservePass), worker.WithLogger(NewServer.logger))
+	NewServer.metrics.RegisterPool(NewServer.db.Stats)
+	NewServer.metrics.RegisterPendingOrders(orderRepo, clock.Real, worker.DefaultStuckAfter)
+	NewServer.health = health.New([]health.Check{
+		databaseCheck(NewServer.db),
+		migrationCheck(db),
+		gatewayCheck(NewServer.router.Registry()),
+		workerCheck(reconciler.LastSuccess, clock.Real.Now(), workerStaleAfter*reconcileInterval, clock.Real),
+	})
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	go reconciler.Run(workerCtx)
 
 	// Declare Server config
 	server := &http.Server{
@@ -34,6 +97,57 @@ func NewServer() *http.Server {
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
+	server.RegisterOnShutdown(stopWorker)
 
 	return server
 }
+
+// migrateSchema applies pending migrations before the server takes
+// traffic. Replicas starting together wait on each other's lock rather
+// than racing.
+func migrateSchema(logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+	pool, err := database.Open(ctx, database.ConfigFromEnv().ForMigrations())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close()
+	m, err := migrate.NewEmbedded(pool.DB())
+	if err != nil {
+		log.Fatal(err)
+	}
+	done, err := m.Up(ctx)
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	for _, mig := range done {
+		logger.Info("applied migration", "migration", mig)
+	}
+}
+
+// newPaymentRouter registers the payment providers. FastPay is the only one
+// in production until the second PSP is live. With chaos on, each provider
+// gets a chaos layer under the resilience stack; it is inert until enabled
+// through the admin endpoints. Metrics and tracing sit between the two, so
+// each attempt is timed, gets a span and a log line.
+func newPaymentRouter(m *metrics.Metrics, logger *slog.Logger, chaosEnabled bool) (*payment.Router, map[string]*payment.Chaos) {
+	registry := payment.NewRegistry()
+	var chaos map[string]*payment.Chaos
+
+	mockCfg := payment.DefaultMockConfig
+	mockCfg.Logger = logger
+	var fastPay payment.PaymentGateway = payment.NewMockGateway(mockCfg, 0)
+	if chaosEnabled {
+		fastPayChaos := payment.NewChaos(fastPay, payment.ChaosConfig{}, 0, nil)
+		chaos = map[string]*payment.Chaos{payment.ProviderFastPay: fastPayChaos}
+		fastPay = fastPayChaos
+	}
+	instrumented := m.Gateway(payment.ProviderFastPay,
+		tracing.Gateway(payment.ProviderFastPay,
+			logging.Gateway(payment.ProviderFastPay, fastPay, logger)))
+	fastPay, breaker := payment.Resilient(instrumented, payment.DefaultCallTimeout, clock.Real)
+	registry.Register(payment.ProviderFastPay, fastPay, breaker)
+
+	return payment.NewRouter(registry), chaos
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"the-phantom-charge/internal/timeline"
+
+	"github.com/google/uuid"
+)
+
+// CrashPoint names a place in Checkout where the process can die. Each one
+// leaves a different trail for reconciliation to clean up.
+type CrashPoint string
+
+const (
+	// CrashBeforeCharge: the provider is assigned (and under
+	// StrategyWriteAhead the intent written) but nothing was sent.
+	CrashBeforeCharge CrashPoint = "before-charge"
+	// CrashAfterCharge: the provider answered but nothing was written.
+	CrashAfterCharge CrashPoint = "after-charge"
+	// CrashBeforeCommit: the order and payment updates are rolled back.
+	CrashBeforeCommit CrashPoint = "before-commit"
+	// CrashAfterCommit: everything is saved but the client never hears.
+	CrashAfterCommit CrashPoint = "after-commit"
+)
+
+var CrashPoints = []CrashPoint{CrashBeforeCharge, CrashAfterCharge, CrashBeforeCommit, CrashAfterCommit}
+
+// ErrCrashed is returned when a CrashHook stopped Checkout. Nothing after
+// the crash point ran, as if the process had died there.
+var ErrCrashed = errors.New("checkout crashed")
+
+// CrashHook decides whether Checkout of the order dies at point.
+type CrashHook func(point CrashPoint, orderId uuid.UUID) bool
+
+// WithCrashHook installs a hook consulted at every CrashPoint. It is for
+// simulations and tests only.
+func WithCrashHook(hook CrashHook) Option {
+	return func(s *orderService) {
+		s.crashHook = hook
+	}
+}
+
+// crash returns ErrCrashed if the hook wants Checkout to die at point.
+func (s *orderService) crash(ctx context.Context, point CrashPoint, orderId uuid.UUID) error {
+	if s.crashHook != nil && s.crashHook(point, orderId) {
+		s.recorder.Record(ctx, timeline.Event{Kind: timeline.KindCrash, OrderID: orderId.String(), Detail: string(point)})
+		return ErrCrashed
+	}
+	return nil
+}
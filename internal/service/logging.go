@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/google/uuid"
+
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/logging"
+)
+
+// WithLogger logs order creation, checkout decisions and their results to
+// logger. The default drops them.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *orderService) {
+		s.logger = logger
+	}
+}
+
+// logCheckout logs how a checkout ended. Refusals the customer caused are
+// routine; anything else is an error worth a look.
+func (s *orderService) logCheckout(ctx context.Context, result *CheckoutResult, err error) {
+	switch {
+	case result != nil:
+		args := []any{"outcome", result.Outcome, "status", result.OrderStatus, logging.Provider, result.Provider, "replayed", result.Replayed}
+		if result.PaymentID != uuid.Nil {
+			args = append(args, logging.PaymentID, result.PaymentID)
+		}
+		if result.FastPayTxnID != uuid.Nil {
+			args = append(args, logging.GatewayTxn, result.FastPayTxnID)
+		}
+		s.logger.InfoContext(ctx, "checkout finished", args...)
+	case errors.Is(err, ErrPaymentFailed), errors.Is(err, ErrOrderNotPending), errors.Is(err, ErrOrderNotFound):
+		s.logger.InfoContext(ctx, "checkout refused", "error", err)
+	default:
+		s.logger.ErrorContext(ctx, "checkout failed", "error", err)
+	}
+}
+
+func (s *orderService) logCommit(ctx context.Context, order *domain.Order) {
+	s.logger.InfoContext(ctx, "order status saved", "status", order.Status, logging.Provider, order.Provider)
+}
@@ -2,114 +2,580 @@ package service
 
 import (
 	"context"
-	"database/sql"
 	"errors"
+	"log/slog"
 	"math/rand/v2"
+	"the-phantom-charge/internal/clock"
 	"the-phantom-charge/internal/domain"
 	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/logging"
 	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/timeline"
+	"the-phantom-charge/internal/tracing"
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var tracer = otel.Tracer("the-phantom-charge/internal/service")
 
 type OrderService interface {
-	Checkout(ctx context.Context, orderId uuid.UUID) (string, error)
+	Checkout(ctx context.Context, orderId uuid.UUID) (*CheckoutResult, error)
 	CreateOrder(ctx context.Context) (*domain.Order, error)
+	// GetOrder returns ErrOrderNotFound if there is no such order.
+	GetOrder(ctx context.Context, orderId uuid.UUID) (*domain.Order, error)
+	// Refund gives a PAID order's charge back through the provider that
+	// took it.
+	Refund(ctx context.Context, orderId uuid.UUID) (*payment.ChargeResult, error)
 }
 
+// CheckoutOutcome tells the caller what to show the customer.
+type CheckoutOutcome string
+
+const (
+	// CheckoutPaid means the charge succeeded and the order is PAID.
+	CheckoutPaid CheckoutOutcome = "PAID"
+	// CheckoutPendingConfirmation means FastPay did not answer in time and
+	// could not confirm the charge afterwards. The order is PAYMENT_UNKNOWN
+	// until reconciliation settles it.
+	CheckoutPendingConfirmation CheckoutOutcome = "PENDING_CONFIRMATION"
+)
+
+type CheckoutResult struct {
+	OrderID       uuid.UUID
+	OrderStatus   domain.OrderStatus
+	Outcome       CheckoutOutcome
+	PaymentID     uuid.UUID
+	FastPayTxnID  uuid.UUID
+	AmountCharged float64
+	Provider      string
+	// Replayed is true when the result was served from an earlier charge
+	// with the same idempotency key rather than a new one.
+	Replayed bool
+}
+
+var (
+	ErrOrderNotFound   = errors.New("order not found")
+	ErrOrderNotPending = errors.New("order is not in pending state")
+	ErrPaymentFailed   = errors.New("payment failed")
+	ErrOrderNotPaid    = errors.New("order is not paid")
+
+	// another request settled the order first
+	errAlreadySettled = errors.New("order already settled")
+)
+
+const (
+	// bounded CheckStatus polling after an ambiguous Charge error:
+	// 200ms, 400ms, 800ms between the 4 attempts
+	statusCheckAttempts = 4
+	statusCheckBackoff  = 200 * time.Millisecond
+	statusCheckTimeout  = 5 * time.Second
+
+	// writes after a charge outlive the request that made it
+	settleTimeout = 5 * time.Second
+)
+
 type orderService struct {
-	db           *sql.DB
-	orderRepo    repo.OrderRepo
-	paymentRepo  repo.PaymentRepo
-	paymentGtw   payment.PaymentGateway
+	txs         repo.TxManager
+	orderRepo   repo.OrderRepo
+	paymentRepo repo.PaymentRepo
+	router      *payment.Router
+	strategy    Strategy
+	crashHook   CrashHook
+	clock       clock.Clock
+	recorder    timeline.Recorder
+	logger      *slog.Logger
 }
 
 func NewOrderService(
-	db *sql.DB,
+	txs repo.TxManager,
 	orderRepo repo.OrderRepo,
 	paymentRepo repo.PaymentRepo,
-	paymentGtw payment.PaymentGateway,
+	router *payment.Router,
+	opts ...Option,
 ) OrderService {
-	return &orderService{
-		db:          db,
+	s := &orderService{
+		txs:         txs,
 		orderRepo:   orderRepo,
 		paymentRepo: paymentRepo,
-		paymentGtw:  paymentGtw,
+		router:      router,
+		strategy:    StrategyIdempotent,
+		clock:       clock.Real,
+		recorder:    timeline.Nop,
+		logger:      logging.Discard,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *orderService) Checkout(ctx context.Context, orderId uuid.UUID) (*CheckoutResult, error) {
+	ctx, span := tracer.Start(ctx, "OrderService.Checkout")
+	ctx = logging.With(ctx, logging.OrderID, orderId)
+	span.SetAttributes(tracing.OrderID.String(orderId.String()), attribute.String("checkout.strategy", string(s.strategy)))
+	s.recorder.Record(ctx, timeline.Event{Kind: timeline.KindCheckout, OrderID: orderId.String()})
+	result, err := s.checkout(ctx, orderId)
+	e := timeline.Event{Kind: timeline.KindCheckoutResult, OrderID: orderId.String(), Error: errString(err)}
+	if result != nil {
+		e.Detail = string(result.Outcome)
+		e.Provider = result.Provider
+		span.SetAttributes(
+			tracing.Outcome.String(string(result.Outcome)),
+			tracing.Provider.String(result.Provider),
+			tracing.PaymentID.String(result.PaymentID.String()),
+			tracing.GatewayTxn.String(result.FastPayTxnID.String()),
+		)
+	}
+	s.recorder.Record(ctx, e)
+	s.logCheckout(ctx, result, err)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (s *orderService) checkout(ctx context.Context, orderId uuid.UUID) (*CheckoutResult, error) {
+	order, err := s.orderRepo.FindById(ctx, orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+
+	// user clicked Pay again after the order was paid: replay the result
+	if order.Status == domain.OrderPaid {
+		return s.replayPaid(ctx, order)
+	}
+
+	// PAYMENT_UNKNOWN may be retried: the idempotency key stops FastPay
+	// from charging twice
+	if order.Status != domain.OrderPending && order.Status != domain.OrderPaymentUnknown {
+		return nil, ErrOrderNotPending
+	}
+
+	// every provider call carries the order as its merchant reference
+	ctx = payment.WithReference(ctx, order.ID)
+	ctx = logging.With(ctx, logging.IdempotencyKey, order.IdempotencyKey)
+	if s.strategy == StrategyNaive {
+		return s.checkoutNaive(ctx, order)
 	}
+
+	charge, err := s.pay(ctx, order)
+	if errors.Is(err, errAlreadySettled) {
+		return s.replaySettled(ctx, orderId)
+	}
+	if errors.Is(err, ErrCrashed) || errors.Is(err, errNotSent) {
+		return nil, err
+	}
+	if errors.Is(err, payment.ErrGatewayUnavailable) {
+		// nothing was sent to any provider; the order stays as it is
+		return nil, err
+	}
+	// only a charge that may have gone through can be lost to a crash
+	if !payment.IsDefinite(err) {
+		if err := s.crash(ctx, CrashAfterCharge, orderId); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil && !payment.IsDefinite(err) && !errors.Is(err, errUnconfirmed) {
+		// the provider may have charged the card; ask before deciding
+		s.logger.WarnContext(ctx, "ambiguous gateway answer, verifying charge", logging.Provider, order.Provider, "error", err)
+		charge, err = s.verifyCharge(ctx, order)
+		if err != nil {
+			return nil, err
+		}
+		if charge == nil {
+			err = errUnconfirmed
+		}
+	}
+
+	// no answer, or only a hold that was never confirmed captured
+	if errors.Is(err, errUnconfirmed) || (charge != nil && charge.Authorized) {
+		result, err := s.markPaymentUnknown(ctx, order)
+		if errors.Is(err, errAlreadySettled) {
+			return s.replaySettled(ctx, orderId)
+		}
+		return result, err
+	}
+
+	if charge == nil || !charge.Paid {
+		_, err := s.settle(ctx, order, charge, domain.OrderFailed)
+		if errors.Is(err, errAlreadySettled) {
+			return s.replaySettled(ctx, orderId)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrPaymentFailed
+	}
+
+	p, err := s.settle(ctx, order, charge, domain.OrderPaid)
+	if errors.Is(err, errAlreadySettled) {
+		return s.replaySettled(ctx, orderId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.crash(ctx, CrashAfterCommit, orderId); err != nil {
+		return nil, err
+	}
+	return paidResult(order, p, charge.Replayed), nil
+}
+
+// lockUnsettled locks the order row for the rest of the transaction in ctx
+// and returns errAlreadySettled if a concurrent checkout or the worker got
+// there first.
+func (s *orderService) lockUnsettled(ctx context.Context, orderId uuid.UUID) error {
+	current, err := s.orderRepo.FindByIdForUpdate(ctx, orderId)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return ErrOrderNotFound
+	}
+	if current.Status.Settled() {
+		return errAlreadySettled
+	}
+	return nil
 }
 
-func (s *orderService) Checkout(ctx context.Context, orderId uuid.UUID) (string, error) {
+// replaySettled answers a checkout that lost the race to settle the order
+// with whatever the winner decided.
+func (s *orderService) replaySettled(ctx context.Context, orderId uuid.UUID) (*CheckoutResult, error) {
 	order, err := s.orderRepo.FindById(ctx, orderId)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+	if order.Status == domain.OrderPaid {
+		return s.replayPaid(ctx, order)
+	}
+	return nil, ErrPaymentFailed
+}
+
+// send makes call against the order's provider. An order that was already
+// sent somewhere stays with that provider, even if it is down: its first
+// attempt may still be ambiguous. A new order fails over to the next
+// candidate only when the breaker refused the call, i.e. nothing was sent.
+func (s *orderService) send(ctx context.Context, order *domain.Order, call func(payment.PaymentGateway) (*payment.ChargeResult, error)) (*payment.ChargeResult, error) {
+	var candidates []string
+	switch {
+	case order.Provider != "":
+		candidates = []string{order.Provider}
+	case order.Status == domain.OrderPaymentUnknown:
+		// timed out before routing existed, so it went to FastPay
+		candidates = []string{payment.ProviderFastPay}
+	default:
+		candidates = s.router.Candidates(order.Currency, int64(order.Amount), order.IdempotencyKey)
 	}
 
-	if order == nil  {
-		return "", errors.New("order not found")
+	var lastErr error
+	for _, provider := range candidates {
+		gw, err := s.router.Gateway(provider)
+		if err != nil {
+			return nil, notSent(err)
+		}
+		// claimed before every send, so the worker leaves the order alone
+		// while the charge is in flight
+		order.Provider = provider
+		if err := s.assignProvider(ctx, order); err != nil {
+			return nil, notSent(err)
+		}
+
+		if err := s.crash(ctx, CrashBeforeCharge, order.ID); err != nil {
+			return nil, err
+		}
+		s.recorder.Record(ctx, timeline.Event{Kind: timeline.KindChargeSent, OrderID: order.ID.String(), Provider: provider, Detail: string(s.strategy)})
+		charge, err := call(gw)
+		s.recordOutcome(ctx, order, charge, err)
+		if !errors.Is(err, payment.ErrGatewayUnavailable) {
+			return charge, err
+		}
+		lastErr = err
 	}
 
-	if order.Status != domain.OrderPending {
-		return "", errors.New("order is not in pending state")
+	if len(candidates) > 1 {
+		// every provider refused without a call; let the next attempt route afresh
+		order.Provider = ""
+		if err := s.assignProvider(ctx, order); err != nil {
+			return nil, notSent(err)
+		}
 	}
+	return nil, lastErr
+}
 
-	isPaid, err := s.paymentGtw.Charge(ctx, int64(order.Amount), order.IdempotencyKey)
+// assignProvider commits the order's provider before the charge is sent, so
+// verification and reconciliation can find the charge even if this process
+// dies mid-call. Touching updated_at also tells a reconciliation pass that
+// listed the order earlier that it is being worked on. Under
+// StrategyWriteAhead it also commits the PROCESSING payment intent.
+func (s *orderService) assignProvider(ctx context.Context, order *domain.Order) error {
+	return s.txs.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.lockUnsettled(ctx, order.ID); err != nil {
+			return err
+		}
+		order.UpdatedAt = s.clock.Now()
+		if err := s.orderRepo.UpdateOrderProvider(ctx, order); err != nil {
+			return err
+		}
+		if s.strategy == StrategyWriteAhead && order.Provider != "" {
+			return s.writeIntent(ctx, order)
+		}
+		return nil
+	})
+}
+
+// writeIntent makes sure the order has a PROCESSING payment for its
+// current provider. An intent for another provider was never sent (the
+// send failed over), so it is closed as FAILED.
+func (s *orderService) writeIntent(ctx context.Context, order *domain.Order) error {
+	latest, err := s.paymentRepo.FindByOrderId(ctx, order.ID)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if latest != nil && latest.Status == domain.PaymentProcessing {
+		if latest.Provider == order.Provider {
+			return nil
+		}
+		if err := s.paymentRepo.UpdatePaymentStatus(ctx, latest.ID, domain.PaymentFailed, uuid.Nil); err != nil {
+			return err
+		}
 	}
 
-	if !isPaid {
-		return "", errors.New("payment failed")
+	return s.paymentRepo.CreatePayment(ctx, &domain.Payment{
+		ID:        uuid.New(),
+		OrderID:   order.ID,
+		Amount:    order.Amount,
+		Status:    domain.PaymentProcessing,
+		CreatedAt: order.UpdatedAt,
+		UpdatedAt: order.UpdatedAt,
+		Provider:  order.Provider,
+	})
+}
+
+// verifyCharge polls CheckStatus with exponential backoff after an
+// ambiguous Charge error. It returns nil if FastPay still has no record of
+// the charge once the attempts are used up.
+func (s *orderService) verifyCharge(ctx context.Context, order *domain.Order) (*payment.ChargeResult, error) {
+	// the request context may be what timed out; verification gets its own
+	ctx, cancel := clock.WithTimeout(context.WithoutCancel(ctx), s.clock, statusCheckTimeout)
+	defer cancel()
+
+	gw, err := s.router.Gateway(order.Provider)
+	if err != nil {
+		return nil, err
 	}
 
-	tx, err := s.db.BeginTx(ctx, nil)
+	backoff := statusCheckBackoff
+	for attempt := 1; ; attempt++ {
+		charge, err := gw.CheckStatus(ctx, order.IdempotencyKey)
+		if err == nil && charge != nil {
+			return charge, nil
+		}
+		if attempt == statusCheckAttempts {
+			return nil, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-s.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// detach gives the writes after a charge a context of their own. The
+// provider may have taken the money, so its answer must be saved even if
+// the client has given up on the request.
+func (s *orderService) detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	return clock.WithTimeout(context.WithoutCancel(ctx), s.clock, settleTimeout)
+}
+
+func (s *orderService) markPaymentUnknown(ctx context.Context, order *domain.Order) (*CheckoutResult, error) {
+	ctx, cancel := s.detach(ctx)
+	defer cancel()
+
+	err := s.txs.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.lockUnsettled(ctx, order.ID); err != nil {
+			return err
+		}
+		order.Status = domain.OrderPaymentUnknown
+		order.UpdatedAt = s.clock.Now()
+		return s.orderRepo.UpdateOrderStatus(ctx, order)
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	s.recordCommit(ctx, order)
+
+	return &CheckoutResult{
+		OrderID:     order.ID,
+		OrderStatus: order.Status,
+		Outcome:     CheckoutPendingConfirmation,
+		Provider:    order.Provider,
+	}, nil
+}
 
-	defer tx.Rollback()
-	order.Status = domain.OrderPaid
+// settle moves the order to its final status and records the provider's
+// answer as a payment row in the same transaction. The payment is nil when
+// there was no charge to record.
+func (s *orderService) settle(ctx context.Context, order *domain.Order, charge *payment.ChargeResult, status domain.OrderStatus) (*domain.Payment, error) {
+	ctx, cancel := s.detach(ctx)
+	defer cancel()
 
-	// update order status
-	err = s.orderRepo.UpdateOrderStatus(ctx, tx, order)
+	var p *domain.Payment
+	err := s.txs.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.lockUnsettled(ctx, order.ID); err != nil {
+			return err
+		}
+		order.Status = status
+		order.UpdatedAt = s.clock.Now()
+
+		// update order status
+		if err := s.orderRepo.UpdateOrderStatus(ctx, order); err != nil {
+			return err
+		}
+
+		var err error
+		p, err = RecordPayment(ctx, s.paymentRepo, order, charge)
+		if err != nil {
+			return err
+		}
+
+		// the rollback is what a dropped connection would do
+		return s.crash(ctx, CrashBeforeCommit, order.ID)
+	})
 	if err != nil {
-		defer tx.Rollback()
-		return "", err
+		return nil, err
 	}
+	s.recordCommit(ctx, order)
+	return p, nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return "", err
+func (s *orderService) replayPaid(ctx context.Context, order *domain.Order) (*CheckoutResult, error) {
+	p, err := s.paymentRepo.FindByOrderId(ctx, order.ID)
+	if err != nil {
+		return nil, err
 	}
+	if p == nil {
+		// paid by reconciliation before it recorded payment rows
+		return &CheckoutResult{
+			OrderID:     order.ID,
+			OrderStatus: order.Status,
+			Outcome:     CheckoutPaid,
+			Provider:    order.Provider,
+			Replayed:    true,
+		}, nil
+	}
+	return paidResult(order, p, true), nil
+}
 
-	return "", nil
+func paidResult(order *domain.Order, p *domain.Payment, replayed bool) *CheckoutResult {
+	return &CheckoutResult{
+		OrderID:       order.ID,
+		OrderStatus:   order.Status,
+		Outcome:       CheckoutPaid,
+		Provider:      p.Provider,
+		PaymentID:     p.ID,
+		FastPayTxnID:  p.FastPayTxn,
+		AmountCharged: p.Amount,
+		Replayed:      replayed,
+	}
 }
 
 func (os *orderService) CreateOrder(ctx context.Context) (*domain.Order, error) {
 	order := &domain.Order{
-		ID:           uuid.New(),
-		Amount:       rand.Float64() * 10000,
-		UserID:       uuid.New(),
+		ID:             uuid.New(),
+		Amount:         rand.Float64() * 10000,
+		UserID:         uuid.New(),
 		IdempotencyKey: uuid.New(),
-		Status:       domain.OrderPending,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		Currency:       domain.DefaultCurrency,
+		Status:         domain.OrderPending,
+		CreatedAt:      os.clock.Now(),
+		UpdatedAt:      os.clock.Now(),
+	}
+
+	// save order
+	if err := os.orderRepo.CreateOrder(ctx, order); err != nil {
+		return nil, err
 	}
+	os.recorder.Record(ctx, timeline.Event{Kind: timeline.KindOrderCreated, OrderID: order.ID.String()})
+	os.logger.InfoContext(ctx, "order created", logging.OrderID, order.ID, logging.IdempotencyKey, order.IdempotencyKey, "amount", order.Amount)
 
-	tx, err := os.db.BeginTx(ctx, nil)
+	return order, nil
+}
+
+func (s *orderService) GetOrder(ctx context.Context, orderId uuid.UUID) (*domain.Order, error) {
+	order, err := s.orderRepo.FindById(ctx, orderId)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
-	// save order
-	err = os.orderRepo.CreateOrder(ctx, tx, order)
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+	return order, nil
+}
+
+func (s *orderService) Refund(ctx context.Context, orderId uuid.UUID) (*payment.ChargeResult, error) {
+	order, err := s.GetOrder(ctx, orderId)
 	if err != nil {
 		return nil, err
 	}
+	if order.Status != domain.OrderPaid {
+		return nil, ErrOrderNotPaid
+	}
+	return s.router.Refund(ctx, order.Provider, order.IdempotencyKey)
+}
 
-	if err := tx.Commit(); err != nil {
+// RecordPayment writes the provider's answer for a settled order in the
+// transaction ctx carries: it closes the order's PROCESSING intent if there
+// is one, or adds a new payment row. It returns nil when there is neither a
+// charge nor an intent. The order must already carry its final status.
+func RecordPayment(ctx context.Context, paymentRepo repo.PaymentRepo, order *domain.Order, charge *payment.ChargeResult) (*domain.Payment, error) {
+	status := domain.PaymentFailed
+	if order.Status == domain.OrderPaid {
+		status = domain.PaymentSucceeded
+	}
+	var txnId uuid.UUID
+	if charge != nil {
+		txnId = charge.TxnID
+	}
+
+	intent, err := paymentRepo.FindByOrderId(ctx, order.ID)
+	if err != nil {
 		return nil, err
 	}
+	if intent != nil && intent.Status == domain.PaymentProcessing {
+		if err := paymentRepo.UpdatePaymentStatus(ctx, intent.ID, status, txnId); err != nil {
+			return nil, err
+		}
+		intent.Status = status
+		intent.FastPayTxn = txnId
+		intent.UpdatedAt = order.UpdatedAt
+		return intent, nil
+	}
 
-	return order, nil
-}
\ No newline at end of file
+	if charge == nil {
+		return nil, nil
+	}
+	p := &domain.Payment{
+		ID:         uuid.New(),
+		OrderID:    order.ID,
+		Amount:     order.Amount,
+		Status:     status,
+		FastPayTxn: txnId,
+		CreatedAt:  order.UpdatedAt,
+		UpdatedAt:  order.UpdatedAt,
+		Provider:   order.Provider,
+	}
+	if err := paymentRepo.CreatePayment(ctx, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
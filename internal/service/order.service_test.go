@@ -0,0 +1,500 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/logging"
+	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/repo/memory"
+	"the-phantom-charge/internal/service"
+
+	"github.com/google/uuid"
+)
+
+// stubGateway is an idempotent FastPay that charges every new key. When
+// loseNext is set it takes the money but loses the answer, once. While
+// unconfirmed is set CheckStatus has no record of any charge.
+type stubGateway struct {
+	mu          sync.Mutex
+	charges     map[uuid.UUID]payment.ChargeResult
+	keys        []uuid.UUID
+	loseNext    bool
+	unconfirmed bool
+}
+
+func newStubGateway() *stubGateway {
+	return &stubGateway{charges: make(map[uuid.UUID]payment.ChargeResult)}
+}
+
+func (g *stubGateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.keys = append(g.keys, idempotencyKey)
+	res, exists := g.charges[idempotencyKey]
+	if exists {
+		res.Replayed = true
+		return &res, nil
+	}
+	res = payment.ChargeResult{TxnID: uuid.New(), Amount: amount, Paid: true}
+	g.charges[idempotencyKey] = res
+	if g.loseNext {
+		g.loseNext = false
+		return nil, payment.ErrConnectionTimeout
+	}
+	return &res, nil
+}
+
+func (g *stubGateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.unconfirmed {
+		return nil, nil
+	}
+	if res, exists := g.charges[idempotencyKey]; exists {
+		return &res, nil
+	}
+	return nil, nil
+}
+
+func (g *stubGateway) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	panic("the idempotent strategy does not authorize")
+}
+
+func (g *stubGateway) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	panic("the idempotent strategy does not capture")
+}
+
+func (g *stubGateway) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	panic("checkout does not refund")
+}
+
+type fixture struct {
+	payments repo.PaymentRepo
+	ledger   payment.Ledger
+	service  service.OrderService
+}
+
+// newFixture wires the service to an in-memory store and a single mock
+// FastPay answering according to cfg.
+func newFixture(cfg payment.MockConfig, opts ...service.Option) fixture {
+	return newGatewayFixture(payment.NewMockGateway(cfg, 1), opts...)
+}
+
+// newGatewayFixture is newFixture with gw as the only provider. The ledger
+// is nil unless gw keeps one.
+func newGatewayFixture(gw payment.PaymentGateway, opts ...service.Option) fixture {
+	registry := payment.NewRegistry()
+	registry.Register(payment.ProviderFastPay, gw, nil)
+	router := payment.NewRouter(registry)
+
+	store := memory.NewStore(nil)
+	paymentRepo := memory.NewPaymentRepo(store)
+	ledger, _ := gw.(payment.Ledger)
+	txs := repo.NewTxManager(store)
+	return fixture{
+		payments: paymentRepo,
+		ledger:   ledger,
+		service:  service.NewOrderService(txs, memory.NewOrderRepo(store), paymentRepo, router, opts...),
+	}
+}
+
+func (f fixture) order(t *testing.T) *domain.Order {
+	t.Helper()
+	order, err := f.service.CreateOrder(context.Background())
+	if err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+	return order
+}
+
+func (f fixture) status(t *testing.T, id uuid.UUID) domain.OrderStatus {
+	t.Helper()
+	order, err := f.service.GetOrder(context.Background(), id)
+	if err != nil {
+		t.Fatalf("get order: %v", err)
+	}
+	return order.Status
+}
+
+func (f fixture) succeeded(t *testing.T, id uuid.UUID) int {
+	t.Helper()
+	payments, err := f.payments.ListByOrderId(context.Background(), id)
+	if err != nil {
+		t.Fatalf("list payments: %v", err)
+	}
+	n := 0
+	for _, p := range payments {
+		if p.Status == domain.PaymentSucceeded {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCheckoutPaid(t *testing.T) {
+	for _, strategy := range service.Strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			f := newFixture(payment.MockConfig{}, service.WithStrategy(strategy))
+			order := f.order(t)
+
+			result, err := f.service.Checkout(context.Background(), order.ID)
+			if err != nil {
+				t.Fatalf("checkout: %v", err)
+			}
+			if result.Outcome != service.CheckoutPaid || result.AmountCharged != order.Amount {
+				t.Fatalf("result = %+v", *result)
+			}
+			if got := f.status(t, order.ID); got != domain.OrderPaid {
+				t.Fatalf("status = %s, want %s", got, domain.OrderPaid)
+			}
+			if n := f.succeeded(t, order.ID); n != 1 {
+				t.Fatalf("%d succeeded payments, want 1", n)
+			}
+			if n := len(f.ledger.Ledger()); n != 1 {
+				t.Fatalf("%d captures, want 1", n)
+			}
+		})
+	}
+}
+
+func TestCheckoutDeclined(t *testing.T) {
+	f := newFixture(payment.MockConfig{DeclineRate: 1})
+	order := f.order(t)
+
+	if _, err := f.service.Checkout(context.Background(), order.ID); !errors.Is(err, service.ErrPaymentFailed) {
+		t.Fatalf("err = %v, want %v", err, service.ErrPaymentFailed)
+	}
+	if got := f.status(t, order.ID); got != domain.OrderFailed {
+		t.Fatalf("status = %s, want %s", got, domain.OrderFailed)
+	}
+	if _, err := f.service.Checkout(context.Background(), order.ID); !errors.Is(err, service.ErrOrderNotPending) {
+		t.Fatalf("second checkout err = %v, want %v", err, service.ErrOrderNotPending)
+	}
+}
+
+// TestCheckoutLostResponse charges the card but loses the answer: the
+// status check afterwards finds the charge and the order is paid.
+func TestCheckoutLostResponse(t *testing.T) {
+	f := newFixture(payment.MockConfig{TimeoutRate: 1})
+	order := f.order(t)
+
+	result, err := f.service.Checkout(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+	if result.Outcome != service.CheckoutPaid {
+		t.Fatalf("outcome = %s, want %s", result.Outcome, service.CheckoutPaid)
+	}
+	if n := f.succeeded(t, order.ID); n != 1 {
+		t.Fatalf("%d succeeded payments, want 1", n)
+	}
+}
+
+// TestCheckoutClientGivesUp has the client hang up while FastPay, which
+// took the money, is still hanging. The outcome must still be written:
+// the order ends PAID or PAYMENT_UNKNOWN, never a PENDING ghost.
+func TestCheckoutClientGivesUp(t *testing.T) {
+	f := newFixture(payment.MockConfig{TimeoutRate: 1, TimeoutLatency: 2 * time.Second})
+	order := f.order(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := f.service.Checkout(ctx, order.ID); err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+
+	switch got := f.status(t, order.ID); got {
+	case domain.OrderPaid:
+		if n := f.succeeded(t, order.ID); n != 1 {
+			t.Fatalf("%d succeeded payments, want 1", n)
+		}
+	case domain.OrderPaymentUnknown:
+	default:
+		t.Fatalf("status = %s, want %s or %s", got, domain.OrderPaid, domain.OrderPaymentUnknown)
+	}
+}
+
+// TestCheckoutLogsOrderHistory checks that one order's lines, including
+// the mock provider's, can all be found by its order ID.
+func TestCheckoutLogsOrderHistory(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New(&buf, slog.LevelInfo)
+	f := newFixture(payment.MockConfig{TimeoutRate: 1, Logger: logger}, service.WithLogger(logger))
+	order := f.order(t)
+
+	result, err := f.service.Checkout(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+
+	var msgs []string
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line map[string]any
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Fatalf("not JSON: %q", l)
+		}
+		if line[logging.OrderID] != order.ID.String() {
+			t.Errorf("line without the order ID: %s", l)
+		}
+		if line["msg"] == "checkout finished" && (line[logging.PaymentID] != result.PaymentID.String() || line[logging.GatewayTxn] != result.FastPayTxnID.String()) {
+			t.Errorf("result line: %s", l)
+		}
+		msgs = append(msgs, line["msg"].(string))
+	}
+	want := []string{"order created", "mock FastPay charged money, response lost", "ambiguous gateway answer, verifying charge", "order status saved", "checkout finished"}
+	if !slices.Equal(msgs, want) {
+		t.Errorf("logged %q, want %q", msgs, want)
+	}
+}
+
+func TestCheckoutDoubleClick(t *testing.T) {
+	f := newFixture(payment.MockConfig{})
+	order := f.order(t)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := f.service.Checkout(context.Background(), order.ID)
+			if err != nil {
+				t.Errorf("checkout: %v", err)
+				return
+			}
+			if result.Outcome != service.CheckoutPaid {
+				t.Errorf("outcome = %s, want %s", result.Outcome, service.CheckoutPaid)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(f.ledger.Ledger()); n != 1 {
+		t.Fatalf("%d captures, want 1", n)
+	}
+	if n := f.succeeded(t, order.ID); n != 1 {
+		t.Fatalf("%d succeeded payments, want 1", n)
+	}
+}
+
+func TestCheckoutCrashBeforeCommit(t *testing.T) {
+	f := newFixture(payment.MockConfig{}, service.WithCrashHook(func(point service.CrashPoint, _ uuid.UUID) bool {
+		return point == service.CrashBeforeCommit
+	}))
+	order := f.order(t)
+
+	if _, err := f.service.Checkout(context.Background(), order.ID); !errors.Is(err, service.ErrCrashed) {
+		t.Fatalf("err = %v, want %v", err, service.ErrCrashed)
+	}
+	// charged, but nothing committed: left for reconciliation
+	if got := f.status(t, order.ID); got.Settled() {
+		t.Fatalf("status = %s, want unsettled", got)
+	}
+	if n := f.succeeded(t, order.ID); n != 0 {
+		t.Fatalf("%d succeeded payments, want 0", n)
+	}
+	if n := len(f.ledger.Ledger()); n != 1 {
+		t.Fatalf("%d captures, want 1", n)
+	}
+}
+
+// TestCheckoutDeclinedDoesNotCrashAfterCharge declines the card with the
+// after-charge crash armed. No charge went through, so there is nothing to
+// crash after: the order fails as usual.
+func TestCheckoutDeclinedDoesNotCrashAfterCharge(t *testing.T) {
+	f := newFixture(payment.MockConfig{DeclineRate: 1}, service.WithCrashHook(func(point service.CrashPoint, _ uuid.UUID) bool {
+		return point == service.CrashAfterCharge
+	}))
+	order := f.order(t)
+
+	if _, err := f.service.Checkout(context.Background(), order.ID); !errors.Is(err, service.ErrPaymentFailed) {
+		t.Fatalf("err = %v, want %v", err, service.ErrPaymentFailed)
+	}
+	if got := f.status(t, order.ID); got != domain.OrderFailed {
+		t.Fatalf("status = %s, want %s", got, domain.OrderFailed)
+	}
+}
+
+// providerlessRepo can't record which provider an order goes to.
+type providerlessRepo struct {
+	repo.OrderRepo
+}
+
+var errDatabaseDown = errors.New("database is down")
+
+func (providerlessRepo) UpdateOrderProvider(ctx context.Context, order *domain.Order) error {
+	return errDatabaseDown
+}
+
+// TestCheckoutFailsBeforeSending fails to claim the order before the
+// charge. Nothing was sent, so there is nothing to verify: the error comes
+// straight back and the order stays PENDING, not PAYMENT_UNKNOWN.
+func TestCheckoutFailsBeforeSending(t *testing.T) {
+	ctx := context.Background()
+	gw := newStubGateway()
+	registry := payment.NewRegistry()
+	registry.Register(payment.ProviderFastPay, gw, nil)
+	store := memory.NewStore(nil)
+	orderRepo := memory.NewOrderRepo(store)
+	var crashes []service.CrashPoint
+	svc := service.NewOrderService(repo.NewTxManager(store), providerlessRepo{orderRepo}, memory.NewPaymentRepo(store), payment.NewRouter(registry),
+		service.WithCrashHook(func(point service.CrashPoint, _ uuid.UUID) bool {
+			crashes = append(crashes, point)
+			return false
+		}))
+
+	order, err := svc.CreateOrder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Checkout(ctx, order.ID); !errors.Is(err, errDatabaseDown) {
+		t.Fatalf("err = %v, want %v", err, errDatabaseDown)
+	}
+	got, err := orderRepo.FindById(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != domain.OrderPending {
+		t.Fatalf("status = %s, want %s", got.Status, domain.OrderPending)
+	}
+	if len(gw.keys) != 0 || len(crashes) != 0 {
+		t.Fatalf("sent %d charges and reached crash points %v, want none", len(gw.keys), crashes)
+	}
+}
+
+// TestCheckoutUnconfirmedCharge loses the answer and FastPay can't confirm
+// the charge before verification gives up. The order is PAYMENT_UNKNOWN,
+// never FAILED, since the card may have been charged.
+func TestCheckoutUnconfirmedCharge(t *testing.T) {
+	gw := newStubGateway()
+	gw.loseNext = true
+	gw.unconfirmed = true
+	f := newGatewayFixture(gw)
+	order := f.order(t)
+
+	result, err := f.service.Checkout(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+	if result.Outcome != service.CheckoutPendingConfirmation {
+		t.Fatalf("outcome = %s, want %s", result.Outcome, service.CheckoutPendingConfirmation)
+	}
+	if got := f.status(t, order.ID); got != domain.OrderPaymentUnknown {
+		t.Fatalf("status = %s, want %s", got, domain.OrderPaymentUnknown)
+	}
+	if n := f.succeeded(t, order.ID); n != 0 {
+		t.Fatalf("%d succeeded payments, want 0", n)
+	}
+}
+
+// TestCheckoutRetryReusesIdempotencyKey loses FastPay's answer to the
+// first checkout and leaves the order PAYMENT_UNKNOWN. The retry sends the
+// order's key again, so FastPay replays the charge it already took instead
+// of charging twice, and a click after that replays the saved payment.
+func TestCheckoutRetryReusesIdempotencyKey(t *testing.T) {
+	gw := newStubGateway()
+	gw.loseNext = true
+	gw.unconfirmed = true
+	f := newGatewayFixture(gw)
+	order := f.order(t)
+
+	first, err := f.service.Checkout(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("first checkout: %v", err)
+	}
+	if first.Outcome != service.CheckoutPendingConfirmation {
+		t.Fatalf("first outcome = %s, want %s", first.Outcome, service.CheckoutPendingConfirmation)
+	}
+	gw.unconfirmed = false
+
+	retry, err := f.service.Checkout(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if retry.Outcome != service.CheckoutPaid || !retry.Replayed {
+		t.Fatalf("retry = %+v, want a replayed PAID", *retry)
+	}
+	if len(gw.keys) != 2 || gw.keys[0] != order.IdempotencyKey || gw.keys[1] != order.IdempotencyKey {
+		t.Fatalf("keys sent = %v, want the order's key twice", gw.keys)
+	}
+	if len(gw.charges) != 1 {
+		t.Fatalf("%d charges, want 1", len(gw.charges))
+	}
+
+	again, err := f.service.Checkout(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("click after paid: %v", err)
+	}
+	if again.PaymentID != retry.PaymentID || !again.Replayed || len(gw.keys) != 2 {
+		t.Fatalf("click after paid = %+v, want the saved payment without a call", *again)
+	}
+	if n := f.succeeded(t, order.ID); n != 1 {
+		t.Fatalf("%d succeeded payments, want 1", n)
+	}
+}
+
+// downForRefunds is a provider that takes charges but can't refund.
+type downForRefunds struct {
+	payment.PaymentGateway
+}
+
+func (g downForRefunds) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	return nil, payment.ErrGatewayUnavailable
+}
+
+// TestRefundStaysWithItsProvider refunds an order whose provider is down
+// while another one is up. The refund fails; it is never sent elsewhere.
+func TestRefundStaysWithItsProvider(t *testing.T) {
+	ctx := context.Background()
+	fastPay := payment.NewMockGateway(payment.MockConfig{}, 1)
+	altPay := payment.NewMockGateway(payment.MockConfig{}, 2)
+	registry := payment.NewRegistry()
+	registry.Register(payment.ProviderFastPay, downForRefunds{fastPay}, nil)
+	registry.Register("altpay", altPay, nil)
+
+	store := memory.NewStore(nil)
+	svc := service.NewOrderService(repo.NewTxManager(store), memory.NewOrderRepo(store), memory.NewPaymentRepo(store), payment.NewRouter(registry))
+	order, err := svc.CreateOrder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Refund(ctx, order.ID); !errors.Is(err, service.ErrOrderNotPaid) {
+		t.Fatalf("refund before checkout err = %v, want %v", err, service.ErrOrderNotPaid)
+	}
+	if _, err := svc.Checkout(ctx, order.ID); err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+
+	if _, err := svc.Refund(ctx, order.ID); !errors.Is(err, payment.ErrGatewayUnavailable) {
+		t.Fatalf("refund err = %v, want %v", err, payment.ErrGatewayUnavailable)
+	}
+	if n := len(altPay.(payment.Ledger).Ledger()); n != 0 {
+		t.Fatalf("altpay captured %d charges, want none", n)
+	}
+}
+
+func TestRefundPaidOrder(t *testing.T) {
+	f := newFixture(payment.MockConfig{})
+	order := f.order(t)
+	if _, err := f.service.Checkout(context.Background(), order.ID); err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+
+	res, err := f.service.Refund(context.Background(), order.ID)
+	if err != nil || !res.Refunded {
+		t.Fatalf("refund: got %+v, %v", res, err)
+	}
+	if ledger := f.ledger.Ledger(); len(ledger) != 1 || ledger[0].RefundedAt.IsZero() {
+		t.Fatalf("expected one refunded capture, got %+v", ledger)
+	}
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/timeline"
+
+	"github.com/google/uuid"
+)
+
+// Strategy is how Checkout talks to the payment provider. Only
+// StrategyIdempotent and the stricter ones are safe; the naive one exists
+// to show what goes wrong without them.
+type Strategy string
+
+const (
+	// StrategyNaive charges with a fresh key on every attempt and trusts the
+	// first answer, as the original checkout did.
+	StrategyNaive Strategy = "naive"
+	// StrategyIdempotent charges with the order's idempotency key and
+	// verifies ambiguous answers.
+	StrategyIdempotent Strategy = "idempotent"
+	// StrategyWriteAhead is StrategyIdempotent plus a PROCESSING payment
+	// row committed before the charge is sent.
+	StrategyWriteAhead Strategy = "write-ahead"
+	// StrategyAuthCapture holds the money first and captures it in a
+	// second call; a lost authorization moves no money.
+	StrategyAuthCapture Strategy = "auth-capture"
+)
+
+var Strategies = []Strategy{StrategyNaive, StrategyIdempotent, StrategyWriteAhead, StrategyAuthCapture}
+
+type Option func(*orderService)
+
+// WithClock sets the clock used for timestamps and status-check backoff.
+// The default is the wall clock.
+func WithClock(c clock.Clock) Option {
+	return func(s *orderService) {
+		s.clock = c
+	}
+}
+
+// WithStrategy picks the checkout strategy. The default is
+// StrategyIdempotent.
+func WithStrategy(strategy Strategy) Option {
+	return func(s *orderService) {
+		s.strategy = strategy
+	}
+}
+
+// errUnconfirmed: the provider's answer was lost and verification found
+// nothing conclusive.
+var errUnconfirmed = errors.New("payment unconfirmed")
+
+// errNotSent wraps a failure before any provider was called: there is no
+// charge to verify, and the order stays as it is.
+var errNotSent = errors.New("payment not sent")
+
+func notSent(err error) error {
+	return fmt.Errorf("%w: %w", errNotSent, err)
+}
+
+// pay sends the order's payment with the configured strategy.
+func (s *orderService) pay(ctx context.Context, order *domain.Order) (*payment.ChargeResult, error) {
+	if s.strategy == StrategyAuthCapture {
+		return s.authorizeAndCapture(ctx, order)
+	}
+	return s.send(ctx, order, func(gw payment.PaymentGateway) (*payment.ChargeResult, error) {
+		return gw.Charge(ctx, int64(order.Amount), order.IdempotencyKey)
+	})
+}
+
+// authorizeAndCapture holds the amount, then captures it. An ambiguous
+// authorization is verified here; an ambiguous capture is left to Checkout.
+func (s *orderService) authorizeAndCapture(ctx context.Context, order *domain.Order) (*payment.ChargeResult, error) {
+	auth, err := s.send(ctx, order, func(gw payment.PaymentGateway) (*payment.ChargeResult, error) {
+		return gw.Authorize(ctx, int64(order.Amount), order.IdempotencyKey)
+	})
+	if errors.Is(err, payment.ErrGatewayUnavailable) || errors.Is(err, errAlreadySettled) ||
+		errors.Is(err, ErrCrashed) || errors.Is(err, errNotSent) || payment.IsDefinite(err) {
+		return auth, err
+	}
+	if err != nil {
+		auth, err = s.verifyCharge(ctx, order)
+		if err != nil {
+			return nil, err
+		}
+		if auth == nil {
+			return nil, errUnconfirmed
+		}
+	}
+	// declined, or captured by an earlier attempt
+	if !auth.Authorized {
+		return auth, nil
+	}
+
+	gw, err := s.router.Gateway(order.Provider)
+	if err != nil {
+		return nil, notSent(err)
+	}
+	s.recorder.Record(ctx, timeline.Event{Kind: timeline.KindChargeSent, OrderID: order.ID.String(), Provider: order.Provider, Detail: "capture"})
+	charge, err := gw.Capture(ctx, order.IdempotencyKey)
+	s.recordOutcome(ctx, order, charge, err)
+	return charge, err
+}
+
+// checkoutNaive is the checkout from before the phantom charge fix: a new
+// key per attempt, so every retry or second click is a new charge, and a
+// lost response leaves the order PENDING with nothing to look it up by.
+func (s *orderService) checkoutNaive(ctx context.Context, order *domain.Order) (*CheckoutResult, error) {
+	charge, err := s.send(ctx, order, func(gw payment.PaymentGateway) (*payment.ChargeResult, error) {
+		return gw.Charge(ctx, int64(order.Amount), uuid.New())
+	})
+	if errors.Is(err, errAlreadySettled) {
+		return s.replaySettled(ctx, order.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.crash(ctx, CrashAfterCharge, order.ID); err != nil {
+		return nil, err
+	}
+
+	p, err := s.settle(ctx, order, charge, domain.OrderPaid)
+	if errors.Is(err, errAlreadySettled) {
+		return s.replaySettled(ctx, order.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.crash(ctx, CrashAfterCommit, order.ID); err != nil {
+		return nil, err
+	}
+	return paidResult(order, p, charge.Replayed), nil
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/timeline"
+)
+
+// WithRecorder records checkout events (charges sent, provider answers,
+// commits) to rec. The default drops them.
+func WithRecorder(rec timeline.Recorder) Option {
+	return func(s *orderService) {
+		s.recorder = rec
+	}
+}
+
+func (s *orderService) recordOutcome(ctx context.Context, order *domain.Order, charge *payment.ChargeResult, err error) {
+	s.recorder.Record(ctx, timeline.Event{
+		Kind:     timeline.KindGatewayOutcome,
+		OrderID:  order.ID.String(),
+		Provider: order.Provider,
+		Detail:   chargeState(charge),
+		Error:    errString(err),
+	})
+}
+
+func (s *orderService) recordCommit(ctx context.Context, order *domain.Order) {
+	s.recorder.Record(ctx, timeline.Event{
+		Kind:     timeline.KindCommit,
+		OrderID:  order.ID.String(),
+		Provider: order.Provider,
+		Detail:   string(order.Status),
+	})
+	s.logCommit(ctx, order)
+}
+
+// chargeState describes a provider answer for the timeline.
+func chargeState(charge *payment.ChargeResult) string {
+	switch {
+	case charge == nil:
+		return ""
+	case charge.Paid:
+		return "paid"
+	case charge.Authorized:
+		return "authorized"
+	default:
+		return "declined"
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
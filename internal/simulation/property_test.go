@@ -0,0 +1,245 @@
+package simulation_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/repo/memory"
+	"the-phantom-charge/internal/service"
+	"the-phantom-charge/internal/simulation"
+	"the-phantom-charge/internal/timeline"
+	"the-phantom-charge/internal/worker"
+
+	"github.com/google/uuid"
+)
+
+// safeStrategies are the strategies that must never lose or double a
+// charge. The naive one is expected to.
+var safeStrategies = []service.Strategy{
+	service.StrategyIdempotent,
+	service.StrategyWriteAhead,
+	service.StrategyAuthCapture,
+}
+
+// TestCheckoutInvariants runs random interleavings of checkouts, double
+// clicks, gateway faults, crashes and reconciliation passes against the
+// in-memory repos, then heals the network and reconciles until nothing is
+// left pending. Whatever happened on the way, every capture must belong to
+// exactly one PAID order with the same amount, and every PAID order to
+// exactly one capture.
+func TestCheckoutInvariants(t *testing.T) {
+	count := 20
+	if testing.Short() {
+		count = 5
+	}
+	for _, strategy := range safeStrategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			property := func(seed uint64) bool {
+				report, events := runSchedule(t, strategy, seed)
+				if report.Violations() == 0 && len(report.StillPending) == 0 {
+					return true
+				}
+				t.Logf("seed %d: ghost=%v phantom=%v duplicate_charges=%v duplicate_payments=%v amount=%v unmatched=%v pending=%v",
+					seed, report.GhostOrders, report.PhantomPaid, report.DuplicateCharges,
+					report.DuplicatePayments, report.AmountMismatches, report.UnmatchedCaptures, report.StillPending)
+				logTimeline(t, events, report)
+				return false
+			}
+			if err := quick.Check(property, &quick.Config{MaxCount: count}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// lockedRand is a rand.Rand safe for the concurrent checkouts.
+type lockedRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Float64()
+}
+
+func (r *lockedRand) IntN(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.IntN(n)
+}
+
+// logTimeline logs what happened to every order that broke an invariant.
+func logTimeline(t *testing.T, events []timeline.Event, report simulation.Report) {
+	broken := make(map[string]bool)
+	for _, ids := range [][]uuid.UUID{report.GhostOrders, report.PhantomPaid, report.DuplicateCharges,
+		report.DuplicatePayments, report.AmountMismatches, report.StillPending} {
+		for _, id := range ids {
+			broken[id.String()] = true
+		}
+	}
+	for _, e := range events {
+		if broken[e.OrderID] {
+			t.Logf("%s %-10s %-18s %-8s %s %s", e.Time.Format("15:04:05.000"), e.Correlation, e.Kind, e.Provider, e.Detail, e.Error)
+		}
+	}
+}
+
+// runSchedule plays one random schedule derived from seed and returns the
+// end state along with the timeline of the run.
+func runSchedule(t *testing.T, strategy service.Strategy, seed uint64) (simulation.Report, []timeline.Event) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rng := &lockedRand{rng: rand.New(rand.NewPCG(seed, seed))}
+
+	// the status checks after a lost response wait on the clock; run it
+	// fast enough that they don't hold up the schedule
+	fake := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	go func() {
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fake.Advance(50 * time.Millisecond)
+			}
+		}
+	}()
+
+	registry := payment.NewRegistry()
+	var ledgers []payment.Ledger
+	var chaoses []*payment.Chaos
+	for i, provider := range []string{payment.ProviderFastPay, "altpay"} {
+		mock := payment.NewMockGateway(payment.MockConfig{
+			DeclineRate: 0.2 * rng.Float64(),
+			TimeoutRate: 0.3 * rng.Float64(),
+			Clock:       fake,
+		}, seed+uint64(i)+1)
+		ledgers = append(ledgers, mock.(payment.Ledger))
+		chaos := payment.NewChaos(mock, payment.ChaosConfig{
+			Enabled:                 true,
+			DropResponseProbability: 0.2 * rng.Float64(),
+			ErrorProbability:        0.2 * rng.Float64(),
+			DuplicateProbability:    0.2 * rng.Float64(),
+		}, seed+uint64(i)+100, fake)
+		chaoses = append(chaoses, chaos)
+		registry.Register(provider, payment.WithRetry(chaos, payment.RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    2 * time.Millisecond,
+		}), nil)
+	}
+	router := payment.NewRouter(registry, payment.Rule{
+		Providers: []payment.WeightedProvider{
+			{Name: payment.ProviderFastPay, Weight: 80},
+			{Name: "altpay", Weight: 20},
+		},
+	})
+
+	store := memory.NewStore(fake)
+	orderRepo := memory.NewOrderRepo(store)
+	paymentRepo := memory.NewPaymentRepo(store)
+	txs := repo.NewTxManager(store)
+	var recorded bytes.Buffer
+	recorder := timeline.NewWriter(&recorded, fake)
+	crashRate := 0.3 * rng.Float64()
+	svc := service.NewOrderService(txs, orderRepo, paymentRepo, router,
+		service.WithClock(fake),
+		service.WithStrategy(strategy),
+		service.WithRecorder(recorder),
+		service.WithCrashHook(func(service.CrashPoint, uuid.UUID) bool {
+			return rng.Float64() < crashRate
+		}),
+	)
+	reconciler := worker.NewReconciliationWorker(txs, orderRepo, paymentRepo, router, fake, time.Second, worker.DefaultStuckAfter,
+		worker.WithRecorder(recorder))
+
+	var orders []uuid.UUID
+	for range 1 + rng.IntN(8) {
+		order, err := svc.CreateOrder(ctx)
+		if err != nil {
+			t.Fatalf("create order: %v", err)
+		}
+		orders = append(orders, order.ID)
+	}
+
+	// each step clicks Pay on some orders, some of them several times at
+	// once, with reconciliation passes racing the checkouts
+	clicks := 0
+	for range 1 + rng.IntN(6) {
+		var wg sync.WaitGroup
+		for _, id := range orders {
+			if rng.Float64() < 0.5 {
+				continue
+			}
+			for range 1 + rng.IntN(3) {
+				clicks++
+				ctx := timeline.WithCorrelation(ctx, fmt.Sprintf("click-%d", clicks))
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					svc.Checkout(ctx, id)
+				}()
+			}
+		}
+		for range rng.IntN(3) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reconciler.RunOnce(ctx)
+			}()
+		}
+		wg.Wait()
+		// let what is left behind become stuck
+		if rng.Float64() < 0.5 {
+			fake.Advance(worker.DefaultStuckAfter + time.Second)
+		}
+	}
+
+	// the network heals; reconciliation must now settle everything
+	for _, chaos := range chaoses {
+		chaos.SetConfig(payment.ChaosConfig{})
+	}
+	fake.Advance(worker.DefaultStuckAfter + time.Second)
+	for range 3 {
+		if err := reconciler.RunOnce(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Fatalf("reconcile: %v", err)
+		}
+	}
+
+	var ledger []payment.LedgerEntry
+	for _, l := range ledgers {
+		ledger = append(ledger, l.Ledger()...)
+	}
+	events, err := timeline.Read(&recorded)
+	if err != nil {
+		t.Fatalf("read timeline: %v", err)
+	}
+	return simulation.BuildReport(store.Orders(), store.Payments(), ledger), events
+}
+
+// TestCheckoutInvariantsDetectNaive makes sure the property has teeth: the
+// naive strategy charges with a fresh key per attempt, so some schedule
+// must break an invariant.
+func TestCheckoutInvariantsDetectNaive(t *testing.T) {
+	for seed := uint64(1); seed <= 50; seed++ {
+		report, _ := runSchedule(t, service.StrategyNaive, seed)
+		if report.Violations() > 0 {
+			return
+		}
+	}
+	t.Error("no schedule broke an invariant under the naive strategy")
+}
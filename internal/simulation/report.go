@@ -0,0 +1,219 @@
+// Package simulation checks the end state of a simulated run: what the
+// providers captured against what the database says.
+package simulation
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/infrastructure/payment"
+
+	"github.com/google/uuid"
+)
+
+// Report compares gateway truth with the database at the end of a run.
+type Report struct {
+	Orders   int `json:"orders"`
+	Captures int `json:"captures"`
+	Paid     int `json:"paid"`
+	Failed   int `json:"failed"`
+
+	// invariant violations
+	GhostOrders       []uuid.UUID `json:"ghost_orders"`       // captured, not PAID
+	PhantomPaid       []uuid.UUID `json:"phantom_paid"`       // PAID, never captured
+	DuplicateCharges  []uuid.UUID `json:"duplicate_charges"`  // captured more than once
+	DuplicatePayments []uuid.UUID `json:"duplicate_payments"` // several SUCCEEDED payment rows
+	AmountMismatches  []uuid.UUID `json:"amount_mismatches"`  // captured a different amount
+	UnmatchedCaptures []uuid.UUID `json:"unmatched_captures"` // captured keys no order owns
+
+	// PENDING or PAYMENT_UNKNOWN at the end of the run
+	StillPending []uuid.UUID `json:"still_pending"`
+
+	// created_at to the final status for PAID and FAILED orders
+	Resolution Percentiles `json:"resolution"`
+}
+
+type Percentiles struct {
+	P50 time.Duration `json:"p50_ns"`
+	P90 time.Duration `json:"p90_ns"`
+	P99 time.Duration `json:"p99_ns"`
+	Max time.Duration `json:"max_ns"`
+}
+
+// BuildReport matches captures to orders by the order reference sent with
+// the charge, falling back to the idempotency key, and payment rows to
+// orders by order ID.
+func BuildReport(orders []domain.Order, payments []domain.Payment, ledger []payment.LedgerEntry) Report {
+	r := Report{Orders: len(orders), Captures: len(ledger)}
+
+	succeeded := make(map[uuid.UUID]int)
+	for _, p := range payments {
+		if p.Status == domain.PaymentSucceeded {
+			succeeded[p.OrderID]++
+		}
+	}
+
+	owned := make(map[uuid.UUID]bool, len(orders))
+	byKey := make(map[uuid.UUID]uuid.UUID, len(orders))
+	for _, order := range orders {
+		owned[order.ID] = true
+		byKey[order.IdempotencyKey] = order.ID
+	}
+
+	captures := make(map[uuid.UUID][]payment.LedgerEntry)
+	for _, entry := range ledger {
+		orderId := entry.OrderRef
+		if orderId == uuid.Nil {
+			orderId = byKey[entry.IdempotencyKey]
+		}
+		if !owned[orderId] {
+			r.UnmatchedCaptures = append(r.UnmatchedCaptures, entry.TxnID)
+			continue
+		}
+		captures[orderId] = append(captures[orderId], entry)
+	}
+
+	var resolution []time.Duration
+	for _, order := range orders {
+		charged := captures[order.ID]
+
+		switch order.Status {
+		case domain.OrderPaid:
+			r.Paid++
+			resolution = append(resolution, order.UpdatedAt.Sub(order.CreatedAt))
+		case domain.OrderFailed:
+			r.Failed++
+			resolution = append(resolution, order.UpdatedAt.Sub(order.CreatedAt))
+		case domain.OrderPending, domain.OrderPaymentUnknown:
+			r.StillPending = append(r.StillPending, order.ID)
+		}
+
+		if len(charged) > 0 && order.Status != domain.OrderPaid {
+			r.GhostOrders = append(r.GhostOrders, order.ID)
+		}
+		if len(charged) == 0 && order.Status == domain.OrderPaid {
+			r.PhantomPaid = append(r.PhantomPaid, order.ID)
+		}
+		if len(charged) > 1 {
+			r.DuplicateCharges = append(r.DuplicateCharges, order.ID)
+		}
+		if succeeded[order.ID] > 1 {
+			r.DuplicatePayments = append(r.DuplicatePayments, order.ID)
+		}
+		for _, entry := range charged {
+			if entry.Amount != int64(order.Amount) {
+				r.AmountMismatches = append(r.AmountMismatches, order.ID)
+				break
+			}
+		}
+	}
+
+	r.Resolution = Summarize(resolution)
+	return r
+}
+
+// Summarize returns the percentiles of ds, sorting it in place.
+func Summarize(ds []time.Duration) Percentiles {
+	if len(ds) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(q float64) time.Duration {
+		return ds[int(q*float64(len(ds)-1))]
+	}
+	return Percentiles{P50: at(0.50), P90: at(0.90), P99: at(0.99), Max: ds[len(ds)-1]}
+}
+
+// Violations is the number of broken invariants. Orders still pending are
+// reported but are not a violation on their own.
+func (r Report) Violations() int {
+	return len(r.GhostOrders) + len(r.PhantomPaid) + len(r.DuplicateCharges) +
+		len(r.DuplicatePayments) + len(r.AmountMismatches) + len(r.UnmatchedCaptures)
+}
+
+func (r Report) rows() [][2]string {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	}
+	return [][2]string{
+		{"orders", strconv.Itoa(r.Orders)},
+		{"captures", strconv.Itoa(r.Captures)},
+		{"paid", strconv.Itoa(r.Paid)},
+		{"failed", strconv.Itoa(r.Failed)},
+		{"still_pending", strconv.Itoa(len(r.StillPending))},
+		{"ghost_orders", strconv.Itoa(len(r.GhostOrders))},
+		{"phantom_paid", strconv.Itoa(len(r.PhantomPaid))},
+		{"duplicate_charges", strconv.Itoa(len(r.DuplicateCharges))},
+		{"duplicate_payments", strconv.Itoa(len(r.DuplicatePayments))},
+		{"amount_mismatches", strconv.Itoa(len(r.AmountMismatches))},
+		{"unmatched_captures", strconv.Itoa(len(r.UnmatchedCaptures))},
+		{"resolution_p50_ms", ms(r.Resolution.P50)},
+		{"resolution_p90_ms", ms(r.Resolution.P90)},
+		{"resolution_p99_ms", ms(r.Resolution.P99)},
+		{"resolution_max_ms", ms(r.Resolution.Max)},
+		{"violations", strconv.Itoa(r.Violations())},
+	}
+}
+
+// Metric returns the value of a report row by its table/CSV name, e.g.
+// "ghost_orders" or "resolution_p99_ms".
+func (r Report) Metric(name string) (float64, bool) {
+	for _, row := range r.rows() {
+		if row[0] == name {
+			v, err := strconv.ParseFloat(row[1], 64)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
+
+func (r Report) WriteTable(w io.Writer) {
+	fmt.Fprintln(w, "---------------------------------------------------")
+	fmt.Fprintln(w, "INVARIANT REPORT")
+	for _, row := range r.rows() {
+		fmt.Fprintf(w, "  %-20s %s\n", row[0], row[1])
+	}
+	for _, v := range []struct {
+		name string
+		ids  []uuid.UUID
+	}{
+		{"GHOST ORDER", r.GhostOrders},
+		{"PHANTOM PAID", r.PhantomPaid},
+		{"DUPLICATE CHARGE", r.DuplicateCharges},
+		{"DUPLICATE PAYMENT", r.DuplicatePayments},
+		{"AMOUNT MISMATCH", r.AmountMismatches},
+		{"UNMATCHED CAPTURE", r.UnmatchedCaptures},
+	} {
+		for _, id := range v.ids {
+			fmt.Fprintf(w, "  %s %s\n", v.name, id)
+		}
+	}
+}
+
+func (r Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes one metric,value row per counter, for tracking runs over
+// time.
+func (r Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"metric", "value"}); err != nil {
+		return err
+	}
+	for _, row := range r.rows() {
+		if err := cw.Write(row[:]); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,96 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/infrastructure/payment"
+
+	"github.com/google/uuid"
+)
+
+func order(status domain.OrderStatus, amount float64) domain.Order {
+	now := time.Now()
+	return domain.Order{
+		ID:             uuid.New(),
+		IdempotencyKey: uuid.New(),
+		Amount:         amount,
+		Status:         status,
+		CreatedAt:      now,
+		UpdatedAt:      now.Add(100 * time.Millisecond),
+	}
+}
+
+func capture(o domain.Order, amount int64) payment.LedgerEntry {
+	return payment.LedgerEntry{IdempotencyKey: o.IdempotencyKey, TxnID: uuid.New(), Amount: amount}
+}
+
+func TestBuildReport(t *testing.T) {
+	paid := order(domain.OrderPaid, 100)
+	ghost := order(domain.OrderPaymentUnknown, 200)
+	phantom := order(domain.OrderPaid, 300)
+	dup := order(domain.OrderPaid, 400)
+	wrongAmount := order(domain.OrderPaid, 500)
+	failed := order(domain.OrderFailed, 600)
+
+	ledger := []payment.LedgerEntry{
+		capture(paid, 100),
+		capture(ghost, 200),
+		capture(dup, 400),
+		capture(dup, 400),
+		capture(wrongAmount, 499),
+		// sent without the order's key, traced by reference
+		{OrderRef: dup.ID, IdempotencyKey: uuid.New(), TxnID: uuid.New(), Amount: 400},
+		{IdempotencyKey: uuid.New(), TxnID: uuid.New(), Amount: 1},
+	}
+
+	payments := []domain.Payment{
+		{OrderID: paid.ID, Status: domain.PaymentSucceeded},
+		{OrderID: dup.ID, Status: domain.PaymentSucceeded},
+		{OrderID: dup.ID, Status: domain.PaymentSucceeded},
+		{OrderID: failed.ID, Status: domain.PaymentFailed},
+	}
+
+	r := BuildReport([]domain.Order{paid, ghost, phantom, dup, wrongAmount, failed}, payments, ledger)
+
+	checks := []struct {
+		name string
+		got  int
+		want int
+	}{
+		{"paid", r.Paid, 4},
+		{"failed", r.Failed, 1},
+		{"still pending", len(r.StillPending), 1},
+		{"ghost orders", len(r.GhostOrders), 1},
+		{"phantom paid", len(r.PhantomPaid), 1},
+		{"duplicate charges", len(r.DuplicateCharges), 1},
+		{"duplicate payments", len(r.DuplicatePayments), 1},
+		{"amount mismatches", len(r.AmountMismatches), 1},
+		{"unmatched captures", len(r.UnmatchedCaptures), 1},
+		{"violations", r.Violations(), 6},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: got %d want %d", c.name, c.got, c.want)
+		}
+	}
+	if r.Resolution.P50 != 100*time.Millisecond {
+		t.Errorf("resolution p50: got %s want 100ms", r.Resolution.P50)
+	}
+}
+
+func TestReportMetric(t *testing.T) {
+	ghost := order(domain.OrderPending, 100)
+	r := BuildReport([]domain.Order{ghost}, nil, []payment.LedgerEntry{capture(ghost, 100)})
+
+	if v, ok := r.Metric("ghost_orders"); !ok || v != 1 {
+		t.Fatalf("ghost_orders = %v, %t", v, ok)
+	}
+	if v, ok := r.Metric("violations"); !ok || v != 1 {
+		t.Fatalf("violations = %v, %t", v, ok)
+	}
+	if _, ok := r.Metric("no_such_metric"); ok {
+		t.Fatal("expected an unknown metric to be reported missing")
+	}
+}
@@ -0,0 +1,122 @@
+package timeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Sequencer replays the interleaving of a recorded timeline. Each event is
+// identified by its correlation and its position within that correlation;
+// Record blocks until every event recorded before it has happened again.
+// Ordering is enforced at event boundaries only, so work between two
+// events can still race.
+//
+// If the rerun takes a different path (an event never comes, or an
+// unexpected one does), the sequencer notes the divergence and stops
+// gating after timeout.
+type Sequencer struct {
+	next    Recorder
+	timeout time.Duration
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	recorded []Event
+	position map[sequenceKey]int
+	seen     map[string]int
+	pos      int
+	diverged []string
+	stopped  bool
+}
+
+type sequenceKey struct {
+	correlation string
+	n           int
+}
+
+// NewSequencer gates events to the order of recorded and forwards them to
+// next. The run event is ignored.
+func NewSequencer(recorded []Event, next Recorder, timeout time.Duration) *Sequencer {
+	s := &Sequencer{
+		next:     next,
+		timeout:  timeout,
+		position: make(map[sequenceKey]int),
+		seen:     make(map[string]int),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	counts := make(map[string]int)
+	for _, e := range recorded {
+		if e.Kind == KindRun {
+			continue
+		}
+		s.position[sequenceKey{e.Correlation, counts[e.Correlation]}] = len(s.recorded)
+		counts[e.Correlation]++
+		s.recorded = append(s.recorded, e)
+	}
+	return s
+}
+
+func (s *Sequencer) Record(ctx context.Context, e Event) {
+	correlation := e.Correlation
+	if correlation == "" {
+		correlation = Correlation(ctx)
+	}
+
+	s.mu.Lock()
+	key := sequenceKey{correlation, s.seen[correlation]}
+	s.seen[correlation]++
+	p, ok := s.position[key]
+	switch {
+	case !ok:
+		s.diverge(fmt.Sprintf("unexpected %s from %q", e.Kind, correlation))
+	case s.recorded[p].Kind != e.Kind:
+		s.diverge(fmt.Sprintf("event %d from %q: recorded %s, got %s", p+1, correlation, s.recorded[p].Kind, e.Kind))
+	}
+	if ok {
+		s.waitTurn(p)
+	}
+	s.mu.Unlock()
+
+	s.next.Record(ctx, e)
+}
+
+// waitTurn blocks until position p is next, then lets the one after it go.
+func (s *Sequencer) waitTurn(p int) {
+	if s.pos < p && !s.stopped {
+		timer := time.AfterFunc(s.timeout, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.pos < p && !s.stopped {
+				s.stopped = true
+				s.diverged = append(s.diverged, fmt.Sprintf("stuck waiting for event %d (%s from %q); gating stopped",
+					s.pos+1, s.recorded[s.pos].Kind, s.recorded[s.pos].Correlation))
+				s.cond.Broadcast()
+			}
+		})
+		for s.pos < p && !s.stopped {
+			s.cond.Wait()
+		}
+		timer.Stop()
+	}
+	if s.pos == p {
+		s.pos++
+		s.cond.Broadcast()
+	}
+}
+
+func (s *Sequencer) diverge(msg string) {
+	s.diverged = append(s.diverged, msg)
+}
+
+// Divergences lists where the rerun departed from the recording; empty
+// means it replayed faithfully.
+func (s *Sequencer) Divergences() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	diverged := append([]string(nil), s.diverged...)
+	if s.pos < len(s.recorded) && !s.stopped {
+		diverged = append(diverged, fmt.Sprintf("%d recorded events never happened", len(s.recorded)-s.pos))
+	}
+	return diverged
+}
@@ -0,0 +1,122 @@
+// Package timeline records what happened during a checkout, one JSON
+// event per line, so a simulation that ends with a ghost order can be read
+// back in order and replayed.
+package timeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"the-phantom-charge/internal/clock"
+	"time"
+)
+
+type Kind string
+
+const (
+	// KindRun is the first event of a timeline; Detail holds the
+	// simulator arguments needed to replay it.
+	KindRun            Kind = "run"
+	KindOrderCreated   Kind = "order_created"
+	KindCheckout       Kind = "checkout_started"
+	KindChargeSent     Kind = "charge_sent"
+	KindGatewayOutcome Kind = "gateway_outcome"
+	KindCommit         Kind = "db_commit"
+	KindCheckoutResult Kind = "checkout_result"
+	KindReconcile      Kind = "reconcile_decision"
+	KindCrash          Kind = "crash"
+)
+
+type Event struct {
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind Kind      `json:"kind"`
+	// Correlation ties together the events of one client or worker;
+	// events with the same correlation happen in sequence.
+	Correlation string `json:"correlation,omitempty"`
+	OrderID     string `json:"order_id,omitempty"`
+	Provider    string `json:"provider,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Recorder receives events. Implementations must be safe for concurrent use.
+type Recorder interface {
+	Record(ctx context.Context, e Event)
+}
+
+// Nop drops every event.
+var Nop Recorder = nopRecorder{}
+
+type nopRecorder struct{}
+
+func (nopRecorder) Record(context.Context, Event) {}
+
+type correlationKey struct{}
+
+// WithCorrelation tags every event recorded under ctx with id.
+func WithCorrelation(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// Correlation returns the id set by WithCorrelation, or "".
+func Correlation(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// Writer writes events as JSON lines, numbering them in the order they
+// were recorded.
+type Writer struct {
+	clock clock.Clock
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	seq int64
+	err error
+}
+
+func NewWriter(w io.Writer, clk clock.Clock) *Writer {
+	return &Writer{clock: clk, enc: json.NewEncoder(w)}
+}
+
+func (w *Writer) Record(ctx context.Context, e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seq++
+	e.Seq = w.seq
+	e.Time = w.clock.Now()
+	if e.Correlation == "" {
+		e.Correlation = Correlation(ctx)
+	}
+	if err := w.enc.Encode(e); err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// Err returns the first write error, if any.
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Read parses a timeline written by Writer.
+func Read(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
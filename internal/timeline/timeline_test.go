@@ -0,0 +1,88 @@
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"the-phantom-charge/internal/clock"
+	"time"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, clock.NewFake(time.Unix(0, 0)))
+	ctx := WithCorrelation(context.Background(), "order-1")
+	w.Record(ctx, Event{Kind: KindOrderCreated, OrderID: "a"})
+	w.Record(ctx, Event{Kind: KindChargeSent, OrderID: "a", Provider: "fastpay"})
+
+	events, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].Seq != 2 || events[1].Correlation != "order-1" || events[1].Provider != "fastpay" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
+
+// recording collects events in the order they are forwarded.
+type recording struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recording) Record(ctx context.Context, e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Correlation = Correlation(ctx)
+	r.events = append(r.events, e)
+}
+
+func TestSequencerReplaysInterleaving(t *testing.T) {
+	recorded := []Event{
+		{Kind: KindRun},
+		{Kind: KindChargeSent, Correlation: "b"},
+		{Kind: KindChargeSent, Correlation: "a"},
+		{Kind: KindCommit, Correlation: "b"},
+		{Kind: KindCommit, Correlation: "a"},
+	}
+	out := &recording{}
+	seq := NewSequencer(recorded, out, time.Second)
+
+	var wg sync.WaitGroup
+	// "a" starts first but has to wait for "b" each time
+	for _, corr := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := WithCorrelation(context.Background(), corr)
+			seq.Record(ctx, Event{Kind: KindChargeSent})
+			seq.Record(ctx, Event{Kind: KindCommit})
+		}()
+	}
+	wg.Wait()
+
+	got := ""
+	for _, e := range out.events {
+		got += e.Correlation
+	}
+	if got != "baba" {
+		t.Fatalf("replayed order %q, want baba", got)
+	}
+	if d := seq.Divergences(); len(d) != 0 {
+		t.Fatalf("unexpected divergences %v", d)
+	}
+}
+
+func TestSequencerGivesUpOnDivergence(t *testing.T) {
+	recorded := []Event{
+		{Kind: KindChargeSent, Correlation: "missing"},
+		{Kind: KindChargeSent, Correlation: "a"},
+	}
+	seq := NewSequencer(recorded, Nop, 10*time.Millisecond)
+	seq.Record(WithCorrelation(context.Background(), "a"), Event{Kind: KindChargeSent})
+
+	if d := seq.Divergences(); len(d) != 1 {
+		t.Fatalf("expected the stuck wait to be reported, got %v", d)
+	}
+}
@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"the-phantom-charge/internal/infrastructure/payment"
+)
+
+// Gateway wraps provider's gateway next in a client span per call, with
+// the idempotency key and the outcome. Under the resilience layer each
+// attempt gets its own span.
+func Gateway(provider string, next payment.PaymentGateway) payment.PaymentGateway {
+	return &gateway{next: next, provider: provider, tracer: otel.Tracer("the-phantom-charge/internal/infrastructure/payment")}
+}
+
+type gateway struct {
+	next     payment.PaymentGateway
+	provider string
+	tracer   trace.Tracer
+}
+
+func (g *gateway) start(ctx context.Context, method string, idempotencyKey uuid.UUID, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, Provider.String(g.provider), IdempotencyKey.String(idempotencyKey.String()))
+	return g.tracer.Start(ctx, "PaymentGateway."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (g *gateway) end(span trace.Span, res *payment.ChargeResult, err error) {
+	outcome := payment.ErrorClass(err)
+	if res != nil {
+		switch {
+		case res.Refunded:
+			outcome = "refunded"
+		case res.Paid:
+			outcome = "paid"
+		case res.Authorized:
+			outcome = "authorized"
+		default:
+			outcome = "not_charged"
+		}
+		span.SetAttributes(attribute.Bool("payment.replayed", res.Replayed))
+		if res.TxnID != uuid.Nil {
+			span.SetAttributes(GatewayTxn.String(res.TxnID.String()))
+		}
+	}
+	span.SetAttributes(Outcome.String(outcome))
+	End(span, err)
+}
+
+func (g *gateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	ctx, span := g.start(ctx, "Charge", idempotencyKey, attribute.Int64("payment.amount", amount))
+	res, err := g.next.Charge(ctx, amount, idempotencyKey)
+	g.end(span, res, err)
+	return res, err
+}
+
+func (g *gateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	ctx, span := g.start(ctx, "CheckStatus", idempotencyKey)
+	res, err := g.next.CheckStatus(ctx, idempotencyKey)
+	g.end(span, res, err)
+	return res, err
+}
+
+func (g *gateway) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	ctx, span := g.start(ctx, "Authorize", idempotencyKey, attribute.Int64("payment.amount", amount))
+	res, err := g.next.Authorize(ctx, amount, idempotencyKey)
+	g.end(span, res, err)
+	return res, err
+}
+
+func (g *gateway) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	ctx, span := g.start(ctx, "Capture", idempotencyKey)
+	res, err := g.next.Capture(ctx, idempotencyKey)
+	g.end(span, res, err)
+	return res, err
+}
+
+func (g *gateway) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	ctx, span := g.start(ctx, "Refund", idempotencyKey)
+	res, err := g.next.Refund(ctx, idempotencyKey)
+	g.end(span, res, err)
+	return res, err
+}
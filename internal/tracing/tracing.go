@@ -0,0 +1,86 @@
+// Package tracing sets up OpenTelemetry and holds the span attributes the
+// service shares. Until Setup installs an exporter, spans cost next to
+// nothing and go nowhere.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters for OTEL_TRACES_EXPORTER.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends over HTTP to OTEL_EXPORTER_OTLP_ENDPOINT,
+	// http://localhost:4318 by default.
+	ExporterOTLP = "otlp"
+)
+
+// Attributes on the service's spans.
+const (
+	OrderID        = attribute.Key("order.id")
+	IdempotencyKey = attribute.Key("payment.idempotency_key")
+	PaymentID      = attribute.Key("payment.id")
+	Provider       = attribute.Key("payment.provider")
+	GatewayTxn     = attribute.Key("payment.gateway_txn")
+	Outcome        = attribute.Key("outcome")
+)
+
+// Setup installs the exporter named by OTEL_TRACES_EXPORTER (none by
+// default) as the global tracer provider, with W3C trace context
+// propagation. The standard OTEL_* variables, such as OTEL_SERVICE_NAME
+// and OTEL_TRACES_SAMPLER, apply. shutdown flushes pending spans.
+func Setup(ctx context.Context, serviceName string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch name := os.Getenv("OTEL_TRACES_EXPORTER"); name {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case ExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("tracing: unknown OTEL_TRACES_EXPORTER %q", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+	// OTEL_SERVICE_NAME, if set, wins over serviceName
+	res, err = resource.Merge(res, resource.Environment())
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"the-phantom-charge/internal/infrastructure/payment"
+)
+
+func attr(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestGatewaySpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx := context.Background()
+
+	gw := Gateway(payment.ProviderFastPay, payment.NewMockGateway(payment.MockConfig{}, 1)).(*gateway)
+	gw.tracer = provider.Tracer("test")
+	key := uuid.New()
+	if _, err := gw.Charge(ctx, 100, key); err != nil {
+		t.Fatal(err)
+	}
+	failing := Gateway(payment.ProviderFastPay,
+		payment.NewChaos(payment.NewMockGateway(payment.MockConfig{}, 1), payment.ChaosConfig{Enabled: true, DropResponseProbability: 1}, 1, nil)).(*gateway)
+	failing.tracer = provider.Tracer("test")
+	if _, err := failing.Charge(ctx, 100, key); err == nil {
+		t.Fatal("chaos let the call through")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want 2", len(spans))
+	}
+	ok, timedOut := spans[0], spans[1]
+	if ok.Name() != "PaymentGateway.Charge" || attr(ok, IdempotencyKey) != key.String() || attr(ok, Outcome) != "paid" || attr(ok, GatewayTxn) == "" {
+		t.Errorf("charge span %s: %v", ok.Name(), ok.Attributes())
+	}
+	if attr(timedOut, Outcome) != "timeout" || timedOut.Status().Code != codes.Error {
+		t.Errorf("timed out span: %v, %v", timedOut.Attributes(), timedOut.Status())
+	}
+}
+
+func TestQueryName(t *testing.T) {
+	tests := map[string]string{
+		"SELECT id, user_id FROM orders WHERE id = $1":         "SELECT orders",
+		"INSERT INTO payments (id, order_id) VALUES ($1, $2)":  "INSERT payments",
+		"UPDATE orders SET status = $1 WHERE id = $2":          "UPDATE orders",
+		"\n\t\tSELECT id FROM payments\n\t\tWHERE status = $1": "SELECT payments",
+		"begin": "BEGIN",
+		"":      "query",
+	}
+	for sql, want := range tests {
+		if got := queryName(sql); got != want {
+			t.Errorf("queryName(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
@@ -2,113 +2,312 @@ package worker
 
 import (
 	"context"
-	"database/sql"
-	"log"
+	"log/slog"
+	"sync/atomic"
+	"the-phantom-charge/internal/clock"
 	"the-phantom-charge/internal/domain"
 	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/logging"
 	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/service"
+	"the-phantom-charge/internal/timeline"
+	"the-phantom-charge/internal/tracing"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("the-phantom-charge/internal/worker")
+
 type ReconciliationWorker struct {
-	db *sql.DB
-	orderRepo repo.OrderRepo
-	gateway   payment.PaymentGateway
-	interval  time.Duration
+	txs         repo.TxManager
+	orderRepo   repo.OrderRepo
+	paymentRepo repo.PaymentRepo
+	router      *payment.Router
+	clock       clock.Clock
+	interval    time.Duration
+	// orders untouched for this long are considered stuck
+	stuckAfter time.Duration
+	recorder   timeline.Recorder
+	passHook   func(PassStats)
+	logger     *slog.Logger
+	// when the last pass finished without error, in UnixNano
+	lastSuccess atomic.Int64
+}
+
+type Option func(*ReconciliationWorker)
+
+// WithRecorder records every reconciliation decision to rec.
+func WithRecorder(rec timeline.Recorder) Option {
+	return func(rw *ReconciliationWorker) {
+		rw.recorder = rec
+	}
 }
 
+// WithPassHook calls hook after every pass with what it found and did.
+func WithPassHook(hook func(PassStats)) Option {
+	return func(rw *ReconciliationWorker) {
+		rw.passHook = hook
+	}
+}
+
+// WithLogger logs passes and every decision on a stuck order to logger.
+// The default is slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(rw *ReconciliationWorker) {
+		rw.logger = logger
+	}
+}
+
+// PassStats summarizes one reconciliation pass.
+type PassStats struct {
+	// orders found stuck
+	Stuck int
+	// stuck orders the provider had charged: ghost orders
+	GhostsFound int
+	// ghosts settled PAID; fewer than found when a checkout touched the
+	// order meanwhile, or the pass failed
+	GhostsFixed int
+	// stuck orders the provider had not charged, settled FAILED
+	AbandonedFixed int
+	// stuck orders whose status the provider couldn't tell, or whose hold
+	// it couldn't capture; left for the next pass
+	CheckFailed int
+	Duration    time.Duration
+	// Err is why the pass stopped early, nil if it finished
+	Err error
+}
+
+// DefaultStuckAfter leaves in-flight checkouts, including their inline
+// status verification, well alone.
+const DefaultStuckAfter = 1 * time.Minute
+
 func NewReconciliationWorker(
-	db *sql.DB,
+	txs repo.TxManager,
 	orderRepo repo.OrderRepo,
-	gateway payment.PaymentGateway,
+	paymentRepo repo.PaymentRepo,
+	router *payment.Router,
+	clk clock.Clock,
 	interval time.Duration,
+	stuckAfter time.Duration,
+	opts ...Option,
 ) *ReconciliationWorker {
-	return &ReconciliationWorker{
-		db:        db,
-		orderRepo: orderRepo,
-		gateway:   gateway,
-		interval:  interval,
+	rw := &ReconciliationWorker{
+		txs:         txs,
+		orderRepo:   orderRepo,
+		paymentRepo: paymentRepo,
+		router:      router,
+		clock:       clk,
+		interval:    interval,
+		stuckAfter:  stuckAfter,
+		recorder:    timeline.Nop,
+		logger:      slog.Default(),
 	}
+	for _, opt := range opts {
+		opt(rw)
+	}
+	return rw
 }
 
 func (rw *ReconciliationWorker) Run(ctx context.Context) {
-	ticker := time.NewTicker(rw.interval)
+	ctx = timeline.WithCorrelation(ctx, "worker")
+	ticker := rw.clock.NewTicker(rw.interval)
 	defer ticker.Stop()
 
-	log.Println("Reconciliation worker started")
+	rw.logger.InfoContext(ctx, "reconciliation worker started", "interval", rw.interval.String(), "stuck_after", rw.stuckAfter.String())
 
 	for {
 		select {
-		case <-ctx.Done(): // Worker bị dừng
+		case <-ctx.Done():
 			return
-		case <-ticker.C:   // Đến giờ chạy job
-			// Logic xử lý chính ở đây
-			if err := rw.process(ctx); err != nil {
-				log.Printf("Reconciliation failed: %v", err)
+		case <-ticker.C():
+			if err := rw.pass(ctx); err != nil {
+				rw.logger.ErrorContext(ctx, "reconciliation pass failed", "error", err)
 			}
 		}
 	}
 }
 
-// process thực hiện logic đối soát
-func (rw *ReconciliationWorker) process(ctx context.Context) error {
-	// 1. Tìm các đơn "PENDING" đã tạo quá 1 phút trước (nghĩa là bị kẹt)
-	stuckOrders, err := rw.orderRepo.FindStuckOrders(ctx, 1*time.Minute)
+// RunOnce runs a single reconciliation pass, as one tick of Run does.
+func (rw *ReconciliationWorker) RunOnce(ctx context.Context) error {
+	return rw.pass(timeline.WithCorrelation(ctx, "worker"))
+}
+
+// LastSuccess is when the last pass finished without error, zero before
+// the first one.
+func (rw *ReconciliationWorker) LastSuccess() time.Time {
+	n := rw.lastSuccess.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func (rw *ReconciliationWorker) pass(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "ReconciliationWorker.pass")
+	start := rw.clock.Now()
+	var stats PassStats
+	stats.Err = rw.process(ctx, &stats)
+	stats.Duration = rw.clock.Now().Sub(start)
+	span.SetAttributes(
+		attribute.Int("reconcile.stuck", stats.Stuck),
+		attribute.Int("reconcile.ghosts_found", stats.GhostsFound),
+		attribute.Int("reconcile.ghosts_fixed", stats.GhostsFixed),
+	)
+	tracing.End(span, stats.Err)
+	if rw.passHook != nil {
+		rw.passHook(stats)
+	}
+	if stats.Err != nil {
+		return stats.Err
+	}
+	rw.lastSuccess.Store(rw.clock.Now().UnixNano())
+	return nil
+}
+
+// process settles every order stuck longer than stuckAfter.
+func (rw *ReconciliationWorker) process(ctx context.Context, stats *PassStats) error {
+	// PENDING / PAYMENT_UNKNOWN orders untouched for stuckAfter
+	stuckOrders, err := rw.orderRepo.FindStuckOrders(ctx, rw.clock.Now().Add(-rw.stuckAfter))
 	if err != nil {
 		return err
 	}
 
+	stats.Stuck = len(stuckOrders)
 	if len(stuckOrders) == 0 {
-		return nil // Không có đơn nào bị kẹt
+		return nil
 	}
 
-	log.Printf("Found %d stuck orders. Fixing...", len(stuckOrders))
+	rw.logger.InfoContext(ctx, "found stuck orders", "count", len(stuckOrders))
 
-	// 2. Duyệt từng đơn và fix
 	for _, order := range stuckOrders {
-		// Gọi sang MockGateway để hỏi: Đơn này Status thực tế là gì?
-		isPaid, err := rw.gateway.CheckStatus(ctx, order.IdempotencyKey)
-		if err != nil {
-			log.Printf("Failed to check status for order %s: %v", order.ID, err)
-			continue // Bỏ qua, chờ đợt quét sau
+		if err := rw.reconcile(ctx, order, stats); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// reconcile asks the order's provider what became of its charge and
+// settles the order to match. Errors asking are left for the next pass;
+// an error saving stops the pass.
+func (rw *ReconciliationWorker) reconcile(ctx context.Context, order domain.Order, stats *PassStats) (err error) {
+	ctx, span := tracer.Start(ctx, "ReconciliationWorker.reconcile", trace.WithAttributes(
+		tracing.OrderID.String(order.ID.String()),
+		tracing.IdempotencyKey.String(order.IdempotencyKey.String()),
+		tracing.Provider.String(order.Provider),
+	))
+	ctx = logging.With(ctx, logging.OrderID, order.ID, logging.IdempotencyKey, order.IdempotencyKey, logging.Provider, order.Provider)
+	decision := "check_failed"
+	defer func() {
+		span.SetAttributes(attribute.String("reconcile.decision", decision))
+		tracing.End(span, err)
+	}()
+
+	// ask the provider that took the order what became of the charge
+	gateway, err := rw.router.Gateway(order.Provider)
+	if err != nil {
+		stats.CheckFailed++
+		rw.logger.WarnContext(ctx, "status check failed, retrying next pass", "error", err)
+		span.RecordError(err)
+		return nil
+	}
+	charge, err := gateway.CheckStatus(ctx, order.IdempotencyKey)
+	if err != nil {
+		stats.CheckFailed++
+		rw.recorder.Record(ctx, timeline.Event{Kind: timeline.KindReconcile, OrderID: order.ID.String(), Provider: order.Provider, Error: err.Error()})
+		rw.logger.WarnContext(ctx, "status check failed, retrying next pass", "error", err)
+		span.RecordError(err)
+		return nil
+	}
 
-		// 3. Update DB theo sự thật (Source of Truth) từ Gateway
-		if isPaid {
-			// Case Ghost Order: Đã thanh toán -> Update PAID
-			order.Status = domain.OrderPaid
-			log.Printf("Found GHOST ORDER %s -> Fixing to PAID", order.ID)
-		} else {
-			// Case thường: Chưa thanh toán (hoặc lỗi thật) -> Cancel luôn cho sạch DB
-			order.Status = domain.OrderFailed
-			log.Printf("Found ABANDONED ORDER %s -> Fixing to FAILED", order.ID)
+	// an auth-capture checkout stopped between its two calls: the hold is
+	// on the card, so finish the payment the customer started
+	if charge != nil && charge.Authorized {
+		rw.logger.WarnContext(ctx, "authorized but never captured, capturing", logging.GatewayTxn, charge.TxnID)
+		charge, err = gateway.Capture(ctx, order.IdempotencyKey)
+		if err != nil {
+			decision = "capture_failed"
+			stats.CheckFailed++
+			rw.recorder.Record(ctx, timeline.Event{Kind: timeline.KindReconcile, OrderID: order.ID.String(), Provider: order.Provider, Error: err.Error()})
+			rw.logger.WarnContext(ctx, "capture failed, retrying next pass", "error", err)
+			span.RecordError(err)
+			return nil
 		}
+	}
 
-		// 4. Lưu vào DB (Không cần Transaction vì đây là lệnh sửa sai cuối cùng)
-		// Lưu ý: UpdateOrderStatus cần TX, nhưng ở đây ta update lẻ tẻ.
-		// Bạn có thể update `repo` để chấp nhận tx=nil hoặc cheat bằng cách begin 1 tx ngắn.
-		// Tốt nhất: Gọi rw.orderRepo.UpdateOrderStatus(ctx, nil, &order) nếu repo hỗ trợ nil tx.
-        // (Nếu repo bắt buộc tx, ta sẽ thêm logic begin tx ở đây).
+	// the provider is the source of truth
+	if charge != nil && charge.Paid {
+		order.Status = domain.OrderPaid
+		stats.GhostsFound++
+		rw.logger.WarnContext(ctx, "ghost order: provider charged it, settling PAID", logging.GatewayTxn, charge.TxnID)
+	} else {
+		order.Status = domain.OrderFailed
+		rw.logger.InfoContext(ctx, "abandoned order: provider has no charge, settling FAILED")
+	}
+	decision = string(order.Status)
 
-        // Giả sử repo của bạn cần Tx, ta tạo 1 cái nho nhỏ
-        // Note: Bạn cần pass db connection vào Worker nếu muốn start Tx.
-        // Tạm thời để đơn giản hóa, hãy check xem repo của bạn có handle tx == nil không?
-        // Nếu không, hãy sửa repo dòng: `execNode := tx; if tx == nil { execNode = r.db }`
+	rw.recorder.Record(ctx, timeline.Event{Kind: timeline.KindReconcile, OrderID: order.ID.String(), Provider: order.Provider, Detail: string(order.Status)})
 
-        // Tạm thời mình giả định bạn đã sửa Repo để support tx == nil hoặc bạn sẽ tự inject DB vào Worker.
-		// Dưới đây là code gọi giả định:
-		tx, err := rw.db.BeginTx(ctx, nil)
+	p, settled, err := rw.updateStatus(ctx, &order, charge)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Bool("reconcile.settled", settled))
+	rw.logSettled(ctx, &order, p, settled)
+	switch {
+	case !settled:
+	case order.Status == domain.OrderPaid:
+		stats.GhostsFixed++
+	default:
+		stats.AbandonedFixed++
+	}
+	return nil
+}
+
+// updateStatus settles the order and records the provider's charge, if
+// any, next to it, returning the payment row. It reports false when it
+// left the order alone.
+func (rw *ReconciliationWorker) updateStatus(ctx context.Context, order *domain.Order, charge *payment.ChargeResult) (*domain.Payment, bool, error) {
+	var p *domain.Payment
+	settled := false
+	err := rw.txs.WithinTx(ctx, func(ctx context.Context) error {
+		p, settled = nil, false // a retried attempt starts over
+		// a late checkout may have settled the order since it was listed,
+		// or picked it up again: its charge may not have reached the
+		// provider when we asked, so leave it to the next pass
+		current, err := rw.orderRepo.FindByIdForUpdate(ctx, order.ID)
 		if err != nil {
 			return err
 		}
+		if current == nil || current.Status.Settled() || !current.UpdatedAt.Equal(order.UpdatedAt) {
+			return nil
+		}
 
-		defer tx.Rollback()
-		order.Status = domain.OrderPaid
-		_ = rw.orderRepo.UpdateOrderStatus(ctx, tx, &order)
-
-		if err := tx.Commit(); err != nil {
+		order.UpdatedAt = rw.clock.Now()
+		if err := rw.orderRepo.UpdateOrderStatus(ctx, order); err != nil {
+			return err
+		}
+		p, err = service.RecordPayment(ctx, rw.paymentRepo, order, charge)
+		if err != nil {
 			return err
 		}
+		settled = true
+		return nil
+	})
+	return p, settled, err
+}
+
+func (rw *ReconciliationWorker) logSettled(ctx context.Context, order *domain.Order, p *domain.Payment, settled bool) {
+	if !settled {
+		rw.logger.InfoContext(ctx, "order changed since it was listed, leaving it to the next pass")
+		return
 	}
-	return nil
-}
\ No newline at end of file
+	args := []any{"status", order.Status}
+	if p != nil {
+		args = append(args, logging.PaymentID, p.ID)
+	}
+	rw.logger.InfoContext(ctx, "order settled by reconciliation", args...)
+}
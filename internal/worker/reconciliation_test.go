@@ -0,0 +1,359 @@
+package worker_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"the-phantom-charge/internal/clock"
+	"the-phantom-charge/internal/domain"
+	"the-phantom-charge/internal/infrastructure/payment"
+	"the-phantom-charge/internal/repo"
+	"the-phantom-charge/internal/repo/memory"
+	"the-phantom-charge/internal/service"
+	"the-phantom-charge/internal/worker"
+
+	"github.com/google/uuid"
+)
+
+// paidGateway knows about the charges in paid and nothing else.
+type paidGateway struct {
+	mu   sync.Mutex
+	paid map[uuid.UUID]bool
+}
+
+func (g *paidGateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	panic("reconciliation must not charge")
+}
+
+func (g *paidGateway) Authorize(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	panic("reconciliation must not authorize")
+}
+
+func (g *paidGateway) Capture(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	panic("reconciliation must not capture")
+}
+
+func (g *paidGateway) Refund(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	panic("reconciliation must not refund")
+}
+
+func (g *paidGateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paid[idempotencyKey] {
+		return nil, nil
+	}
+	return &payment.ChargeResult{TxnID: uuid.New(), Paid: true}, nil
+}
+
+// TestReconcileSettlesStuckOrders leaves a ghost order FastPay charged, an
+// abandoned one it never saw, and one still in flight. The worker settles
+// the first two, recording the ghost's charge, and leaves the in-flight
+// checkout alone.
+func TestReconcileSettlesStuckOrders(t *testing.T) {
+	ctx := context.Background()
+	fake := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := memory.NewStore(fake)
+	orderRepo := memory.NewOrderRepo(store)
+	paymentRepo := memory.NewPaymentRepo(store)
+	txs := repo.NewTxManager(store)
+
+	newOrder := func(status domain.OrderStatus) domain.Order {
+		o := domain.Order{
+			ID:             uuid.New(),
+			UserID:         uuid.New(),
+			Amount:         100,
+			IdempotencyKey: uuid.New(),
+			Status:         status,
+			Currency:       domain.DefaultCurrency,
+			Provider:       payment.ProviderFastPay,
+			CreatedAt:      fake.Now(),
+			UpdatedAt:      fake.Now(),
+		}
+		err := txs.WithinTx(ctx, func(ctx context.Context) error {
+			return orderRepo.CreateOrder(ctx, &o)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	ghost := newOrder(domain.OrderPaymentUnknown)
+	abandoned := newOrder(domain.OrderPending)
+	fake.Advance(worker.DefaultStuckAfter + time.Second)
+	inFlight := newOrder(domain.OrderPending)
+
+	gateway := &paidGateway{paid: map[uuid.UUID]bool{
+		ghost.IdempotencyKey:    true,
+		inFlight.IdempotencyKey: true,
+	}}
+	registry := payment.NewRegistry()
+	registry.Register(payment.ProviderFastPay, gateway, nil)
+	rw := worker.NewReconciliationWorker(txs, orderRepo, paymentRepo, payment.NewRouter(registry), fake, time.Second, worker.DefaultStuckAfter)
+
+	if err := rw.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		order    domain.Order
+		want     domain.OrderStatus
+		payments int
+	}{
+		{"ghost", ghost, domain.OrderPaid, 1},
+		{"abandoned", abandoned, domain.OrderFailed, 0},
+		{"in flight", inFlight, domain.OrderPending, 0},
+	}
+	for _, tt := range tests {
+		got, err := orderRepo.FindById(ctx, tt.order.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.want {
+			t.Errorf("%s order = %s, want %s", tt.name, got.Status, tt.want)
+		}
+		payments, err := paymentRepo.ListByOrderId(ctx, tt.order.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payments) != tt.payments {
+			t.Errorf("%s order has %d payments, want %d", tt.name, len(payments), tt.payments)
+		}
+	}
+}
+
+// TestReconcileCapturesHold leaves an order with an authorization its
+// checkout never captured. The pass captures the hold and settles the
+// order PAID instead of failing it with the money blocked on the card.
+func TestReconcileCapturesHold(t *testing.T) {
+	ctx := context.Background()
+	fake := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := memory.NewStore(fake)
+	orderRepo := memory.NewOrderRepo(store)
+	paymentRepo := memory.NewPaymentRepo(store)
+	txs := repo.NewTxManager(store)
+	mock := payment.NewMockGateway(payment.MockConfig{Clock: fake}, 1)
+	registry := payment.NewRegistry()
+	registry.Register(payment.ProviderFastPay, mock, nil)
+	var stats worker.PassStats
+	rw := worker.NewReconciliationWorker(txs, orderRepo, paymentRepo, payment.NewRouter(registry), fake, time.Second, worker.DefaultStuckAfter,
+		worker.WithPassHook(func(s worker.PassStats) { stats = s }))
+
+	order := domain.Order{
+		ID:             uuid.New(),
+		UserID:         uuid.New(),
+		Amount:         100,
+		IdempotencyKey: uuid.New(),
+		Status:         domain.OrderPaymentUnknown,
+		Currency:       domain.DefaultCurrency,
+		Provider:       payment.ProviderFastPay,
+		CreatedAt:      fake.Now(),
+		UpdatedAt:      fake.Now(),
+	}
+	err := txs.WithinTx(ctx, func(ctx context.Context) error {
+		return orderRepo.CreateOrder(ctx, &order)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mock.Authorize(ctx, 100, order.IdempotencyKey); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(worker.DefaultStuckAfter + time.Second)
+
+	if err := rw.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := (worker.PassStats{Stuck: 1, GhostsFound: 1, GhostsFixed: 1}); stats != want {
+		t.Fatalf("pass stats = %+v, want %+v", stats, want)
+	}
+	got, err := orderRepo.FindById(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != domain.OrderPaid {
+		t.Fatalf("status = %s, want %s", got.Status, domain.OrderPaid)
+	}
+	if n := len(mock.(payment.Ledger).Ledger()); n != 1 {
+		t.Fatalf("%d captures, want 1", n)
+	}
+}
+
+// TestReconcileAfterCrash kills checkouts at every crash point, then runs a
+// reconciliation pass once the orders are stuck. Orders whose charge went
+// through end PAID with one payment; the others end FAILED.
+func TestReconcileAfterCrash(t *testing.T) {
+	tests := []struct {
+		point service.CrashPoint
+		want  domain.OrderStatus
+	}{
+		{service.CrashBeforeCharge, domain.OrderFailed},
+		{service.CrashAfterCharge, domain.OrderPaid},
+		{service.CrashBeforeCommit, domain.OrderPaid},
+		{service.CrashAfterCommit, domain.OrderPaid},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.point), func(t *testing.T) {
+			ctx := context.Background()
+			fake := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			mock := payment.NewMockGateway(payment.MockConfig{Clock: fake}, 1)
+			registry := payment.NewRegistry()
+			registry.Register(payment.ProviderFastPay, mock, nil)
+			router := payment.NewRouter(registry)
+
+			store := memory.NewStore(fake)
+			orderRepo := memory.NewOrderRepo(store)
+			paymentRepo := memory.NewPaymentRepo(store)
+			txs := repo.NewTxManager(store)
+			svc := service.NewOrderService(txs, orderRepo, paymentRepo, router,
+				service.WithClock(fake),
+				service.WithCrashHook(func(point service.CrashPoint, _ uuid.UUID) bool {
+					return point == tt.point
+				}))
+			var stats worker.PassStats
+			rw := worker.NewReconciliationWorker(txs, orderRepo, paymentRepo, router, fake, time.Second, worker.DefaultStuckAfter,
+				worker.WithPassHook(func(s worker.PassStats) { stats = s }))
+
+			order, err := svc.CreateOrder(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.Checkout(ctx, order.ID); !errors.Is(err, service.ErrCrashed) {
+				t.Fatalf("checkout err = %v, want %v", err, service.ErrCrashed)
+			}
+
+			// not stuck yet: an in-flight checkout is left alone
+			if err := rw.RunOnce(ctx); err != nil {
+				t.Fatal(err)
+			}
+			fake.Advance(worker.DefaultStuckAfter + time.Second)
+			if err := rw.RunOnce(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if !rw.LastSuccess().Equal(fake.Now()) {
+				t.Fatalf("last success = %s, want %s", rw.LastSuccess(), fake.Now())
+			}
+			wantStats := worker.PassStats{Stuck: 1, AbandonedFixed: 1}
+			switch {
+			case tt.point == service.CrashAfterCommit:
+				wantStats = worker.PassStats{} // settled before the crash
+			case tt.want == domain.OrderPaid:
+				wantStats = worker.PassStats{Stuck: 1, GhostsFound: 1, GhostsFixed: 1}
+			}
+			if stats != wantStats {
+				t.Fatalf("pass stats = %+v, want %+v", stats, wantStats)
+			}
+
+			got, err := orderRepo.FindById(ctx, order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.want {
+				t.Fatalf("status = %s, want %s", got.Status, tt.want)
+			}
+			payments, err := paymentRepo.ListByOrderId(ctx, order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			succeeded := 0
+			for _, p := range payments {
+				if p.Status == domain.PaymentSucceeded {
+					succeeded++
+				}
+			}
+			if want := map[domain.OrderStatus]int{domain.OrderPaid: 1}[tt.want]; succeeded != want {
+				t.Fatalf("%d succeeded payments, want %d", succeeded, want)
+			}
+		})
+	}
+}
+
+// TestReconcileSkipsTouchedOrder lists an order as stuck, then lets a
+// checkout claim it and send its charge before the pass settles it. The
+// pass must leave it alone: the provider had not seen the charge yet when
+// it was asked.
+func TestReconcileSkipsTouchedOrder(t *testing.T) {
+	ctx := context.Background()
+	fake := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := memory.NewStore(fake)
+	orderRepo := memory.NewOrderRepo(store)
+	paymentRepo := memory.NewPaymentRepo(store)
+	txs := repo.NewTxManager(store)
+
+	gate := &gatedGateway{
+		PaymentGateway: payment.NewMockGateway(payment.MockConfig{Clock: fake}, 1),
+		checked:        make(chan struct{}),
+		resumeCheck:    make(chan struct{}),
+		sent:           make(chan struct{}),
+		resumeCharge:   make(chan struct{}),
+	}
+	registry := payment.NewRegistry()
+	registry.Register(payment.ProviderFastPay, gate, nil)
+	router := payment.NewRouter(registry)
+	svc := service.NewOrderService(txs, orderRepo, paymentRepo, router, service.WithClock(fake))
+	rw := worker.NewReconciliationWorker(txs, orderRepo, paymentRepo, router, fake, time.Second, worker.DefaultStuckAfter)
+
+	order, err := svc.CreateOrder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(worker.DefaultStuckAfter + time.Second)
+
+	// the pass lists the order and FastPay has not seen it...
+	passDone := make(chan error, 1)
+	go func() { passDone <- rw.RunOnce(ctx) }()
+	<-gate.checked
+	// ...while the user clicks Pay and the charge goes out
+	checkoutDone := make(chan error, 1)
+	go func() {
+		_, err := svc.Checkout(ctx, order.ID)
+		checkoutDone <- err
+	}()
+	<-gate.sent
+	close(gate.resumeCheck)
+	if err := <-passDone; err != nil {
+		t.Fatal(err)
+	}
+	close(gate.resumeCharge)
+	if err := <-checkoutDone; err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+
+	got, err := orderRepo.FindById(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != domain.OrderPaid {
+		t.Fatalf("status = %s, want %s", got.Status, domain.OrderPaid)
+	}
+}
+
+// gatedGateway holds the first status check and the first charge until
+// told to go on. The status check is answered as of the time it was made.
+type gatedGateway struct {
+	payment.PaymentGateway
+	checked, resumeCheck chan struct{}
+	sent, resumeCharge   chan struct{}
+	checkOnce, sendOnce  sync.Once
+}
+
+func (g *gatedGateway) CheckStatus(ctx context.Context, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	res, err := g.PaymentGateway.CheckStatus(ctx, idempotencyKey)
+	g.checkOnce.Do(func() {
+		close(g.checked)
+		<-g.resumeCheck
+	})
+	return res, err
+}
+
+func (g *gatedGateway) Charge(ctx context.Context, amount int64, idempotencyKey uuid.UUID) (*payment.ChargeResult, error) {
+	g.sendOnce.Do(func() {
+		close(g.sent)
+		<-g.resumeCharge
+	})
+	return g.PaymentGateway.Charge(ctx, amount, idempotencyKey)
+}